@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Returned by an Authenticator when the request carries no credentials it
+// understands. Any other error means the credentials were present but invalid.
+var ErrNoCredentials = errors.New("no credentials")
+
+// The authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Roles   []string
+	Claims  map[string]interface{}
+}
+
+func (principal *Principal) HasRole(role string) bool {
+	if principal == nil {
+		return false
+	}
+	for _, principalRole := range principal.Roles {
+		if principalRole == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a key identifying everything authorization may look at in principal, for
+// keying per principal caches. Anonymous requests have an empty key.
+func principalKey(principal *Principal) string {
+	if principal == nil {
+		return ""
+	}
+	data, err := json.Marshal(principal)
+	if err != nil {
+		// Unlikely, but never share responses between principals that cannot be told apart.
+		return fmt.Sprintf("principal %p", principal)
+	}
+	return "principal " + string(data)
+}
+
+// Identifies the caller of a request. Set on EndpointHandler to authenticate requests
+// before Endpoint.GetResource is called; requests failing authentication get a 401
+// with Challenge as the WWW-Authenticate header.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+	Challenge() string
+}
+
+type principalContextKey struct{}
+
+// Returns a copy of ctx carrying principal.
+func ContextWithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey{}, principal)
+}
+
+// Returns the authenticated principal of a request, or nil for anonymous requests.
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalContextKey{}).(*Principal)
+	return principal
+}
+
+// Authenticates the request, returning it with the principal in its context. ok is
+// false if a 401 has been written.
+func authenticate(w http.ResponseWriter, r *http.Request, authenticator Authenticator, allowAnonymous bool) (*http.Request, bool) {
+	principal, err := authenticator.Authenticate(r)
+	if errors.Is(err, ErrNoCredentials) && allowAnonymous {
+		return r, true
+	}
+	if err != nil || principal == nil {
+		recordError(r, err)
+		w.Header().Set("WWW-Authenticate", authenticator.Challenge())
+		w.WriteHeader(http.StatusUnauthorized)
+		return r, false
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.principal = principal
+	}
+	return r.WithContext(ContextWithPrincipal(r.Context(), principal)), true
+}
+
+// Tries each Authenticator in turn, returning the first principal found. If none
+// succeed the first error other than ErrNoCredentials is returned.
+type Authenticators []Authenticator
+
+func (authenticators Authenticators) Authenticate(r *http.Request) (*Principal, error) {
+	var firstErr error
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err == nil {
+			return principal, nil
+		}
+		if firstErr == nil && !errors.Is(err, ErrNoCredentials) {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrNoCredentials
+}
+
+func (authenticators Authenticators) Challenge() string {
+	challenges := make([]string, len(authenticators))
+	for i, authenticator := range authenticators {
+		challenges[i] = authenticator.Challenge()
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// Authenticates requests carrying one of Keys, mapped to their principal, in Header.
+type APIKeyAuthenticator struct {
+	Header string // Defaults to X-API-Key.
+	Keys   map[string]*Principal
+}
+
+func (authenticator *APIKeyAuthenticator) header() string {
+	if authenticator.Header == "" {
+		return "X-API-Key"
+	}
+	return authenticator.Header
+}
+
+func (authenticator *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(authenticator.header())
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	var found *Principal
+	for candidate, principal := range authenticator.Keys {
+		// Compare every key in constant time so timing does not leak key prefixes.
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			found = principal
+		}
+	}
+	if found == nil {
+		return nil, errors.New("invalid API key")
+	}
+	return found, nil
+}
+
+func (authenticator *APIKeyAuthenticator) Challenge() string {
+	return `APIKey header="` + authenticator.header() + `"`
+}
+
+// Authenticates requests using HTTP Basic authentication. Verify returns the principal
+// for a username and password, or an error if they are invalid. Without Verify every
+// request carrying credentials is rejected.
+type BasicAuthenticator struct {
+	Realm  string
+	Verify func(username string, password string) (*Principal, error)
+}
+
+var errNoVerify = errors.New("basic authenticator has no Verify function")
+
+func (authenticator *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	if authenticator.Verify == nil {
+		return nil, errNoVerify
+	}
+	return authenticator.Verify(username, password)
+}
+
+func (authenticator *BasicAuthenticator) Challenge() string {
+	return `Basic realm="` + authenticator.Realm + `", charset="UTF-8"`
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type principalEndpoint struct{}
+
+func (endpoint principalEndpoint) GetResource(r *http.Request) Resource {
+	principal := PrincipalFromContext(r.Context())
+	if principal == nil {
+		return &JSONReadOnlyResource{Object: "anonymous"}
+	}
+	return &JSONReadOnlyResource{Object: principal.Subject}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	handler := EndpointHandler{
+		Endpoint:      principalEndpoint{},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{"secret": {Subject: "bob"}}},
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Request without credentials should give a 401.")
+	}
+	if w.Header().Get("WWW-Authenticate") != `APIKey header="X-API-Key"` {
+		t.Error("Wrong challenge " + w.Header().Get("WWW-Authenticate"))
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Request with an invalid key should give a 401.")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", "secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `"bob"` {
+		t.Error("Principal should be available to GetResource.")
+	}
+
+	handler.AllowAnonymous = true
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `"anonymous"` {
+		t.Error("Anonymous requests should be allowed.")
+	}
+}
+
+func TestBasicAuthentication(t *testing.T) {
+	authenticator := Authenticators{
+		&APIKeyAuthenticator{},
+		&BasicAuthenticator{
+			Realm: "pets",
+			Verify: func(username string, password string) (*Principal, error) {
+				if username == "bob" && password == "hunter2" {
+					return &Principal{Subject: username, Roles: []string{"admin"}}, nil
+				}
+				return nil, errors.New("invalid password")
+			},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("bob", "hunter2")
+	principal, err := authenticator.Authenticate(r)
+	if err != nil || principal.Subject != "bob" || !principal.HasRole("admin") {
+		t.Error("Valid basic credentials should authenticate.")
+	}
+
+	r.SetBasicAuth("bob", "wrong")
+	_, err = authenticator.Authenticate(r)
+	if err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Error("Invalid basic credentials should fail.")
+	}
+
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/", nil))
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Error("Request without credentials should have no credentials.")
+	}
+	if authenticator.Challenge() != `APIKey header="X-API-Key", Basic realm="pets", charset="UTF-8"` {
+		t.Error("Wrong challenge " + authenticator.Challenge())
+	}
+
+	r.SetBasicAuth("bob", "hunter2")
+	if _, err = (&BasicAuthenticator{}).Authenticate(r); err == nil || errors.Is(err, ErrNoCredentials) {
+		t.Error("Credentials should be rejected without Verify.")
+	}
+}
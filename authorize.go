@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Returned by an Authorizer to deny a request. Handlers respond with a 403, or a 404
+// if EndpointHandler.HideForbidden is set.
+var ErrForbidden = errors.New("forbidden")
+
+// Decides whether principal, nil for anonymous requests, may use method on a
+// resource. Implemented by resources, and settable on EndpointHandler for every
+// resource of an endpoint. Authorization is checked after the method is found to be
+// supported and before it is dispatched.
+type Authorizer interface {
+	Authorize(ctx context.Context, principal *Principal, method string) error
+}
+
+const (
+	// In a RolePolicy, allows any authenticated principal.
+	RoleAuthenticated = "*"
+	// In a RolePolicy, allows every request, including anonymous ones.
+	RoleAnyone = "anyone"
+)
+
+// A declarative Authorizer listing the roles allowed to use each method. The "*" key
+// applies to methods without an entry of their own; methods with neither are denied.
+//
+//	RolePolicy{
+//		http.MethodGet: {handlers.RoleAnyone},
+//		"*":            {"admin"},
+//	}
+type RolePolicy map[string][]string
+
+func (policy RolePolicy) Authorize(ctx context.Context, principal *Principal, method string) error {
+	roles, ok := policy[method]
+	if !ok {
+		roles = policy["*"]
+	}
+	for _, role := range roles {
+		if role == RoleAnyone || (principal != nil && (role == RoleAuthenticated || principal.HasRole(role))) {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+// Implemented by the objects of a JSONListResource or JSONReadOnlyListResource to hide
+// them from principals not allowed to read them.
+type RowAuthorizer interface {
+	CanRead(principal *Principal) bool
+}
+
+// Returns the objects of list principal may read.
+func filterRows(ctx context.Context, list []interface{}) []interface{} {
+	principal := PrincipalFromContext(ctx)
+	filtered := make([]interface{}, 0, len(list))
+	for _, obj := range list {
+		rowAuthorizer, isRowAuthorizer := obj.(RowAuthorizer)
+		if isRowAuthorizer && !rowAuthorizer.CanRead(principal) {
+			continue
+		}
+		filtered = append(filtered, obj)
+	}
+	return filtered
+}
+
+// Checks the endpoint and resource authorizers before calling handler.
+type authorizationHandler struct {
+	authorizers   []Authorizer
+	hideForbidden bool
+	handler       http.Handler
+}
+
+func (handler authorizationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	principal := PrincipalFromContext(r.Context())
+	for _, authorizer := range handler.authorizers {
+		err := authorizer.Authorize(r.Context(), principal, r.Method)
+		if err == nil {
+			continue
+		}
+		if errorStatus(err, http.StatusForbidden) == http.StatusForbidden && handler.hideForbidden {
+			// Log why, but answer as if there was nothing there.
+			recordError(r, err)
+			writeError(w, r, ErrNotFound, http.StatusNotFound)
+			return
+		}
+		writeError(w, r, err, http.StatusForbidden)
+		return
+	}
+	handler.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type note struct {
+	Owner string `json:"owner"`
+	Text  string `json:"text"`
+}
+
+func (note note) CanRead(principal *Principal) bool {
+	return principal != nil && (principal.Subject == note.Owner || principal.HasRole("admin"))
+}
+
+type noteEndpoint struct{}
+
+func (endpoint noteEndpoint) GetResource(r *http.Request) Resource {
+	if r.URL.Path == "/secret" {
+		return secretResource{}
+	}
+	return &JSONReadOnlyListResource{ObjectList: []interface{}{note{Owner: "bob", Text: "a"}, note{Owner: "jim", Text: "b"}}}
+}
+
+type secretResource struct {
+	readable
+}
+
+func (resource secretResource) Authorize(ctx context.Context, principal *Principal, method string) error {
+	if !principal.HasRole("admin") {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func TestAuthorization(t *testing.T) {
+	handler := EndpointHandler{
+		Endpoint: noteEndpoint{},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{
+			"bob":   {Subject: "bob"},
+			"admin": {Subject: "root", Roles: []string{"admin"}},
+		}},
+		AllowAnonymous: true,
+		Authorizer:     RolePolicy{http.MethodGet: {RoleAuthenticated}},
+	}
+	request := func(path string, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("/", ""); w.Code != http.StatusForbidden {
+		t.Error("Anonymous request should be denied by the policy.")
+	}
+
+	w := request("/", "bob")
+	notes := []note{}
+	json.Unmarshal(w.Body.Bytes(), &notes)
+	if w.Code != http.StatusOK || len(notes) != 1 || notes[0].Owner != "bob" {
+		t.Error("List should only contain rows the principal may read.")
+	}
+	w = request("/", "admin")
+	json.Unmarshal(w.Body.Bytes(), &notes)
+	if len(notes) != 2 {
+		t.Error("Admin should read every row.")
+	}
+
+	if w := request("/secret", "bob"); w.Code != http.StatusForbidden {
+		t.Error("Resource authorizer should deny non admins.")
+	}
+	if w := request("/secret", "admin"); w.Code != http.StatusOK {
+		t.Error("Resource authorizer should allow admins.")
+	}
+	handler.HideForbidden = true
+	if w := request("/secret", "bob"); w.Code != http.StatusNotFound {
+		t.Error("Denied request should be hidden as a 404.")
+	}
+}
+
+func TestRolePolicy(t *testing.T) {
+	policy := RolePolicy{
+		http.MethodGet: {RoleAnyone},
+		"*":            {"admin"},
+	}
+	ctx := context.Background()
+	if policy.Authorize(ctx, nil, http.MethodGet) != nil {
+		t.Error("Anyone should be allowed to GET.")
+	}
+	if policy.Authorize(ctx, &Principal{Subject: "bob"}, http.MethodDelete) != ErrForbidden {
+		t.Error("Non admins should not be allowed to DELETE.")
+	}
+	if policy.Authorize(ctx, &Principal{Roles: []string{"admin"}}, http.MethodDelete) != nil {
+		t.Error("Admins should be allowed to DELETE.")
+	}
+}
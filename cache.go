@@ -0,0 +1,364 @@
+package handlers
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How clients and caches may cache a resource's GET responses.
+type CachePolicy struct {
+	MaxAge       time.Duration // max-age, for every cache.
+	SharedMaxAge time.Duration // s-maxage, overriding MaxAge for shared caches.
+
+	// Public allows shared caches to store responses to authenticated requests,
+	// Private only allows the client's own cache to store the response.
+	Public  bool
+	Private bool
+
+	NoStore bool
+
+	// How long a stale response may be served while it is revalidated.
+	StaleWhileRevalidate time.Duration
+}
+
+// Returns the Cache-Control header value for the policy.
+func (policy CachePolicy) String() string {
+	if policy.NoStore {
+		return "no-store"
+	}
+	directives := make([]string, 0, 4)
+	if policy.Public {
+		directives = append(directives, "public")
+	}
+	if policy.Private {
+		directives = append(directives, "private")
+	}
+	directives = append(directives, "max-age="+strconv.Itoa(int(policy.MaxAge.Seconds())))
+	if policy.SharedMaxAge > 0 {
+		directives = append(directives, "s-maxage="+strconv.Itoa(int(policy.SharedMaxAge.Seconds())))
+	}
+	if policy.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+strconv.Itoa(int(policy.StaleWhileRevalidate.Seconds())))
+	}
+	return strings.Join(directives, ", ")
+}
+
+// A Readable resource implementing Cacheable has its policy sent as the Cache-Control
+// header of GET responses.
+type Cacheable interface {
+	CachePolicy() CachePolicy
+}
+
+// Returns the Cache-Control directives in value, keyed by lower case name.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(value, ",") {
+		name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// An in-process shared cache of GET responses. Set Cache on EndpointHandler to cache
+// the endpoint's responses according to the Cache-Control header its resources send,
+// see Cacheable. Responses are keyed by URL, the principal and the request headers
+// named by their Vary header, and are only served after the request has been
+// authenticated and authorized. As a shared cache it does not store private
+// responses, nor responses to authenticated requests unless they are public or have
+// an s-maxage.
+//
+// All responses of an endpoint are invalidated when the endpoint serves a
+// successful POST, PUT, PATCH or DELETE.
+type ResponseCache struct {
+	MaxEntries int // Defaults to 1000. The least recently used entries are evicted.
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recent  *list.List
+	vary    map[string][]string
+	// Incremented when an endpoint is invalidated, so responses read before the
+	// invalidation are not stored after it.
+	generations map[string]uint64
+}
+
+type cacheEntry struct {
+	key        string
+	endpoint   string
+	base       http.Header
+	header     http.Header
+	status     int
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	staleUntil time.Time
+	refreshing bool
+}
+
+func (cache *ResponseCache) maxEntries() int {
+	if cache.MaxEntries <= 0 {
+		return 1000
+	}
+	return cache.MaxEntries
+}
+
+// Removes every response of endpoint from the cache.
+func (cache *ResponseCache) Invalidate(endpoint string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.generations == nil {
+		cache.generations = make(map[string]uint64)
+	}
+	cache.generations[endpoint]++
+	for key, element := range cache.entries {
+		if element.Value.(*cacheEntry).endpoint == endpoint {
+			cache.recent.Remove(element)
+			delete(cache.entries, key)
+		}
+	}
+	for base := range cache.vary {
+		if strings.HasPrefix(base, endpoint+" ") {
+			delete(cache.vary, base)
+		}
+	}
+}
+
+func cacheBaseKey(endpoint string, r *http.Request) string {
+	return endpoint + " " + r.URL.RequestURI()
+}
+
+func cacheKey(base string, vary []string, r *http.Request) string {
+	// Fields and rows are filtered for the principal, so responses are not shared.
+	key := base + "\n" + principalKey(PrincipalFromContext(r.Context()))
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(r.Header.Values(name), ", ")
+	}
+	return key
+}
+
+func (cache *ResponseCache) generation(endpoint string) uint64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.generations[endpoint]
+}
+
+func (cache *ResponseCache) lookup(endpoint string, r *http.Request) *cacheEntry {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	base := cacheBaseKey(endpoint, r)
+	key := cacheKey(base, cache.vary[base], r)
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.staleUntil) {
+		cache.recent.Remove(element)
+		delete(cache.entries, key)
+		return nil
+	}
+	cache.recent.MoveToFront(element)
+	return entry
+}
+
+// Stores the response, read in the given generation of the endpoint, if it may be
+// cached.
+func (cache *ResponseCache) store(endpoint string, generation uint64, r *http.Request, base http.Header, response *bufferedResponse) {
+	if response.status != http.StatusOK {
+		return
+	}
+	directives := parseCacheControl(response.header.Get("Cache-Control"))
+	_, noStore := directives["no-store"]
+	_, private := directives["private"]
+	_, noCache := directives["no-cache"]
+	_, public := directives["public"]
+	if noStore || private || noCache {
+		return
+	}
+	maxAge, ok := directiveSeconds(directives, "s-maxage")
+	authenticated := PrincipalFromContext(r.Context()) != nil || r.Header.Get("Authorization") != ""
+	if authenticated && !public && !ok {
+		return
+	}
+	if !ok {
+		maxAge, ok = directiveSeconds(directives, "max-age")
+	}
+	if !ok || maxAge <= 0 {
+		return
+	}
+	stale, _ := directiveSeconds(directives, "stale-while-revalidate")
+
+	vary := make([]string, 0)
+	for _, value := range response.header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return
+			}
+			if name != "" && !containsFold(vary, name) {
+				vary = append(vary, name)
+			}
+		}
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		endpoint:   endpoint,
+		base:       base,
+		header:     changedHeaders(base, response.header),
+		status:     response.status,
+		body:       response.body.Bytes(),
+		stored:     now,
+		expires:    now.Add(maxAge),
+		staleUntil: now.Add(maxAge + stale),
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.generations[endpoint] != generation {
+		return
+	}
+	if cache.entries == nil {
+		cache.entries = make(map[string]*list.Element)
+		cache.recent = list.New()
+		cache.vary = make(map[string][]string)
+	}
+	baseKey := cacheBaseKey(endpoint, r)
+	cache.vary[baseKey] = vary
+	entry.key = cacheKey(baseKey, vary, r)
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.recent.Remove(element)
+	}
+	cache.entries[entry.key] = cache.recent.PushFront(entry)
+	for cache.recent.Len() > cache.maxEntries() {
+		oldest := cache.recent.Back()
+		cache.recent.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Returns the headers of response that the handler added or changed from base.
+func changedHeaders(base http.Header, response http.Header) http.Header {
+	changed := make(http.Header)
+	for name, values := range response {
+		if strings.Join(base.Values(name), "\n") != strings.Join(values, "\n") {
+			changed[name] = append([]string(nil), values...)
+		}
+	}
+	return changed
+}
+
+// Caches the GET responses of a method handler, or invalidates the endpoint's
+// responses after a successful write.
+type cacheHandler struct {
+	cache    *ResponseCache
+	endpoint string
+	handler  http.Handler
+}
+
+func (handler cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		recorder := &responseRecorder{ResponseWriter: w}
+		handler.handler.ServeHTTP(recorder, r)
+		if status := recorder.statusCode(); status >= 200 && status < 300 {
+			handler.cache.Invalidate(handler.endpoint)
+		}
+		return
+	}
+
+	// Long polls wait for a change rather than being answered from the cache.
+	if isLongPoll(r) {
+		handler.handler.ServeHTTP(w, r)
+		return
+	}
+
+	requestDirectives := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noCache := requestDirectives["no-cache"]
+	if !noCache {
+		entry := handler.cache.lookup(handler.endpoint, r)
+		if entry != nil {
+			handler.serveEntry(w, r, entry)
+			return
+		}
+	}
+
+	generation := handler.cache.generation(handler.endpoint)
+	base := w.Header().Clone()
+	response := &bufferedResponse{header: w.Header().Clone()}
+	handler.handler.ServeHTTP(response, r)
+	handler.cache.store(handler.endpoint, generation, r, base, response)
+	response.flush(w)
+}
+
+func (handler cacheHandler) serveEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	now := time.Now()
+	if now.After(entry.expires) {
+		handler.refresh(r, entry)
+	}
+	header := w.Header()
+	for name, values := range entry.header {
+		if name == "Vary" {
+			for _, value := range values {
+				if !containsFold(header.Values("Vary"), value) {
+					header.Add(name, value)
+				}
+			}
+			continue
+		}
+		header[name] = values
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(entry.stored).Seconds())))
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, header.Get("ETag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// Revalidates a stale entry in the background, once at a time.
+func (handler cacheHandler) refresh(r *http.Request, entry *cacheEntry) {
+	handler.cache.mu.Lock()
+	refreshing := entry.refreshing
+	entry.refreshing = true
+	handler.cache.mu.Unlock()
+	if refreshing {
+		return
+	}
+
+	// A fresh context: the request's carries its span and log record, which are done
+	// with once it has been answered. Keep the principal to read as the same caller.
+	ctx := ContextWithPrincipal(context.Background(), PrincipalFromContext(r.Context()))
+	if endpoint := EndpointFromContext(r.Context()); endpoint != nil {
+		ctx = context.WithValue(ctx, endpointContextKey{}, endpoint)
+	}
+	background := r.Clone(ctx)
+	generation := handler.cache.generation(handler.endpoint)
+	go func() {
+		response := &bufferedResponse{header: entry.base.Clone()}
+		handler.handler.ServeHTTP(response, background)
+		handler.cache.store(handler.endpoint, generation, background, entry.base, response)
+		handler.cache.mu.Lock()
+		entry.refreshing = false
+		handler.cache.mu.Unlock()
+	}()
+}
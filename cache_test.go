@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type cachedCounter struct {
+	reads  *int32
+	value  *string
+	policy CachePolicy
+}
+
+func (counter cachedCounter) GetContentType() string {
+	return "application/json"
+}
+
+func (counter cachedCounter) Read() ([]byte, error) {
+	atomic.AddInt32(counter.reads, 1)
+	return []byte(*counter.value), nil
+}
+
+func (counter cachedCounter) Update(data []byte) error {
+	*counter.value = string(data)
+	return nil
+}
+
+func (counter cachedCounter) CachePolicy() CachePolicy {
+	return counter.policy
+}
+
+type cachedCounterEndpoint struct {
+	counter cachedCounter
+}
+
+func (endpoint cachedCounterEndpoint) GetResource(r *http.Request) Resource {
+	return endpoint.counter
+}
+
+func newCachedCounter(policy CachePolicy) (cachedCounter, *int32) {
+	reads := int32(0)
+	value := `"a"`
+	return cachedCounter{reads: &reads, value: &value, policy: policy}, &reads
+}
+
+func TestCachePolicyString(t *testing.T) {
+	policy := CachePolicy{Public: true, MaxAge: time.Minute, SharedMaxAge: time.Hour, StaleWhileRevalidate: 30 * time.Second}
+	if policy.String() != "public, max-age=60, s-maxage=3600, stale-while-revalidate=30" {
+		t.Error("Wrong Cache-Control " + policy.String())
+	}
+	if (CachePolicy{NoStore: true, MaxAge: time.Minute}).String() != "no-store" {
+		t.Error("no-store should override other directives.")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	counter, reads := newCachedCounter(CachePolicy{MaxAge: time.Minute})
+	handler := EndpointHandler{Endpoint: cachedCounterEndpoint{counter: counter}, Name: "counter", Cache: &ResponseCache{}}
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/counter", nil))
+		if w.Code != http.StatusOK || w.Body.String() != `"a"` || w.Header().Get("Cache-Control") != "max-age=60" {
+			t.Fatal("Cached responses should match the original " + w.Body.String())
+		}
+	}
+	if *reads != 1 {
+		t.Error("Repeated GETs should be served from the cache.")
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/counter?other", nil))
+	if *reads != 2 {
+		t.Error("Other URLs should not share a cache entry.")
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/counter", strings.NewReader(`"b"`)))
+	if w.Code != http.StatusOK {
+		t.Fatal("Update failed.")
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/counter", nil))
+	if w.Body.String() != `"b"` {
+		t.Error("Writes should invalidate the endpoint's cached responses.")
+	}
+}
+
+func TestResponseCacheVary(t *testing.T) {
+	counter, reads := newCachedCounter(CachePolicy{MaxAge: time.Minute})
+	varyAccept := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept")
+			next.ServeHTTP(w, r)
+		})
+	}
+	handler := EndpointHandler{
+		Endpoint:         cachedCounterEndpoint{counter: counter},
+		Cache:            &ResponseCache{},
+		MethodMiddleware: map[string][]Middleware{http.MethodGet: {varyAccept}},
+	}
+	for _, accept := range []string{"application/json", "text/plain", "application/json"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if len(w.Header().Values("Vary")) != 1 {
+			t.Error("Vary should not be repeated on cached responses.")
+		}
+	}
+	if *reads != 2 {
+		t.Error("Responses should be cached per Vary header value.")
+	}
+}
+
+func TestResponseCacheNotStored(t *testing.T) {
+	policies := []CachePolicy{{MaxAge: time.Minute, Private: true}, {NoStore: true}, {}}
+	for _, policy := range policies {
+		counter, reads := newCachedCounter(policy)
+		handler := EndpointHandler{Endpoint: cachedCounterEndpoint{counter: counter}, Cache: &ResponseCache{}}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		if *reads != 2 {
+			t.Error("Should not cache " + policy.String())
+		}
+	}
+
+	counter, reads := newCachedCounter(CachePolicy{MaxAge: time.Minute})
+	handler := EndpointHandler{
+		Endpoint:      cachedCounterEndpoint{counter: counter},
+		Cache:         &ResponseCache{},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{"key": {Subject: "bob"}}},
+	}
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-API-Key", "key")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if *reads != 2 {
+		t.Error("Should not share responses to authenticated requests unless they are public.")
+	}
+}
+
+func TestResponseCachePrincipals(t *testing.T) {
+	counter, reads := newCachedCounter(CachePolicy{MaxAge: time.Minute, Public: true})
+	handler := EndpointHandler{
+		Endpoint: cachedCounterEndpoint{counter: counter},
+		Cache:    &ResponseCache{},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{
+			"bob":   {Subject: "bob"},
+			"jim":   {Subject: "jim"},
+			"admin": {Subject: "bob", Roles: []string{"admin"}},
+		}},
+	}
+	for _, key := range []string{"bob", "bob", "jim", "admin"} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-API-Key", key)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if *reads != 3 {
+		t.Error("Responses should only be shared by requests of the same principal.", *reads)
+	}
+}
+
+func TestResponseCacheStaleWhileRevalidate(t *testing.T) {
+	counter, reads := newCachedCounter(CachePolicy{MaxAge: time.Second, StaleWhileRevalidate: time.Minute})
+	cache := &ResponseCache{}
+	handler := EndpointHandler{Endpoint: cachedCounterEndpoint{counter: counter}, Cache: cache}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	// Age the entry past its max-age.
+	cache.mu.Lock()
+	for _, element := range cache.entries {
+		element.Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+	}
+	cache.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != `"a"` {
+		t.Error("Stale responses should be served while revalidating.")
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(reads) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(reads) != 2 {
+		t.Error("Stale responses should be revalidated in the background.")
+	}
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// The kinds of ChangeEvent.
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// A change to an object of a collection, as published to a ChangeBus.
+type ChangeEvent struct {
+	ID         uint64 // Assigned by the bus, increasing.
+	Type       string
+	Collection string
+	Key        string
+	Object     interface{} // A copy of the object after the change, or before a delete.
+	Time       time.Time
+
+	fields *FieldPolicy
+}
+
+// Returns the event as JSON, with the fields of the object the principal in ctx may
+// not read removed.
+func (event ChangeEvent) render(ctx context.Context) ([]byte, error) {
+	object, err := marshalReadable(ctx, event.Object, event.fields)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		ID         uint64          `json:"id"`
+		Type       string          `json:"type"`
+		Collection string          `json:"collection"`
+		Key        string          `json:"key,omitempty"`
+		Object     json.RawMessage `json:"object,omitempty"`
+		Time       time.Time       `json:"time"`
+	}{event.ID, event.Type, event.Collection, event.Key, object, event.Time})
+}
+
+// Returns whether the principal in ctx may see the event's object, see RowAuthorizer.
+func (event ChangeEvent) visible(ctx context.Context) bool {
+	rowAuthorizer, isRowAuthorizer := unwrapHookObject(event.Object).(RowAuthorizer)
+	return !isRowAuthorizer || rowAuthorizer.CanRead(PrincipalFromContext(ctx))
+}
+
+// Distributes change events to subscribers and keeps the latest ReplaySize events so
+// that subscribers can resume after reconnecting. Set Changes on JSONResource and
+// JSONListResource to publish their creates, updates and deletes, and serve the
+// changes with ChangeStream.
+type ChangeBus struct {
+	ReplaySize int // Defaults to 1000.
+
+	mu          sync.Mutex
+	lastID      uint64
+	replay      []ChangeEvent
+	subscribers map[*Subscription]struct{}
+}
+
+// Receives the events of a collection, or of one of its objects, from a ChangeBus.
+// Subscribers that fall behind are dropped: their channel is closed and Dropped
+// returns true. They can resume from the last event they received.
+type Subscription struct {
+	bus        *ChangeBus
+	collection string
+	key        string
+	events     chan ChangeEvent
+	dropped    bool
+	closed     bool
+}
+
+const subscriptionBuffer = 64
+
+func (bus *ChangeBus) replaySize() int {
+	if bus.ReplaySize <= 0 {
+		return 1000
+	}
+	return bus.ReplaySize
+}
+
+// Publishes event, assigning its ID and time.
+func (bus *ChangeBus) Publish(event ChangeEvent) ChangeEvent {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.lastID++
+	event.ID = bus.lastID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	bus.replay = append(bus.replay, event)
+	if overflow := len(bus.replay) - bus.replaySize(); overflow > 0 {
+		bus.replay = append([]ChangeEvent(nil), bus.replay[overflow:]...)
+	}
+	for subscription := range bus.subscribers {
+		if !subscription.matches(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			subscription.dropped = true
+			bus.unsubscribe(subscription)
+		}
+	}
+	return event
+}
+
+// Subscribes to the events of collection, or of the object with key if key is not
+// empty. An empty collection subscribes to every event.
+func (bus *ChangeBus) Subscribe(collection string, key string) *Subscription {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.subscribe(collection, key)
+}
+
+// Subscribes like Subscribe and returns the buffered events published after
+// lastEventID. complete is false if some of those events are no longer buffered.
+func (bus *ChangeBus) Resume(collection string, key string, lastEventID uint64) (subscription *Subscription, missed []ChangeEvent, complete bool) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	subscription = bus.subscribe(collection, key)
+	// An ID beyond the last one was not issued by this bus, for instance before a
+	// restart, so nothing can be said about what was missed.
+	complete = lastEventID == bus.lastID || (lastEventID < bus.lastID && len(bus.replay) > 0 && bus.replay[0].ID <= lastEventID+1)
+	for _, event := range bus.replay {
+		if event.ID > lastEventID && subscription.matches(event) {
+			missed = append(missed, event)
+		}
+	}
+	return subscription, missed, complete
+}
+
+// Returns the ID of the last event published.
+func (bus *ChangeBus) LastEventID() uint64 {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.lastID
+}
+
+func (bus *ChangeBus) subscribe(collection string, key string) *Subscription {
+	if bus.subscribers == nil {
+		bus.subscribers = make(map[*Subscription]struct{})
+	}
+	subscription := &Subscription{
+		bus:        bus,
+		collection: collection,
+		key:        key,
+		events:     make(chan ChangeEvent, subscriptionBuffer),
+	}
+	bus.subscribers[subscription] = struct{}{}
+	return subscription
+}
+
+func (bus *ChangeBus) unsubscribe(subscription *Subscription) {
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	delete(bus.subscribers, subscription)
+	close(subscription.events)
+}
+
+func (subscription *Subscription) matches(event ChangeEvent) bool {
+	return (subscription.collection == "" || subscription.collection == event.Collection) &&
+		(subscription.key == "" || subscription.key == event.Key)
+}
+
+// Returns the channel events are delivered on. It is closed when the subscription is
+// closed or dropped.
+func (subscription *Subscription) Events() <-chan ChangeEvent {
+	return subscription.events
+}
+
+func (subscription *Subscription) Dropped() bool {
+	subscription.bus.mu.Lock()
+	defer subscription.bus.mu.Unlock()
+	return subscription.dropped
+}
+
+func (subscription *Subscription) Close() {
+	subscription.bus.mu.Lock()
+	defer subscription.bus.mu.Unlock()
+	subscription.bus.unsubscribe(subscription)
+}
+
+// Publishes a change of obj, if bus is set, once the transaction of ctx commits. The
+// object is copied so later changes do not alter the event.
+func publishChange(ctx context.Context, bus *ChangeBus, changeType string, collection string, key string, obj interface{}, fields *FieldPolicy) {
+	if bus == nil {
+		return
+	}
+	snapshot, err := copyObject(obj)
+	if err != nil {
+		snapshot = nil
+	}
+	event := ChangeEvent{Type: changeType, Collection: collection, Key: key, Object: snapshot, fields: fields}
+	afterCommit(ctx, func() { bus.Publish(event) })
+}
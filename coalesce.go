@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Collapses identical concurrent GETs into a single Read. Set Coalescer on
+// EndpointHandler for endpoints whose resources are expensive to read and requested
+// by many clients at once. Requests are identical if they are for the same endpoint,
+// URL and Accept header by the same principal, with the same roles and claims, so a
+// read is never shared between principals who may see different rows or fields.
+//
+// The shared Read runs with a context that is not cancelled when the first client
+// goes away, so the other waiting clients still get the result.
+type ReadCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*readCall
+	stats map[string]*CoalescingStats
+}
+
+// Counts the reads of an endpoint's GETs: Executed reads called Read, Shared reads
+// waited for one of them instead.
+type CoalescingStats struct {
+	Executed uint64
+	Shared   uint64
+}
+
+var errReadFailed = errors.New("shared read failed")
+
+type readCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Returns the reads made through the coalescer, keyed by endpoint name.
+func (coalescer *ReadCoalescer) Stats() map[string]CoalescingStats {
+	coalescer.mu.Lock()
+	defer coalescer.mu.Unlock()
+	stats := make(map[string]CoalescingStats, len(coalescer.stats))
+	for endpoint, endpointStats := range coalescer.stats {
+		stats[endpoint] = *endpointStats
+	}
+	return stats
+}
+
+func coalescingKey(endpoint string, r *http.Request) string {
+	principal := principalKey(PrincipalFromContext(r.Context()))
+	return endpoint + "\n" + r.URL.RequestURI() + "\n" + r.Header.Get("Accept") + "\n" + principal
+}
+
+// Reads readable, or waits for an identical read in progress. shared reports whether
+// the result came from another request's read.
+func (coalescer *ReadCoalescer) read(r *http.Request, endpoint string, readable Readable) (data []byte, shared bool, err error) {
+	key := coalescingKey(endpoint, r)
+	coalescer.mu.Lock()
+	if coalescer.calls == nil {
+		coalescer.calls = make(map[string]*readCall)
+		coalescer.stats = make(map[string]*CoalescingStats)
+	}
+	stats := coalescer.stats[endpoint]
+	if stats == nil {
+		stats = &CoalescingStats{}
+		coalescer.stats[endpoint] = stats
+	}
+	call, inProgress := coalescer.calls[key]
+	if inProgress {
+		stats.Shared++
+		coalescer.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.data, true, call.err
+		case <-r.Context().Done():
+			return nil, true, r.Context().Err()
+		}
+	}
+	// Waiters get an error rather than an empty body if Read panics.
+	call = &readCall{done: make(chan struct{}), err: errReadFailed}
+	coalescer.calls[key] = call
+	stats.Executed++
+	coalescer.mu.Unlock()
+
+	defer func() {
+		coalescer.mu.Lock()
+		delete(coalescer.calls, key)
+		coalescer.mu.Unlock()
+		close(call.done)
+	}()
+	call.data, call.err = readResource(context.WithoutCancel(r.Context()), readable)
+	return call.data, false, call.err
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type slowReadable struct {
+	reads   *int32
+	release chan struct{}
+}
+
+func (readable slowReadable) GetContentType() string {
+	return "application/json"
+}
+
+func (readable slowReadable) Read() ([]byte, error) {
+	atomic.AddInt32(readable.reads, 1)
+	<-readable.release
+	return []byte(`{"hot":true}`), nil
+}
+
+type slowEndpoint struct {
+	readable slowReadable
+}
+
+func (endpoint slowEndpoint) GetResource(r *http.Request) Resource {
+	return endpoint.readable
+}
+
+// Sends requests concurrently, releasing the reads once all of them are waiting.
+func serveConcurrently(handler http.Handler, coalescer *ReadCoalescer, release chan struct{}, requests []*http.Request) []*httptest.ResponseRecorder {
+	responses := make([]*httptest.ResponseRecorder, len(requests))
+	var wg sync.WaitGroup
+	for i, r := range requests {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder, r *http.Request) {
+			defer wg.Done()
+			handler.ServeHTTP(w, r)
+		}(responses[i], r)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		total := uint64(0)
+		for _, stats := range coalescer.Stats() {
+			total += stats.Executed + stats.Shared
+		}
+		if total == uint64(len(requests)) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	return responses
+}
+
+func TestReadCoalescing(t *testing.T) {
+	reads := int32(0)
+	readable := slowReadable{reads: &reads, release: make(chan struct{})}
+	coalescer := &ReadCoalescer{}
+	metrics := &Metrics{}
+	handler := EndpointHandler{Endpoint: slowEndpoint{readable: readable}, Name: "hot", Coalescer: coalescer, Metrics: metrics}
+
+	requests := make([]*http.Request, 20)
+	for i := range requests {
+		requests[i] = httptest.NewRequest(http.MethodGet, "/hot", nil)
+	}
+	for _, w := range serveConcurrently(handler, coalescer, readable.release, requests) {
+		if w.Code != http.StatusOK || w.Body.String() != `{"hot":true}` {
+			t.Error("Every waiter should get the response.")
+		}
+	}
+	if reads != 1 {
+		t.Error("Concurrent identical reads should be collapsed.")
+	}
+	if stats := coalescer.Stats()["hot"]; stats.Executed != 1 || stats.Shared != 19 {
+		t.Error("Wrong coalescing stats.")
+	}
+	exposition := metrics.exposition()
+	if !strings.Contains(exposition, `handlers_coalesced_reads_total{endpoint="hot",result="shared"} 19`) ||
+		!strings.Contains(exposition, `handlers_coalesced_reads_total{endpoint="hot",result="executed"} 1`) {
+		t.Error("Coalescing should be exported per endpoint.\n" + exposition)
+	}
+}
+
+func TestReadCoalescingScope(t *testing.T) {
+	reads := int32(0)
+	readable := slowReadable{reads: &reads, release: make(chan struct{})}
+	coalescer := &ReadCoalescer{}
+	handler := EndpointHandler{
+		Endpoint:  slowEndpoint{readable: readable},
+		Coalescer: coalescer,
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{
+			"a":       {Subject: "alice"},
+			"b":       {Subject: "bob"},
+			"admin":   {Subject: "alice", Roles: []string{"admin"}},
+			"service": {Roles: []string{"service"}},
+		}},
+		AllowAnonymous: true,
+	}
+
+	requests := make([]*http.Request, 0)
+	for _, key := range []string{"a", "b", "admin", "service", ""} {
+		r := httptest.NewRequest(http.MethodGet, "/hot", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		requests = append(requests, r)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/hot", nil)
+	r.Header.Set("Accept", "text/plain")
+	requests = append(requests, r)
+
+	serveConcurrently(handler, coalescer, readable.release, requests)
+	if reads != 6 {
+		t.Error("Reads should not be shared between principals, roles or Accept headers.", reads)
+	}
+}
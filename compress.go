@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Returns a writer compressing into w. Closing it must flush any buffered data but
+// not close w.
+type Encoder func(w io.Writer) (io.WriteCloser, error)
+
+var encoders = struct {
+	sync.RWMutex
+	byName map[string]Encoder
+}{byName: map[string]Encoder{
+	"gzip": func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	},
+	"deflate": func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(w), nil
+	},
+}}
+
+// Returns a reader decompressing r.
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+var decoders = struct {
+	sync.RWMutex
+	byName map[string]Decoder
+}{byName: map[string]Decoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	"deflate": decodeDeflate,
+}}
+
+// Makes a content coding available to every Compressor, for instance br using a
+// third party package:
+//
+//	handlers.RegisterEncoder("br", func(w io.Writer) (io.WriteCloser, error) {
+//		return brotli.NewWriter(w), nil
+//	})
+//
+// gzip and deflate are registered by default, and zstd when built with the zstd tag.
+func RegisterEncoder(name string, encoder Encoder) {
+	encoders.Lock()
+	defer encoders.Unlock()
+	encoders.byName[strings.ToLower(name)] = encoder
+}
+
+func registeredEncoder(name string) Encoder {
+	encoders.RLock()
+	defer encoders.RUnlock()
+	return encoders.byName[name]
+}
+
+// Makes a content coding of request bodies decodable, for instance br:
+//
+//	handlers.RegisterDecoder("br", func(r io.Reader) (io.ReadCloser, error) {
+//		return ioutil.NopCloser(brotli.NewReader(r)), nil
+//	})
+//
+// gzip and deflate are registered by default, and zstd when built with the zstd tag.
+func RegisterDecoder(name string, decoder Decoder) {
+	decoders.Lock()
+	defer decoders.Unlock()
+	decoders.byName[strings.ToLower(name)] = decoder
+}
+
+// Returns the names of the registered decoders, sorted.
+func registeredDecoders() []string {
+	decoders.RLock()
+	defer decoders.RUnlock()
+	names := make([]string, 0, len(decoders.byName))
+	for name := range decoders.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// Returns body decoded according to the Content-Encoding header values, which list
+// the codings in the order they were applied.
+func decodeBody(body io.ReadCloser, contentEncoding []string) (io.ReadCloser, error) {
+	codings := make([]string, 0, 1)
+	for _, value := range contentEncoding {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+
+	decoded := body
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoders.RLock()
+		decoder := decoders.byName[codings[i]]
+		decoders.RUnlock()
+		if decoder == nil {
+			return nil, errUnsupportedEncoding
+		}
+		reader, err := decoder(decoded)
+		if err != nil {
+			return nil, &StatusError{Status: http.StatusBadRequest, Message: "invalid " + codings[i] + " body"}
+		}
+		decoded = reader
+	}
+	return decoded, nil
+}
+
+// Decodes the deflate coding, zlib wrapped deflate data, also accepting the raw
+// deflate data some clients send instead.
+func decodeDeflate(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// Content types that are already compressed. A type ending in "/" matches every
+// subtype.
+var DefaultSkipContentTypes = []string{
+	"image/", "video/", "audio/", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/pdf",
+}
+
+// Compresses responses in the content coding the client prefers in Accept-Encoding.
+// Set Compressor on EndpointHandler or use Middleware around any handler.
+//
+// Bodies smaller than MinSize, responses without a body, responses that already have
+// a Content-Encoding or Cache-Control: no-transform and content types in
+// SkipContentTypes are sent as they are. Compressed responses get a weak ETag, as
+// their bytes differ from the uncompressed representation, and every response
+// varies by Accept-Encoding.
+type Compressor struct {
+	MinSize int // Defaults to 1KB.
+
+	// Codings in order of preference, for clients accepting several equally. Codings
+	// must be registered with RegisterEncoder. Defaults to zstd, br, gzip and deflate,
+	// skipping those not registered: zstd is only available when built with the zstd
+	// tag, and br only once registered.
+	Encodings []string
+
+	SkipContentTypes []string // Defaults to DefaultSkipContentTypes.
+}
+
+var defaultEncodings = []string{"zstd", "br", "gzip", "deflate"}
+
+func (compressor *Compressor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := compressor.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writer := &compressWriter{ResponseWriter: w, compressor: compressor, encoding: encoding}
+		defer writer.close()
+		next.ServeHTTP(writer, r)
+	})
+}
+
+func (compressor *Compressor) minSize() int {
+	if compressor.MinSize <= 0 {
+		return 1 << 10
+	}
+	return compressor.MinSize
+}
+
+func (compressor *Compressor) encodings() []string {
+	if len(compressor.Encodings) > 0 {
+		return compressor.Encodings
+	}
+	return defaultEncodings
+}
+
+// Returns the registered coding the client accepts with the highest quality, or ""
+// to send the response as it is.
+func (compressor *Compressor) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = parsed
+				}
+			}
+		}
+		if name != "" {
+			qualities[name] = quality
+		}
+	}
+
+	type candidate struct {
+		name    string
+		quality float64
+	}
+	candidates := make([]candidate, 0)
+	for _, name := range compressor.encodings() {
+		if registeredEncoder(name) == nil {
+			continue
+		}
+		quality, ok := qualities[name]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+		if ok && quality > 0 {
+			candidates = append(candidates, candidate{name: name, quality: quality})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	// Stable, so equally acceptable codings keep the server's order of preference.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].quality > candidates[j].quality
+	})
+	return candidates[0].name
+}
+
+func (compressor *Compressor) skipsContentType(contentType string) bool {
+	skip := compressor.SkipContentTypes
+	if skip == nil {
+		skip = DefaultSkipContentTypes
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	for _, skipped := range skip {
+		if mediaType == skipped || (strings.HasSuffix(skipped, "/") && strings.HasPrefix(mediaType, skipped)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Buffers the start of the response until it is known to be large enough to
+// compress, then either compresses it or passes it through.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *Compressor
+	encoding   string
+
+	status  int
+	buffer  []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (writer *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK || writer.decided {
+		writer.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if writer.status == 0 {
+		writer.status = status
+	}
+}
+
+func (writer *compressWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+	if !writer.decided {
+		writer.buffer = append(writer.buffer, data...)
+		if len(writer.buffer) >= writer.compressor.minSize() {
+			err := writer.decide(true)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return len(data), nil
+	}
+	if writer.encoder != nil {
+		return writer.encoder.Write(data)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *compressWriter) Flush() {
+	if !writer.decided {
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		writer.decide(true)
+	}
+	flusher, ok := writer.encoder.(interface{ Flush() error })
+	if ok {
+		flusher.Flush()
+	}
+	responseFlusher, ok := writer.ResponseWriter.(http.Flusher)
+	if ok {
+		responseFlusher.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the underlying ResponseWriter.
+func (writer *compressWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// Sends the headers and buffered data, compressed if compress is set and the
+// response can be.
+func (writer *compressWriter) decide(compress bool) error {
+	writer.decided = true
+	header := writer.Header()
+	if compress && writer.compressible() {
+		encoder, err := registeredEncoder(writer.encoding)(writer.ResponseWriter)
+		if err == nil {
+			writer.encoder = encoder
+			header.Set("Content-Encoding", writer.encoding)
+			header.Del("Content-Length")
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+	if writer.status != 0 {
+		writer.ResponseWriter.WriteHeader(writer.status)
+	}
+	buffered := writer.buffer
+	writer.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	var err error
+	if writer.encoder != nil {
+		_, err = writer.encoder.Write(buffered)
+	} else {
+		_, err = writer.ResponseWriter.Write(buffered)
+	}
+	return err
+}
+
+func (writer *compressWriter) compressible() bool {
+	header := writer.Header()
+	if writer.status == http.StatusNoContent || writer.status == http.StatusNotModified ||
+		writer.status == http.StatusPartialContent {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	return !writer.compressor.skipsContentType(header.Get("Content-Type"))
+}
+
+func (writer *compressWriter) close() {
+	if !writer.decided {
+		writer.decide(false)
+	}
+	if writer.encoder != nil {
+		writer.encoder.Close()
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serveCompressed(compressor *Compressor, acceptEncoding string, contentType string, body string) *httptest.ResponseRecorder {
+	handler := compressor.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestCompressorGzip(t *testing.T) {
+	body := strings.Repeat(`{"name":"Bob"},`, 200)
+	w := serveCompressed(&Compressor{}, "gzip, deflate;q=0.5", "application/json", body)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatal("Large responses should be compressed with the preferred coding.")
+	}
+	if w.Header().Get("ETag") != `W/"v1"` {
+		t.Error("Compressed responses should have a weak ETag.")
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != body {
+		t.Error("Body should survive compression.")
+	}
+}
+
+func TestCompressorDeflate(t *testing.T) {
+	body := strings.Repeat("a", 2000)
+	w := serveCompressed(&Compressor{}, "gzip;q=0.2, deflate", "text/plain", body)
+	if w.Header().Get("Content-Encoding") != "deflate" {
+		t.Fatal("The coding with the highest quality should be used.")
+	}
+	reader, err := zlib.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != body {
+		t.Error("Body should survive compression.")
+	}
+}
+
+func TestCompressorSkips(t *testing.T) {
+	large := strings.Repeat("a", 2000)
+	cases := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		body           string
+	}{
+		{"small bodies", "gzip", "application/json", "{}"},
+		{"compressed types", "gzip", "image/png", large},
+		{"clients not accepting a coding", "", "application/json", large},
+		{"refused codings", "gzip;q=0, br", "application/json", large},
+	}
+	for _, c := range cases {
+		w := serveCompressed(&Compressor{}, c.acceptEncoding, c.contentType, c.body)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != c.body {
+			t.Error("Should not compress " + c.name)
+		}
+		if w.Header().Get("ETag") != `"v1"` || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Error("Uncompressed responses should keep their ETag and vary by Accept-Encoding.")
+		}
+	}
+}
+
+type upperWriter struct {
+	w io.Writer
+}
+
+func (writer upperWriter) Write(data []byte) (int, error) {
+	return writer.w.Write(bytes.ToUpper(data))
+}
+
+func (writer upperWriter) Close() error {
+	return nil
+}
+
+func TestCompressorRegisteredEncoder(t *testing.T) {
+	RegisterEncoder("x-upper", func(w io.Writer) (io.WriteCloser, error) {
+		return upperWriter{w: w}, nil
+	})
+	compressor := &Compressor{MinSize: 1, Encodings: []string{"x-upper", "gzip"}}
+	w := serveCompressed(compressor, "gzip, x-upper", "text/plain", "abc")
+	if w.Header().Get("Content-Encoding") != "x-upper" || w.Body.String() != "ABC" {
+		t.Error("Registered encoders should be negotiated in order of preference.")
+	}
+}
+
+func TestEndpointCompression(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	for i := 0; i < 100; i++ {
+		id := strings.Repeat("x", i+1)
+		dataStore[id] = &PetObject{ID: id, Name: "Pet"}
+	}
+	handler := EndpointHandler{Endpoint: PetListResourceDispatcher{}, Compressor: &Compressor{}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("Endpoint responses should be compressed.")
+	}
+}
+
+func compressedRequest(method string, encoding string, body string) *http.Request {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&buffer)
+	case "deflate":
+		writer = zlib.NewWriter(&buffer)
+	default:
+		buffer.WriteString(body)
+	}
+	if writer != nil {
+		writer.Write([]byte(body))
+		writer.Close()
+	}
+	r := httptest.NewRequest(method, "/", &buffer)
+	r.Header.Set("Content-Encoding", encoding)
+	return r
+}
+
+func TestCompressedRequestBodies(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	handler := EndpointHandler{Endpoint: PetListResourceDispatcher{}}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, compressedRequest(http.MethodPost, encoding, `{"id":"`+encoding+`","name":"Foo"}`))
+		if w.Code != http.StatusCreated || dataStore[encoding] == nil {
+			t.Error("Should decode " + encoding + " request bodies.")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, compressedRequest(http.MethodPost, "br", `{"id":"br"}`))
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Header().Get("Accept-Encoding"), "gzip") {
+		t.Error("Unsupported codings should be rejected with a 415.")
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Corrupt bodies should be rejected with a 400.")
+	}
+}
+
+func TestCompressedRequestBodyLimit(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	handler := EndpointHandler{Endpoint: PetListResourceDispatcher{}, MaxBodyBytes: 1000}
+	bomb := `{"id":"bomb","name":"` + strings.Repeat("a", 100000) + `"}`
+	r := compressedRequest(http.MethodPost, "gzip", bomb)
+	if r.ContentLength > 1000 {
+		t.Fatal("The compressed body should be below the limit.")
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge || dataStore["bomb"] != nil {
+		t.Error("The limit should apply to the decompressed body.")
+	}
+}
+
+func TestDecodeRawDeflate(t *testing.T) {
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+	writer.Write([]byte("raw"))
+	writer.Close()
+	body, err := decodeBody(ioutil.NopCloser(&buffer), []string{"deflate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	if string(data) != "raw" {
+		t.Error("Should accept raw deflate data.")
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// Implemented by objects that copy themselves rather than relying on copyObject.
+type Copier interface {
+	Copy() interface{}
+}
+
+// Returns a deep copy of obj, a pointer to a struct. The struct is copied as a whole,
+// so unexported fields are kept, and the maps, slices and pointers encoding/json sees
+// are then rebuilt from the JSON encoding of obj so they are not shared with it.
+func copyObject(obj interface{}) (interface{}, error) {
+	copier, isCopier := obj.(Copier)
+	if isCopier {
+		return copier.Copy(), nil
+	}
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	value := reflect.ValueOf(obj)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		var duplicate interface{}
+		err = json.Unmarshal(data, &duplicate)
+		return duplicate, err
+	}
+
+	duplicate := reflect.New(value.Elem().Type())
+	duplicate.Elem().Set(value.Elem())
+	clearReferences(duplicate.Elem())
+	err = json.Unmarshal(data, duplicate.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return duplicate.Interface(), nil
+}
+
+func clearReferences(value reflect.Value) {
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Map, reflect.Slice, reflect.Ptr:
+			value.Field(i).Set(reflect.Zero(field.Type))
+		case reflect.Struct:
+			clearReferences(value.Field(i))
+		}
+	}
+}
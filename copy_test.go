@@ -0,0 +1,27 @@
+package handlers
+
+import "testing"
+
+type copyable struct {
+	Name    string            `json:"name"`
+	Tags    []string          `json:"tags"`
+	Labels  map[string]string `json:"labels"`
+	private string
+}
+
+func TestCopyObject(t *testing.T) {
+	original := &copyable{Name: "Rex", Tags: []string{"dog"}, Labels: map[string]string{"a": "b"}, private: "secret"}
+	duplicate, err := copyObject(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := duplicate.(*copyable)
+	copied.Tags[0] = "cat"
+	copied.Labels["a"] = "c"
+	if original.Tags[0] != "dog" || original.Labels["a"] != "b" {
+		t.Error("Copy should not share slices or maps with the original.")
+	}
+	if copied.private != "secret" || copied.Name != "Rex" {
+		t.Error("Copy should keep all fields.")
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cross-origin resource sharing for browser clients. Use Middleware around an
+// EndpointHandler or HTTPMethodDispatcher.
+//
+// Preflight requests are passed on as plain OPTIONS requests and the Allow header of
+// the response, which EndpointHandler derives from the interfaces the resource
+// implements, becomes Access-Control-Allow-Methods. The allowed methods therefore
+// always match what the resource supports.
+type CORS struct {
+	// Origins allowed to make requests. "*" allows any origin and a "*" inside an
+	// origin matches one or more subdomains, e.g. "https://*.example.com".
+	AllowedOrigins []string
+	// Further origins allowed if they match one of the expressions.
+	AllowedOriginPatterns []*regexp.Regexp
+	// Allow cookies and HTTP authentication. The origin is then always echoed, even
+	// when "*" is allowed.
+	AllowCredentials bool
+	// Headers clients may send. Without any, the headers requested in a preflight
+	// are allowed.
+	AllowedHeaders []string
+	// Response headers clients may read.
+	ExposedHeaders []string
+	// How long preflight responses may be cached.
+	MaxAge time.Duration
+}
+
+func (cors *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !cors.originAllowed(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		if cors.allowsAnyOrigin() && !cors.AllowCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if cors.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(cors.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(cors.ExposedHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		options := newBufferedResponse()
+		next.ServeHTTP(options, r)
+		if allowed := options.Header().Get("Allow"); allowed != "" {
+			header.Set("Access-Control-Allow-Methods", allowed)
+		}
+		if len(cors.AllowedHeaders) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+		} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			header.Set("Access-Control-Allow-Headers", requested)
+		}
+		if cors.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (cors *CORS) allowsAnyOrigin() bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cors *CORS) originAllowed(origin string) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if star := strings.Index(allowed, "*"); star >= 0 {
+			prefix, suffix := allowed[:star], allowed[star+1:]
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+				strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range cors.AllowedOriginPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	cors := &CORS{
+		AllowedOrigins:        []string{"https://app.example.com", "https://*.example.org"},
+		AllowedOriginPatterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+		AllowCredentials:      true,
+		MaxAge:                time.Hour,
+	}
+	handler := EndpointHandler{
+		Endpoint:      PetObjectResourceDispatcher{},
+		Middleware:    []Middleware{cors.Middleware},
+		Authenticator: &APIKeyAuthenticator{},
+	}
+	dataStore = map[string]*PetObject{"foo": {ID: "foo"}}
+	preflight := func(path string, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, path, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+		r.Header.Set("Access-Control-Request-Headers", "Content-Type")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := preflight("/foo", "https://app.example.com")
+	if w.Code != http.StatusNoContent {
+		t.Error("Preflight should give a 204.")
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET, PUT, PATCH, DELETE, OPTIONS" {
+		t.Error("Allowed methods should match the resource, got " + w.Header().Get("Access-Control-Allow-Methods"))
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		w.Header().Get("Access-Control-Max-Age") != "3600" {
+		t.Error("Missing preflight headers.")
+	}
+
+	for _, origin := range []string{"https://api.example.org", "http://localhost:3000"} {
+		if preflight("/foo", origin).Header().Get("Access-Control-Allow-Origin") != origin {
+			t.Error("Origin " + origin + " should be allowed.")
+		}
+	}
+	for _, origin := range []string{"https://example.org", "https://evil.com"} {
+		if preflight("/foo", origin).Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Error("Origin " + origin + " should not be allowed.")
+		}
+	}
+}
+
+func TestCORSRequest(t *testing.T) {
+	cors := &CORS{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"ETag"}}
+	handler := cors.Middleware(PetListHandler)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "https://anywhere.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("Any origin should be allowed.")
+	}
+	if w.Header().Get("Access-Control-Expose-Headers") != "ETag" {
+		t.Error("Exposed headers not set.")
+	}
+
+	r = httptest.NewRequest(http.MethodOptions, "/", nil)
+	w = httptest.NewRecorder()
+	PetListHandler.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, POST, OPTIONS" {
+		t.Error("OPTIONS should list the methods of the resource.")
+	}
+}
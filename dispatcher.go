@@ -1,8 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // A basic REST resource. The methods it will respond to are determined by
@@ -42,35 +48,120 @@ type Deletable interface {
 	Delete() error
 }
 
+// Context aware variants of the interfaces above. When a resource implements one of
+// these the request context is passed through, making the request's transaction and
+// principal available to the resource.
+type ContextReadable interface {
+	ReadContext(ctx context.Context) ([]byte, error)
+}
+
+type ContextCreatable interface {
+	CreateContext(ctx context.Context, data []byte) (Readable, error)
+}
+
+type ContextUpdatable interface {
+	UpdateContext(ctx context.Context, data []byte) error
+}
+
+type ContextPartialUpdatable interface {
+	PartialUpdateContext(ctx context.Context, data []byte) error
+}
+
+type ContextDeletable interface {
+	DeleteContext(ctx context.Context) error
+}
+
 type restHandlerDispatcher struct {
-	resource Resource
+	resource      Resource
+	transactor    Transactor
+	middleware    map[string][]Middleware
+	authorizer    Authorizer
+	hideForbidden bool
+	maxBodyBytes  int64
+	cache         *ResponseCache
+	coalescer     *ReadCoalescer
+	metrics       *Metrics
+	endpoint      string
+	maxWait       time.Duration
 }
 
+// The methods a resource may support, in the order they are listed in Allow headers.
+var resourceMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
 func (dispatcher restHandlerDispatcher) GetMethodHandler(requestMethod string) http.Handler {
+	if requestMethod == http.MethodOptions {
+		options := optionsHandler{allowed: dispatcher.allowedMethods()}
+		return Chain(options, dispatcher.middleware[requestMethod]...)
+	}
+
+	method := dispatcher.methodHandler(requestMethod)
+	if method == nil {
+		return nil
+	}
+	if dispatcher.transactor != nil && requestMethod != http.MethodGet {
+		method = transactionHandler{transactor: dispatcher.transactor, handler: method}
+	}
+	if dispatcher.cache != nil {
+		method = cacheHandler{cache: dispatcher.cache, endpoint: dispatcher.endpoint, handler: method}
+	}
+	authorizers := make([]Authorizer, 0, 2)
+	if dispatcher.authorizer != nil {
+		authorizers = append(authorizers, dispatcher.authorizer)
+	}
+	resourceAuthorizer, isAuthorizer := dispatcher.resource.(Authorizer)
+	if isAuthorizer {
+		authorizers = append(authorizers, resourceAuthorizer)
+	}
+	if len(authorizers) > 0 {
+		method = authorizationHandler{authorizers: authorizers, hideForbidden: dispatcher.hideForbidden, handler: method}
+	}
+	return Chain(method, dispatcher.middleware[requestMethod]...)
+}
+
+// Returns the methods the resource supports, as found by methodHandler.
+func (dispatcher restHandlerDispatcher) allowedMethods() []string {
+	allowed := make([]string, 0, len(resourceMethods)+1)
+	for _, method := range resourceMethods {
+		if dispatcher.methodHandler(method) != nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return append(allowed, http.MethodOptions)
+}
+
+// Returns the handler for requestMethod if the resource implements the matching
+// interface, or nil.
+func (dispatcher restHandlerDispatcher) methodHandler(requestMethod string) http.Handler {
 	var method http.Handler
 	switch requestMethod {
 	case http.MethodGet:
 		readable, isReadable := dispatcher.resource.(Readable)
 		if isReadable {
-			method = getHandler{readable: readable}
+			method = getHandler{
+				readable:  readable,
+				coalescer: dispatcher.coalescer,
+				metrics:   dispatcher.metrics,
+				endpoint:  dispatcher.endpoint,
+				maxWait:   dispatcher.maxWait,
+			}
 		}
 		break
 	case http.MethodPost:
 		creatable, isCreatable := dispatcher.resource.(Creatable)
 		if isCreatable {
-			method = postHandler{creatable: creatable}
+			method = postHandler{creatable: creatable, maxBodyBytes: dispatcher.maxBodyBytes}
 		}
 		break
 	case http.MethodPatch:
 		partialUpdatable, isPartialUpdatable := dispatcher.resource.(PartialUpdatable)
 		if isPartialUpdatable {
-			method = patchHandler{partialUpdatable: partialUpdatable}
+			method = patchHandler{partialUpdatable: partialUpdatable, maxBodyBytes: dispatcher.maxBodyBytes}
 		}
 		break
 	case http.MethodPut:
 		updatable, isUpdatable := dispatcher.resource.(Updatable)
 		if isUpdatable {
-			method = putHandler{updatable: updatable}
+			method = putHandler{updatable: updatable, maxBodyBytes: dispatcher.maxBodyBytes}
 		}
 		break
 	case http.MethodDelete:
@@ -79,8 +170,6 @@ func (dispatcher restHandlerDispatcher) GetMethodHandler(requestMethod string) h
 			method = deleteHandler{deletable: deletable}
 		}
 		break
-	case http.MethodOptions:
-		break
 	default:
 		break
 	}
@@ -90,47 +179,141 @@ func (dispatcher restHandlerDispatcher) GetMethodHandler(requestMethod string) h
 
 type getHandler struct {
 	readable Readable
+
+	// Set to share reads between identical concurrent requests.
+	coalescer *ReadCoalescer
+	metrics   *Metrics
+	endpoint  string
+
+	// The longest a long-polling GET may wait for a change, see Watchable.
+	maxWait time.Duration
 }
 
 func (handler getHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	data, err := handler.readable.Read()
+	// Writes render their result with a getHandler, only GETs are conditional.
+	ifNoneMatch := ""
+	if r.Method == http.MethodGet {
+		ifNoneMatch = r.Header.Get("If-None-Match")
+	}
+
+	// Subscribed before reading so no change is missed between the two.
+	var subscription *Subscription
+	watchable, isWatchable := handler.readable.(Watchable)
+	if isWatchable && ifNoneMatch != "" && isLongPoll(r) {
+		subscription = watchable.Watch()
+	}
+	if subscription != nil {
+		defer subscription.Close()
+	}
+
+	data, err := handler.read(r)
+	if err == nil && subscription != nil && etagMatches(ifNoneMatch, entityTag(data)) {
+		wait, preferred := longPollWait(r, handler.maxWait)
+		if preferred {
+			w.Header().Set("Preference-Applied", "wait="+strconv.Itoa(int(wait.Seconds())))
+		}
+		data, err = handler.waitForChange(r, subscription, wait, data)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
+	etag := entityTag(data)
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", etag)
+	cacheable, isCacheable := handler.readable.(Cacheable)
+	if isCacheable && r.Method == http.MethodGet {
+		w.Header().Set("Cache-Control", cacheable.CachePolicy().String())
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write(data)
 }
 
+func (handler getHandler) read(r *http.Request) ([]byte, error) {
+	if handler.coalescer == nil {
+		return readResource(r.Context(), handler.readable)
+	}
+	data, shared, err := handler.coalescer.read(r, handler.endpoint, handler.readable)
+	if handler.metrics != nil {
+		handler.metrics.observeRead(handler.endpoint, shared)
+	}
+	return data, err
+}
+
+// Reads readable, passing ctx if it is a ContextReadable.
+func readResource(ctx context.Context, readable Readable) ([]byte, error) {
+	ctx, span := startSpan(ctx, "Read")
+	contextReadable, isContextReadable := readable.(ContextReadable)
+	if isContextReadable {
+		data, err := contextReadable.ReadContext(ctx)
+		return data, endSpan(span, err)
+	}
+	data, err := readable.Read()
+	return data, endSpan(span, err)
+}
+
+// The request body size limit used when none is configured.
+const defaultMaxBodyBytes = 10 << 20
+
+// Reads the request body, decoding its Content-Encoding. The limit applies to the
+// decoded body, so small compressed bodies cannot expand without bound.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		limit = defaultMaxBodyBytes
+	}
+	body, err := decodeBody(r.Body, r.Header.Values("Content-Encoding"))
+	if errors.Is(err, errUnsupportedEncoding) {
+		w.Header().Set("Accept-Encoding", strings.Join(registeredDecoders(), ", "))
+		return nil, &StatusError{Status: http.StatusUnsupportedMediaType, Message: err.Error()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &StatusError{Status: http.StatusRequestEntityTooLarge, Message: "request body too large"}
+	}
+	return data, nil
+}
+
 type postHandler struct {
-	creatable Creatable
+	creatable    Creatable
+	maxBodyBytes int64
 }
 
 func (handler postHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := readBody(w, r, handler.maxBodyBytes)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	newReadable, err := handler.creatable.Create(body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, fieldErrOk := err.(FieldErrors)
-		if fieldErrOk {
-			w.Header().Set("Content-Type", "application/json")
-		} else {
-			w.Header().Set("Content-Type", "text/plain")
-		}
-		w.Write([]byte(err.Error()))
+	var newReadable Readable
+	ctx, span := startSpan(r.Context(), "Create")
+	contextCreatable, isContextCreatable := handler.creatable.(ContextCreatable)
+	if isContextCreatable {
+		newReadable, err = contextCreatable.CreateContext(ctx, body)
+	} else {
+		newReadable, err = handler.creatable.Create(body)
+	}
+	if endSpan(span, err) != nil {
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	data, err := newReadable.Read()
+	data, err := readResource(r.Context(), newReadable)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -140,25 +323,25 @@ func (handler postHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 type patchHandler struct {
 	partialUpdatable PartialUpdatable
+	maxBodyBytes     int64
 }
 
 func (handler patchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := readBody(w, r, handler.maxBodyBytes)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	err = handler.partialUpdatable.PartialUpdate(body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, fieldErrOk := err.(FieldErrors)
-		if fieldErrOk {
-			w.Header().Set("Content-Type", "application/json")
-		} else {
-			w.Header().Set("Content-Type", "text/plain")
-		}
-		w.Write([]byte(err.Error()))
+	ctx, span := startSpan(r.Context(), "PartialUpdate")
+	contextPartialUpdatable, isContextPartialUpdatable := handler.partialUpdatable.(ContextPartialUpdatable)
+	if isContextPartialUpdatable {
+		err = contextPartialUpdatable.PartialUpdateContext(ctx, body)
+	} else {
+		err = handler.partialUpdatable.PartialUpdate(body)
+	}
+	if endSpan(span, err) != nil {
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
@@ -171,26 +354,26 @@ func (handler patchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type putHandler struct {
-	updatable Updatable
+	updatable    Updatable
+	maxBodyBytes int64
 }
 
 func (handler putHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := readBody(w, r, handler.maxBodyBytes)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	err = handler.updatable.Update(body)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, fieldErrOk := err.(FieldErrors)
-		if fieldErrOk {
-			w.Header().Set("Content-Type", "application/json")
-		} else {
-			w.Header().Set("Content-Type", "text/plain")
-		}
-		w.Write([]byte(err.Error()))
+	ctx, span := startSpan(r.Context(), "Update")
+	contextUpdatable, isContextUpdatable := handler.updatable.(ContextUpdatable)
+	if isContextUpdatable {
+		err = contextUpdatable.UpdateContext(ctx, body)
+	} else {
+		err = handler.updatable.Update(body)
+	}
+	if endSpan(span, err) != nil {
+		writeError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
@@ -207,10 +390,22 @@ type deleteHandler struct {
 }
 
 func (handler deleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	err := handler.deletable.Delete()
-	if err != nil {
+	var err error
+	ctx, span := startSpan(r.Context(), "Delete")
+	contextDeletable, isContextDeletable := handler.deletable.(ContextDeletable)
+	if isContextDeletable {
+		err = contextDeletable.DeleteContext(ctx)
+	} else {
+		err = handler.deletable.Delete()
+	}
+	if endSpan(span, err) != nil {
+		if errorStatus(err, 0) != 0 {
+			writeError(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		recordError(r, err)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error deleting obect"))
+		w.Write(errorBody(r, errors.New("error deleting obect")))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
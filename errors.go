@@ -1,6 +1,10 @@
 package handlers
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
 
 type FieldErrors interface {
 	error
@@ -37,3 +41,75 @@ func (fieldErrors *fieldErrors) Error() string {
 func NewFieldErrors() FieldErrors {
 	return &fieldErrors{errors: make(map[string]string)}
 }
+
+// An error carrying the HTTP status it should be answered with.
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+// Returns an error that handlers answer with the given status and message, for
+// instance to abort a write from a before hook.
+func NewStatusError(status int, message string) error {
+	return &StatusError{Status: status, Message: message}
+}
+
+func (err *StatusError) Error() string {
+	if err.Message == "" {
+		return http.StatusText(err.Status)
+	}
+	return err.Message
+}
+
+// Returns the HTTP status code for err, or fallback if err does not map to one.
+func errorStatus(err error, fallback int) int {
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.Status
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	}
+	return fallback
+}
+
+// Writes err as the response body. FieldErrors are written as JSON, anything else as
+// plain text. The status is taken from the error where possible, otherwise fallback.
+func writeError(w http.ResponseWriter, r *http.Request, err error, fallback int) {
+	recordError(r, err)
+	_, fieldErrOk := err.(FieldErrors)
+	if fieldErrOk {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+	}
+	w.WriteHeader(errorStatus(err, fallback))
+	w.Write(errorBody(r, err))
+}
+
+// Returns the body of an error response. The request ID, if any, is added as a
+// "request_id" member to FieldErrors and as a last line to plain text errors.
+func errorBody(r *http.Request, err error) []byte {
+	requestID := requestIDOf(r)
+	_, fieldErrOk := err.(FieldErrors)
+	if requestID == "" {
+		return []byte(err.Error())
+	}
+	if !fieldErrOk {
+		return []byte(err.Error() + "\nrequest ID: " + requestID)
+	}
+	var body map[string]interface{}
+	if json.Unmarshal([]byte(err.Error()), &body) != nil {
+		return []byte(err.Error())
+	}
+	body["request_id"] = requestID
+	data, marshalErr := json.Marshal(body)
+	if marshalErr != nil {
+		return []byte(err.Error())
+	}
+	return data
+}
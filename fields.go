@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Field level permissions for the objects of a JSON resource, in addition to those
+// declared with the `access` struct tag. Fields are named by their JSON names.
+//
+// The tag takes comma separated options: "readonly" fields are never written from a
+// request body, "read=role1 role2" fields are only rendered for principals with one
+// of the roles and "write=role1 role2" fields are only written for them. Tags of
+// embedded structs apply to the fields encoding/json flattens from them.
+//
+//	type Pet struct {
+//		ID    string `json:"id" access:"readonly"`
+//		Notes string `json:"notes" access:"read=staff,write=staff"`
+//	}
+type FieldPolicy struct {
+	ReadOnly   []string
+	ReadRoles  map[string][]string
+	WriteRoles map[string][]string
+
+	// Drop fields the principal may not write from request bodies instead of
+	// rejecting the request with FieldErrors.
+	IgnoreForbidden bool
+}
+
+type fieldRule struct {
+	readOnly   bool
+	readRoles  []string
+	writeRoles []string
+}
+
+func (rule fieldRule) readable(principal *Principal) bool {
+	return len(rule.readRoles) == 0 || hasAnyRole(principal, rule.readRoles)
+}
+
+func (rule fieldRule) writable(principal *Principal) bool {
+	return !rule.readOnly && (len(rule.writeRoles) == 0 || hasAnyRole(principal, rule.writeRoles))
+}
+
+func hasAnyRole(principal *Principal, roles []string) bool {
+	for _, role := range roles {
+		if principal.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+var tagFieldRules sync.Map
+
+// Returns the rules for the fields of obj keyed by JSON name.
+func fieldRules(obj interface{}, policy *FieldPolicy) map[string]fieldRule {
+	objType := reflect.TypeOf(unwrapHookObject(obj))
+	for objType != nil && objType.Kind() == reflect.Ptr {
+		objType = objType.Elem()
+	}
+
+	var rules map[string]fieldRule
+	if objType != nil && objType.Kind() == reflect.Struct {
+		cached, ok := tagFieldRules.Load(objType)
+		if !ok {
+			cached, _ = tagFieldRules.LoadOrStore(objType, parseAccessTags(objType))
+		}
+		rules = cached.(map[string]fieldRule)
+	}
+	if policy == nil {
+		return rules
+	}
+
+	merged := make(map[string]fieldRule, len(rules))
+	for name, rule := range rules {
+		merged[name] = rule
+	}
+	for _, name := range policy.ReadOnly {
+		rule := merged[name]
+		rule.readOnly = true
+		merged[name] = rule
+	}
+	for name, roles := range policy.ReadRoles {
+		rule := merged[name]
+		rule.readRoles = roles
+		merged[name] = rule
+	}
+	for name, roles := range policy.WriteRoles {
+		rule := merged[name]
+		rule.writeRoles = roles
+		merged[name] = rule
+	}
+	return merged
+}
+
+// Returns the rules declared by the access tags of structType, including those of the
+// structs it embeds, which encoding/json flattens into it. Fields of the struct
+// itself take precedence over embedded fields of the same name.
+func parseAccessTags(structType reflect.Type) map[string]fieldRule {
+	rules, _ := accessTags(structType, map[reflect.Type]bool{})
+	return rules
+}
+
+// Returns the rules of structType and the JSON names of all its fields.
+func accessTags(structType reflect.Type, visiting map[reflect.Type]bool) (map[string]fieldRule, map[string]bool) {
+	rules := make(map[string]fieldRule)
+	names := make(map[string]bool)
+	if visiting[structType] {
+		return rules, names
+	}
+	visiting[structType] = true
+	defer delete(visiting, structType)
+
+	embedded := make([]reflect.Type, 0)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && jsonName == "" && fieldType.Kind() == reflect.Struct {
+			embedded = append(embedded, fieldType)
+			continue
+		}
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		names[name] = true
+		tag, ok := field.Tag.Lookup("access")
+		if !ok {
+			continue
+		}
+		rule := fieldRule{}
+		for _, option := range strings.Split(tag, ",") {
+			option = strings.TrimSpace(option)
+			switch {
+			case option == "readonly":
+				rule.readOnly = true
+			case strings.HasPrefix(option, "read="):
+				rule.readRoles = strings.Fields(option[len("read="):])
+			case strings.HasPrefix(option, "write="):
+				rule.writeRoles = strings.Fields(option[len("write="):])
+			}
+		}
+		rules[name] = rule
+	}
+
+	own := make(map[string]bool, len(names))
+	for name := range names {
+		own[name] = true
+	}
+	for _, embeddedType := range embedded {
+		embeddedRules, embeddedNames := accessTags(embeddedType, visiting)
+		for name := range embeddedNames {
+			names[name] = true
+		}
+		for name, rule := range embeddedRules {
+			if _, ok := rules[name]; !ok && !own[name] {
+				rules[name] = rule
+			}
+		}
+	}
+	return rules, names
+}
+
+// Returns FieldErrors naming the filters and sorts of params on fields the request's
+// principal may not read, as listing by them would reveal their values one guess at
+// a time. Columns not encoded to JSON are never readable. They are reported as
+// unknown, like fields that do not exist.
+func checkListParams(ctx context.Context, structType reflect.Type, mapping *tableMapping, policy *FieldPolicy, params ListParams) error {
+	rules := fieldRules(reflect.New(structType).Interface(), policy)
+	principal := PrincipalFromContext(ctx)
+	readable := func(field string) bool {
+		col := mapping.fields[field]
+		if col == nil {
+			// Left to the caller, which reports unknown fields.
+			return true
+		}
+		rule, ok := rules[col.jsonName]
+		return col.jsonName != "" && (!ok || rule.readable(principal))
+	}
+
+	fieldErrs := NewFieldErrors()
+	hasErrs := false
+	for _, filter := range params.Filters {
+		if !readable(filter.Field) {
+			fieldErrs.Add(filter.Field, "unknown field")
+			hasErrs = true
+		}
+	}
+	for _, order := range params.Sort {
+		if !readable(order.Field) {
+			fieldErrs.Add("sort", "unknown field "+order.Field)
+			hasErrs = true
+		}
+	}
+	if hasErrs {
+		return fieldErrs
+	}
+	return nil
+}
+
+// Returns data with the fields the request's principal may not write removed, or
+// FieldErrors naming them unless the policy ignores them. Keys are matched case
+// insensitively, as encoding/json does.
+func enforceWritable(ctx context.Context, obj interface{}, policy *FieldPolicy, data []byte) ([]byte, error) {
+	rules := fieldRules(obj, policy)
+	if len(rules) == 0 {
+		return data, nil
+	}
+	var body map[string]json.RawMessage
+	if json.Unmarshal(data, &body) != nil {
+		// Not an object, let the caller report the decoding error.
+		return data, nil
+	}
+
+	principal := PrincipalFromContext(ctx)
+	fieldErrs := NewFieldErrors()
+	forbidden := false
+	for key := range body {
+		for name, rule := range rules {
+			if strings.EqualFold(key, name) && !rule.writable(principal) {
+				forbidden = true
+				fieldErrs.Add(key, "field is read-only")
+				delete(body, key)
+			}
+		}
+	}
+	if !forbidden {
+		return data, nil
+	}
+	if policy == nil || !policy.IgnoreForbidden {
+		return nil, fieldErrs
+	}
+	return json.Marshal(body)
+}
+
+// Copies the fields of src the request's principal may not write or may not read
+// over those of dst, so a full update does not reset them.
+func restoreProtected(ctx context.Context, dst interface{}, src interface{}, policy *FieldPolicy) error {
+	principal := PrincipalFromContext(ctx)
+	protected := make([]string, 0)
+	for name, rule := range fieldRules(src, policy) {
+		if !rule.writable(principal) || !rule.readable(principal) {
+			protected = append(protected, name)
+		}
+	}
+	if len(protected) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(src)
+	if err != nil {
+		return err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]json.RawMessage, len(protected))
+	for _, name := range protected {
+		if value, ok := fields[name]; ok {
+			kept[name] = value
+		}
+	}
+	data, err = json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// Marshals obj without the fields the request's principal may not read.
+func marshalReadable(ctx context.Context, obj interface{}, policy *FieldPolicy) ([]byte, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	principal := PrincipalFromContext(ctx)
+	hidden := make([]string, 0)
+	for name, rule := range fieldRules(obj, policy) {
+		if !rule.readable(principal) {
+			hidden = append(hidden, name)
+		}
+	}
+	if len(hidden) == 0 {
+		return data, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return data, nil
+	}
+	for _, name := range hidden {
+		delete(fields, name)
+	}
+	return json.Marshal(fields)
+}
+
+// Marshals list with every element redacted by marshalReadable.
+func marshalReadableList(ctx context.Context, list []interface{}, policy *FieldPolicy) ([]byte, error) {
+	elements := make([]json.RawMessage, len(list))
+	for i, obj := range list {
+		data, err := marshalReadable(ctx, obj, policy)
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = data
+	}
+	return json.Marshal(elements)
+}
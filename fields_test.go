@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type guardedPet struct {
+	ID        string    `json:"id" access:"readonly"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner" access:"write=admin"`
+	Notes     string    `json:"notes" access:"read=staff admin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (pet *guardedPet) Validate() FieldErrors { return nil }
+func (pet *guardedPet) Save() error           { return nil }
+func (pet *guardedPet) Delete() error         { return nil }
+func (pet *guardedPet) Reset()                { *pet = guardedPet{} }
+func (pet *guardedPet) Create() SafeSavable   { return &guardedPet{} }
+
+func TestFieldWritePermissions(t *testing.T) {
+	pet := &guardedPet{ID: "rex", Name: "Rex", Owner: "bob"}
+	resource := &JSONResource{Object: pet}
+	ctx := context.Background()
+
+	err := resource.PartialUpdateContext(ctx, []byte(`{"ID":"other","name":"Max"}`))
+	if _, ok := err.(FieldErrors); !ok {
+		t.Error("Writing a read-only field should be rejected, in any case.")
+	}
+	if pet.ID != "rex" || pet.Name != "Rex" {
+		t.Error("Rejected update should not change the object.")
+	}
+
+	err = resource.PartialUpdateContext(ctx, []byte(`{"owner":"jim"}`))
+	if err == nil {
+		t.Error("Writing a field restricted to admins should be rejected.")
+	}
+	admin := ContextWithPrincipal(ctx, &Principal{Roles: []string{"admin"}})
+	err = resource.PartialUpdateContext(admin, []byte(`{"owner":"jim"}`))
+	if err != nil || pet.Owner != "jim" {
+		t.Error("Admins should be able to write restricted fields.")
+	}
+
+	err = resource.UpdateContext(ctx, []byte(`{"name":"Max"}`))
+	if err != nil || pet.ID != "rex" || pet.Name != "Max" {
+		t.Error("Full update should keep read-only fields.")
+	}
+
+	pet.Owner, pet.Notes = "bob", "bites"
+	err = resource.UpdateContext(ctx, []byte(`{"name":"Max"}`))
+	if err != nil || pet.Owner != "bob" || pet.Notes != "bites" {
+		t.Error("Full update should keep fields the principal may not write or read.")
+	}
+	err = resource.UpdateContext(admin, []byte(`{"name":"Max"}`))
+	if err != nil || pet.Owner != "" || pet.Notes != "" {
+		t.Error("Full update should reset the fields the principal may write.")
+	}
+
+	resource.Fields = &FieldPolicy{ReadOnly: []string{"created_at"}, IgnoreForbidden: true}
+	err = resource.PartialUpdateContext(ctx, []byte(`{"id":"other","created_at":"2020-01-01T00:00:00Z","name":"Rex"}`))
+	if err != nil || pet.ID != "rex" || !pet.CreatedAt.IsZero() || pet.Name != "Rex" {
+		t.Error("Forbidden fields should be ignored when configured.")
+	}
+
+	list := &JSONListResource{Creator: &guardedPet{}}
+	_, err = list.CreateContext(ctx, []byte(`{"id":"chosen","name":"Rex"}`))
+	if err == nil {
+		t.Error("Creating with a read-only field should be rejected.")
+	}
+}
+
+func TestFieldReadPermissions(t *testing.T) {
+	pet := &guardedPet{ID: "rex", Name: "Rex", Notes: "bites"}
+	list := &JSONReadOnlyListResource{ObjectList: []interface{}{pet}}
+	ctx := context.Background()
+
+	data, _ := list.ReadContext(ctx)
+	var fields []map[string]interface{}
+	json.Unmarshal(data, &fields)
+	if _, ok := fields[0]["notes"]; ok || fields[0]["name"] != "Rex" {
+		t.Error("Restricted field should be redacted for anonymous requests.")
+	}
+
+	staff := ContextWithPrincipal(ctx, &Principal{Roles: []string{"staff"}})
+	data, _ = (&JSONResource{Object: pet}).ReadContext(staff)
+	var object map[string]interface{}
+	json.Unmarshal(data, &object)
+	if object["notes"] != "bites" {
+		t.Error("Restricted field should be rendered for allowed roles.")
+	}
+
+	data, _ = (&JSONResource{Object: pet, Fields: &FieldPolicy{ReadRoles: map[string][]string{"name": {"admin"}}}}).ReadContext(staff)
+	object = map[string]interface{}{}
+	json.Unmarshal(data, &object)
+	if _, ok := object["name"]; ok {
+		t.Error("Field policy should redact fields as well.")
+	}
+}
+
+type baseModel struct {
+	ID        string    `json:"id" access:"readonly"`
+	CreatedAt time.Time `json:"created_at" access:"readonly"`
+	Secret    string    `json:"secret" access:"read=admin"`
+}
+
+type embeddingPet struct {
+	baseModel
+	Name   string `json:"name"`
+	Secret string `json:"secret"` // Shadows the embedded field, as in encoding/json.
+}
+
+func (pet *embeddingPet) Validate() FieldErrors { return nil }
+func (pet *embeddingPet) Save() error           { return nil }
+func (pet *embeddingPet) Delete() error         { return nil }
+func (pet *embeddingPet) Reset()                { *pet = embeddingPet{} }
+
+func TestFieldPermissionsOfEmbeddedStructs(t *testing.T) {
+	pet := &embeddingPet{baseModel: baseModel{ID: "rex"}, Name: "Rex"}
+	resource := &JSONResource{Object: pet}
+	ctx := context.Background()
+
+	for _, body := range []string{`{"id":"other"}`, `{"created_at":"2020-01-01T00:00:00Z"}`} {
+		if _, ok := resource.PartialUpdateContext(ctx, []byte(body)).(FieldErrors); !ok {
+			t.Error("Read-only fields of embedded structs should not be writable.", body)
+		}
+	}
+	err := resource.UpdateContext(ctx, []byte(`{"name":"Max"}`))
+	if err != nil || pet.ID != "rex" || pet.Name != "Max" {
+		t.Error("Full update should keep read-only fields of embedded structs.", err)
+	}
+
+	pet.Secret = "public"
+	data, _ := resource.ReadContext(ctx)
+	var object map[string]interface{}
+	json.Unmarshal(data, &object)
+	if object["secret"] != "public" {
+		t.Error("Fields of the struct should take precedence over embedded ones.", string(data))
+	}
+}
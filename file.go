@@ -0,0 +1,375 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// The on-disk encoding of a FileRepository.
+type FileFormat int
+
+const (
+	// A single JSON array holding every object.
+	FormatJSON FileFormat = iota
+	// Newline delimited JSON, one object per line.
+	FormatNDJSON
+)
+
+// A Repository persisting a collection to a single file, meant for prototypes and
+// small services. Every write rewrites the whole file to a temporary file which is
+// then renamed over Path, so the file is never observed half written. An exclusive
+// lock on Path + ".lock" is held for each operation, so several processes may share
+// the file; on platforms other than unix and Windows, which have no file locks,
+// every operation fails. Temporary files left by a crash are removed the next time
+// the file is used. Objects are identified by their PrimaryKey JSON field, "id" by
+// default; a zero key is replaced by the next integer key, or a random string key,
+// on Insert.
+type FileRepository struct {
+	Path       string
+	Format     FileFormat
+	PrimaryKey string
+	// Restricts the fields List may filter and sort by to those the request's
+	// principal may read, in addition to the `access` struct tags, see FieldPolicy.
+	Fields *FieldPolicy
+
+	mu        sync.Mutex
+	recovered bool
+}
+
+type fileRecord struct {
+	id   string
+	data json.RawMessage
+}
+
+func (repo *FileRepository) primaryKey() string {
+	if repo.PrimaryKey == "" {
+		return "id"
+	}
+	return repo.PrimaryKey
+}
+
+func (repo *FileRepository) Get(ctx context.Context, id string, dest interface{}) error {
+	return repo.view(ctx, func(records []fileRecord) error {
+		for _, record := range records {
+			if record.id == id {
+				return json.Unmarshal(record.data, dest)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+func (repo *FileRepository) List(ctx context.Context, params ListParams, dest interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("handlers: List destination must be a pointer to a slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	structType := elemType
+	if elemType.Kind() == reflect.Ptr {
+		structType = elemType.Elem()
+	}
+	mapping, err := columnMapping(structType)
+	if err != nil {
+		return err
+	}
+	err = checkListParams(ctx, structType, mapping, repo.Fields, params)
+	if err != nil {
+		return err
+	}
+
+	return repo.view(ctx, func(records []fileRecord) error {
+		items := make([]reflect.Value, len(records))
+		for i, record := range records {
+			item := reflect.New(structType)
+			err := json.Unmarshal(record.data, item.Interface())
+			if err != nil {
+				return err
+			}
+			items[i] = item.Elem()
+		}
+		items, err := applyListParams(items, mapping, params)
+		if err != nil {
+			return err
+		}
+		result := reflect.MakeSlice(slice.Type(), 0, len(items))
+		for _, item := range items {
+			if elemType.Kind() == reflect.Ptr {
+				result = reflect.Append(result, item.Addr())
+			} else {
+				result = reflect.Append(result, item)
+			}
+		}
+		slice.Set(result)
+		return nil
+	})
+}
+
+func (repo *FileRepository) Insert(ctx context.Context, obj interface{}) error {
+	return repo.update(ctx, func(records []fileRecord) ([]fileRecord, error) {
+		record, err := repo.record(obj)
+		if err != nil {
+			return nil, err
+		}
+		if record.id == "" || record.id == "0" {
+			record, err = repo.generateID(obj, records)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, existing := range records {
+			if existing.id == record.id {
+				return nil, fmt.Errorf("%w: %s %q already exists", ErrConflict, repo.primaryKey(), record.id)
+			}
+		}
+		return append(records, record), nil
+	})
+}
+
+func (repo *FileRepository) Update(ctx context.Context, obj interface{}) error {
+	return repo.update(ctx, func(records []fileRecord) ([]fileRecord, error) {
+		record, err := repo.record(obj)
+		if err != nil {
+			return nil, err
+		}
+		for i, existing := range records {
+			if existing.id == record.id {
+				records[i] = record
+				return records, nil
+			}
+		}
+		return nil, ErrNotFound
+	})
+}
+
+func (repo *FileRepository) Delete(ctx context.Context, id string) error {
+	return repo.update(ctx, func(records []fileRecord) ([]fileRecord, error) {
+		for i, existing := range records {
+			if existing.id == id {
+				return append(records[:i], records[i+1:]...), nil
+			}
+		}
+		return nil, ErrNotFound
+	})
+}
+
+func (repo *FileRepository) record(obj interface{}) (fileRecord, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return fileRecord{}, err
+	}
+	id, err := repo.recordID(data)
+	return fileRecord{id: id, data: data}, err
+}
+
+func (repo *FileRepository) jsonPrimaryKey() string {
+	return repo.primaryKey()
+}
+
+func (repo *FileRepository) recordID(data []byte) (string, error) {
+	return jsonFieldID(data, repo.primaryKey())
+}
+
+// Returns the value of the JSON field key of the object encoded in data as a string,
+// or "" if it is missing or null.
+func jsonFieldID(data []byte, key string) (string, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return "", err
+	}
+	raw, ok := fields[key]
+	if !ok {
+		return "", nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var id interface{}
+	err = decoder.Decode(&id)
+	if err != nil || id == nil {
+		return "", err
+	}
+	return fmt.Sprint(id), nil
+}
+
+// Assigns obj the next free integer key, or a random string key if the key field is
+// not numeric.
+func (repo *FileRepository) generateID(obj interface{}, records []fileRecord) (fileRecord, error) {
+	next := int64(1)
+	for _, record := range records {
+		id, err := strconv.ParseInt(record.id, 10, 64)
+		if err == nil && id >= next {
+			next = id + 1
+		}
+	}
+	key, err := json.Marshal(repo.primaryKey())
+	if err != nil {
+		return fileRecord{}, err
+	}
+	err = json.Unmarshal([]byte(fmt.Sprintf("{%s:%d}", key, next)), obj)
+	if err != nil {
+		random := make([]byte, 8)
+		_, err = rand.Read(random)
+		if err != nil {
+			return fileRecord{}, err
+		}
+		err = json.Unmarshal([]byte(fmt.Sprintf("{%s:%q}", key, hex.EncodeToString(random))), obj)
+		if err != nil {
+			return fileRecord{}, err
+		}
+	}
+	return repo.record(obj)
+}
+
+func (repo *FileRepository) view(ctx context.Context, fn func(records []fileRecord) error) error {
+	return repo.locked(ctx, func() error {
+		records, err := repo.load()
+		if err != nil {
+			return err
+		}
+		return fn(records)
+	})
+}
+
+func (repo *FileRepository) update(ctx context.Context, fn func(records []fileRecord) ([]fileRecord, error)) error {
+	return repo.locked(ctx, func() error {
+		records, err := repo.load()
+		if err != nil {
+			return err
+		}
+		records, err = fn(records)
+		if err != nil {
+			return err
+		}
+		return repo.store(records)
+	})
+}
+
+func (repo *FileRepository) locked(ctx context.Context, fn func() error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	unlock, err := lockFile(repo.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !repo.recovered {
+		// Temporary files are only left behind by writers that crashed before renaming.
+		stale, _ := filepath.Glob(repo.Path + ".tmp-*")
+		for _, path := range stale {
+			os.Remove(path)
+		}
+		repo.recovered = true
+	}
+	return fn()
+}
+
+func (repo *FileRepository) load() ([]fileRecord, error) {
+	data, err := ioutil.ReadFile(repo.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []fileRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raws := make([]json.RawMessage, 0)
+	if repo.Format == FormatNDJSON {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return nil, fmt.Errorf("handlers: %s contains an invalid line", repo.Path)
+			}
+			raws = append(raws, json.RawMessage(append([]byte{}, line...)))
+		}
+	} else if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &raws)
+		if err != nil {
+			return nil, fmt.Errorf("handlers: reading %s: %w", repo.Path, err)
+		}
+	}
+
+	records := make([]fileRecord, len(raws))
+	for i, raw := range raws {
+		id, err := repo.recordID(raw)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = fileRecord{id: id, data: raw}
+	}
+	return records, nil
+}
+
+// Writes records to a temporary file in the same directory, syncs it and renames it
+// over Path.
+func (repo *FileRepository) store(records []fileRecord) error {
+	var buffer bytes.Buffer
+	if repo.Format == FormatNDJSON {
+		for _, record := range records {
+			buffer.Write(record.data)
+			buffer.WriteByte('\n')
+		}
+	} else {
+		buffer.WriteString("[")
+		for i, record := range records {
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			buffer.WriteString("\n")
+			buffer.Write(record.data)
+		}
+		buffer.WriteString("\n]\n")
+	}
+
+	dir := filepath.Dir(repo.Path)
+	temp, err := ioutil.TempFile(dir, filepath.Base(repo.Path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(buffer.Bytes())
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), repo.Path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	// Persist the rename itself. Not every platform can sync a directory.
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type filePet struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (pet *filePet) Validate() FieldErrors {
+	if pet.Age > 10 {
+		errs := NewFieldErrors()
+		errs.Add("age", "Too old")
+		return errs
+	}
+	return nil
+}
+
+func TestFileRepository(t *testing.T) {
+	for _, format := range []FileFormat{FormatJSON, FormatNDJSON} {
+		path := filepath.Join(t.TempDir(), "pets")
+		ctx := context.Background()
+		repo := &FileRepository{Path: path, Format: format}
+
+		rex := filePet{Name: "Rex", Age: 3}
+		if err := repo.Insert(ctx, &rex); err != nil {
+			t.Fatal(err)
+		}
+		if rex.ID != 1 {
+			t.Error("Zero id should be generated.")
+		}
+		fido := filePet{Name: "Fido", Age: 7}
+		repo.Insert(ctx, &fido)
+		if err := repo.Insert(ctx, &filePet{ID: 1}); !errors.Is(err, ErrConflict) {
+			t.Error("Inserting an existing id should conflict.")
+		}
+
+		// Stale temporary files from a crashed writer should be cleaned up.
+		ioutil.WriteFile(path+".tmp-crashed", []byte("[{"), 0644)
+
+		reopened := &FileRepository{Path: path, Format: format}
+		pet := filePet{}
+		if err := reopened.Get(ctx, "2", &pet); err != nil || pet.Name != "Fido" {
+			t.Error("Objects should survive reopening the file.")
+		}
+		if _, err := os.Stat(path + ".tmp-crashed"); !os.IsNotExist(err) {
+			t.Error("Stale temporary file not removed.")
+		}
+		if err := reopened.Get(ctx, "3", &pet); !errors.Is(err, ErrNotFound) {
+			t.Error("Missing object should not be found.")
+		}
+
+		pet.Age = 8
+		reopened.Update(ctx, &pet)
+		if err := reopened.Update(ctx, &filePet{ID: 5}); !errors.Is(err, ErrNotFound) {
+			t.Error("Updating a missing object should not be found.")
+		}
+
+		var pets []filePet
+		err := reopened.List(ctx, ListParams{Filters: []Filter{{Field: "age", Op: OpGt, Value: "5"}}}, &pets)
+		if err != nil || len(pets) != 1 || pets[0].Age != 8 {
+			t.Error("List should filter updated objects.")
+		}
+		var sorted []*filePet
+		reopened.List(ctx, ListParams{Sort: []Sort{{Field: "name"}}, Limit: 1}, &sorted)
+		if len(sorted) != 1 || sorted[0].Name != "Fido" {
+			t.Error("List should sort and limit.")
+		}
+
+		reopened.Delete(ctx, "1")
+		if err := reopened.Delete(ctx, "1"); !errors.Is(err, ErrNotFound) {
+			t.Error("Deleting twice should not be found.")
+		}
+	}
+}
+
+func TestFileRepositoryResources(t *testing.T) {
+	ctx := context.Background()
+	repo := &FileRepository{Path: filepath.Join(t.TempDir(), "pets.json")}
+	list := &JSONListResource{
+		Creator: &RepositoryFactory{Repository: repo, New: func() interface{} { return &filePet{} }},
+	}
+
+	if _, err := list.Create([]byte(`{"name":"Rex","age":12}`)); err == nil {
+		t.Error("Invalid object should not be created.")
+	}
+	created, err := list.Create([]byte(`{"name":"Rex","age":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := created.Read()
+	pet := filePet{}
+	json.Unmarshal(data, &pet)
+	if pet.ID != 1 {
+		t.Error("Created object should be returned with its id.")
+	}
+
+	stored := filePet{}
+	repo.Get(ctx, "1", &stored)
+	resource := &JSONResource{Object: NewRepositoryObject(repo, &stored)}
+	if err := resource.Update([]byte(`{"name":"Max"}`)); err != nil {
+		t.Fatal(err)
+	}
+	repo.Get(ctx, "1", &pet)
+	if pet.Name != "Max" || pet.Age != 0 {
+		t.Error("Update should replace the stored object.")
+	}
+
+	resource.Delete()
+	if err := repo.Get(ctx, "1", &pet); !errors.Is(err, ErrNotFound) {
+		t.Error("Delete should remove the stored object.")
+	}
+}
+
+type resettingFilePet struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func (pet *resettingFilePet) Reset() {
+	*pet = resettingFilePet{}
+}
+
+func TestFileRepositoryPrimaryKeyChanges(t *testing.T) {
+	ctx := context.Background()
+	repo := &FileRepository{Path: filepath.Join(t.TempDir(), "pets.json")}
+	repo.Insert(ctx, &filePet{Name: "Rex"})
+	repo.Insert(ctx, &filePet{Name: "Max"})
+
+	stored := resettingFilePet{}
+	repo.Get(ctx, "1", &stored)
+	resource := &JSONResource{Object: NewRepositoryObject(repo, &stored)}
+	if err := resource.Update([]byte(`{"name":"Rex II"}`)); err != nil {
+		t.Fatal(err)
+	}
+	pet := filePet{}
+	if repo.Get(ctx, "1", &pet); pet.Name != "Rex II" {
+		t.Error("Objects with their own Reset should keep their primary key.", pet)
+	}
+
+	for _, update := range []func([]byte) error{resource.Update, resource.PartialUpdate} {
+		if err := update([]byte(`{"id":2,"name":"Rex III"}`)); errorStatus(err, 0) != http.StatusBadRequest {
+			t.Error("Changing the primary key should be rejected.", err)
+		}
+	}
+	if repo.Get(ctx, "2", &pet); pet.Name != "Max" {
+		t.Error("Other objects should not be overwritten.", pet)
+	}
+}
+
+type namedPet struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func TestFileRepositoryCustomPrimaryKey(t *testing.T) {
+	ctx := context.Background()
+	repo := &FileRepository{Path: filepath.Join(t.TempDir(), "pets.json"), PrimaryKey: "name"}
+	repo.Insert(ctx, &namedPet{Name: "Rex", Age: 3})
+	repo.Insert(ctx, &namedPet{Name: "Max", Age: 5})
+
+	var pets []namedPet
+	params := ListParams{Filters: []Filter{{Field: "age", Op: OpGte, Value: "4"}}}
+	if err := repo.List(ctx, params, &pets); err != nil || len(pets) != 1 || pets[0].Name != "Max" {
+		t.Fatal("List should work without a primary key column.", err, pets)
+	}
+
+	stored := namedPet{}
+	repo.Get(ctx, "Rex", &stored)
+	resource := &JSONResource{Object: NewRepositoryObject(repo, &stored)}
+	if err := resource.Update([]byte(`{"age":4}`)); err != nil {
+		t.Fatal(err)
+	}
+	pet := namedPet{}
+	if repo.Get(ctx, "Rex", &pet); pet.Age != 4 {
+		t.Error("Full updates should keep the primary key.", pet)
+	}
+	if err := resource.PartialUpdate([]byte(`{"name":"Max"}`)); errorStatus(err, 0) != http.StatusBadRequest {
+		t.Error("Changing the primary key should be rejected.", err)
+	}
+	if err := resource.Delete(); err != nil {
+		t.Error("Delete should find the object by its primary key.", err)
+	}
+	if err := repo.Get(ctx, "Rex", &pet); errorStatus(err, 0) != http.StatusNotFound {
+		t.Error("The deleted object should be gone.", err)
+	}
+}
+
+type secretPet struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Secret string `json:"secret" access:"read=admin"`
+	Hash   string `json:"-"`
+}
+
+func TestFileRepositoryListHiddenFields(t *testing.T) {
+	ctx := context.Background()
+	repo := &FileRepository{Path: filepath.Join(t.TempDir(), "pets.json")}
+	repo.Insert(ctx, &secretPet{Name: "Rex", Secret: "abc"})
+
+	var pets []secretPet
+	for _, params := range []ListParams{
+		{Filters: []Filter{{Field: "secret", Op: OpLike, Value: "a%"}}},
+		{Sort: []Sort{{Field: "secret"}}},
+		{Filters: []Filter{{Field: "hash", Op: OpEq, Value: ""}}},
+	} {
+		if _, ok := repo.List(ctx, params, &pets).(FieldErrors); !ok {
+			t.Error("Listing by fields the principal may not read should be rejected.", params)
+		}
+	}
+
+	admin := ContextWithPrincipal(ctx, &Principal{Roles: []string{"admin"}})
+	params := ListParams{Filters: []Filter{{Field: "secret", Op: OpLike, Value: "a%"}}}
+	if err := repo.List(admin, params, &pets); err != nil || len(pets) != 1 {
+		t.Error("Principals that may read a field should list by it.", err)
+	}
+	repo.Fields = &FieldPolicy{ReadRoles: map[string][]string{"name": {"staff"}}}
+	params = ListParams{Filters: []Filter{{Field: "name", Op: OpEq, Value: "Rex"}}}
+	if _, ok := repo.List(admin, params, &pets).(FieldErrors); !ok {
+		t.Error("The repository's FieldPolicy should apply as well.")
+	}
+}
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"sync"
 )
 
 const jsonContentType = "application/json"
@@ -11,6 +15,12 @@ type Savable interface {
 	Save() error
 }
 
+// A Savable that wants the request context, for instance to find the transaction the
+// request is running in with TxFromContext.
+type ContextSavable interface {
+	SaveContext(ctx context.Context) error
+}
+
 type Validatable interface {
 	Validate() FieldErrors
 }
@@ -35,6 +45,7 @@ type ResourceObject interface {
 // object using JSON marshall for any GET request.
 type JSONReadOnlyResource struct {
 	Object interface{}
+	Fields *FieldPolicy
 }
 
 func (resource *JSONReadOnlyResource) GetContentType() string {
@@ -45,11 +56,34 @@ func (resource *JSONReadOnlyResource) Read() ([]byte, error) {
 	return json.Marshal(resource.Object)
 }
 
+// Renders the object without the fields the request's principal may not read.
+func (resource *JSONReadOnlyResource) ReadContext(ctx context.Context) ([]byte, error) {
+	return marshalReadable(ctx, resource.Object, resource.Fields)
+}
+
 // An object resource for creating a simple JSON REST endpoint. Will render the given
 // object using json.Marshall for any GET request. Will also allow for PUT, PATCH,
 // operations using json.Unmarshall. Also allows for DELETE operations.
+//
+// Updates are applied to a copy of the object (see Copier) which is validated and
+// saved before being copied back over Object, so a failed update leaves Object
+// untouched. In a transaction, Object is only replaced once it commits; until then
+// the resource reads as the update, and other updates of the object wait for the
+// transaction to end. Reads and writes of the same object are synchronised, also
+// across JSONResources wrapping the same object pointer. Fields restricts which
+// fields the request's principal may read and write, see FieldPolicy.
+//
+// Successful updates and deletes are published to Changes, if set, as events of the
+// object with Key in Collection.
 type JSONResource struct {
 	Object ResourceObject
+	Fields *FieldPolicy
+
+	Changes    *ChangeBus
+	Collection string
+	Key        string
+
+	pending ResourceObject // Updated in a transaction that has not committed yet.
 }
 
 func (resource *JSONResource) GetContentType() string {
@@ -57,34 +91,145 @@ func (resource *JSONResource) GetContentType() string {
 }
 
 func (resource *JSONResource) Read() ([]byte, error) {
+	lock := lockFor(resource.Object)
+	defer lock.release()
+	lock.rw.RLock()
+	defer lock.rw.RUnlock()
+	if resource.pending != nil {
+		return json.Marshal(resource.pending)
+	}
 	return json.Marshal(resource.Object)
 }
 
+func (resource *JSONResource) ReadContext(ctx context.Context) ([]byte, error) {
+	lock := lockFor(resource.Object)
+	defer lock.release()
+	lock.rw.RLock()
+	defer lock.rw.RUnlock()
+	if resource.pending != nil {
+		return marshalReadable(ctx, resource.pending, resource.Fields)
+	}
+	return marshalReadable(ctx, resource.Object, resource.Fields)
+}
+
 func (resource *JSONResource) Update(data []byte) error {
-	resource.Object.Reset()
-	return resource.PartialUpdate(data)
+	return resource.UpdateContext(context.Background(), data)
+}
+
+func (resource *JSONResource) UpdateContext(ctx context.Context, data []byte) error {
+	return resource.update(ctx, data, true)
 }
 
 func (resource *JSONResource) PartialUpdate(data []byte) error {
-	err := json.Unmarshal(data, &resource.Object)
+	return resource.PartialUpdateContext(context.Background(), data)
+}
+
+func (resource *JSONResource) PartialUpdateContext(ctx context.Context, data []byte) error {
+	return resource.update(ctx, data, false)
+}
+
+func (resource *JSONResource) update(ctx context.Context, data []byte, reset bool) error {
+	data, err := enforceWritable(ctx, resource.Object, resource.Fields, data)
 	if err != nil {
 		return err
 	}
-	fieldErrs := resource.Object.Validate()
+
+	// In a transaction the write lock is held until it ends, so that concurrent
+	// updates copy the object only once the previous one is committed or rolled back.
+	lock := lockFor(resource.Object)
+	lock.write.Lock()
+	unlock := func() {
+		lock.rw.Lock()
+		resource.pending = nil
+		lock.rw.Unlock()
+		lock.write.Unlock()
+		lock.release()
+	}
+	if !afterTransaction(ctx, unlock) {
+		defer unlock()
+	}
+
+	lock.rw.RLock()
+	duplicate, err := copyObject(resource.Object)
+	var old interface{}
+	if err == nil && hasUpdateHooks(ctx, resource.Object) {
+		old, err = copyObject(resource.Object)
+	}
+	lock.rw.RUnlock()
+	if err != nil {
+		return err
+	}
+	updated, ok := duplicate.(ResourceObject)
+	if !ok {
+		return errors.New("copy of object is not a ResourceObject")
+	}
+
+	if reset {
+		updated.Reset()
+		err = restoreProtected(ctx, updated, resource.Object, resource.Fields)
+		if err != nil {
+			return err
+		}
+	}
+	err = json.Unmarshal(data, &updated)
+	if err != nil {
+		return err
+	}
+	err = beforeUpdate(ctx, old, updated)
+	if err != nil {
+		return err
+	}
+	fieldErrs := validateObject(ctx, updated)
 	if fieldErrs != nil {
 		return fieldErrs
 	}
-	return resource.Object.Save()
+	err = saveObject(ctx, updated)
+	if err != nil {
+		return err
+	}
+
+	lock.rw.Lock()
+	resource.pending = updated
+	lock.rw.Unlock()
+	afterCommit(ctx, func() {
+		lock.rw.Lock()
+		swapObject(resource.Object, updated)
+		resource.pending = nil
+		lock.rw.Unlock()
+		afterUpdate(ctx, old, resource.Object)
+	})
+	publishChange(ctx, resource.Changes, ChangeUpdated, resource.Collection, resource.Key, updated, resource.Fields)
+	return nil
 }
 
 func (resource JSONResource) Delete() error {
-	return resource.Object.Delete()
+	return resource.DeleteContext(context.Background())
+}
+
+func (resource JSONResource) DeleteContext(ctx context.Context) error {
+	lock := lockFor(resource.Object)
+	defer lock.release()
+	lock.write.Lock()
+	defer lock.write.Unlock()
+
+	err := beforeDelete(ctx, resource.Object)
+	if err != nil {
+		return err
+	}
+	err = deleteObject(ctx, resource.Object)
+	if err != nil {
+		return err
+	}
+	afterCommit(ctx, func() { afterDelete(ctx, resource.Object) })
+	publishChange(ctx, resource.Changes, ChangeDeleted, resource.Collection, resource.Key, resource.Object, resource.Fields)
+	return nil
 }
 
 // A list resource that will return a JSON array of the given ObjectList for
 // a GET request.
 type JSONReadOnlyListResource struct {
 	ObjectList []interface{}
+	Fields     *FieldPolicy
 }
 
 func (resource *JSONReadOnlyListResource) GetContentType() string {
@@ -95,12 +240,26 @@ func (resource *JSONReadOnlyListResource) Read() ([]byte, error) {
 	return json.Marshal(resource.ObjectList)
 }
 
+// Returns the objects the request's principal may read, see RowAuthorizer, without
+// the fields it may not read.
+func (resource *JSONReadOnlyListResource) ReadContext(ctx context.Context) ([]byte, error) {
+	return marshalReadableList(ctx, filterRows(ctx, resource.ObjectList), resource.Fields)
+}
+
 // A list resource that will return a JSON array of the given ObjectList for
 // a GET request. Will create objects on a POST request using json.Unmarshall on
 // the default object created by the Creator Factory.
+//
+// Created objects are published to Changes, if set, as events in Collection keyed by
+// KeyOf, which defaults to the primary key of objects with `db` tags.
 type JSONListResource struct {
 	ObjectList []interface{}
 	Creator    Factory
+	Fields     *FieldPolicy
+
+	Changes    *ChangeBus
+	Collection string
+	KeyOf      func(obj interface{}) string
 }
 
 func (resource *JSONListResource) GetContentType() string {
@@ -111,19 +270,142 @@ func (resource *JSONListResource) Read() ([]byte, error) {
 	return json.Marshal(resource.ObjectList)
 }
 
+// Returns the objects the request's principal may read, see RowAuthorizer, without
+// the fields it may not read.
+func (resource *JSONListResource) ReadContext(ctx context.Context) ([]byte, error) {
+	return marshalReadableList(ctx, filterRows(ctx, resource.ObjectList), resource.Fields)
+}
+
 func (resource *JSONListResource) Create(data []byte) (Readable, error) {
+	return resource.CreateContext(context.Background(), data)
+}
+
+func (resource *JSONListResource) CreateContext(ctx context.Context, data []byte) (Readable, error) {
 	newObj := resource.Creator.Create()
-	err := json.Unmarshal(data, &newObj)
+	data, err := enforceWritable(ctx, newObj, resource.Fields, data)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &newObj)
 	if err != nil {
 		return nil, err
 	}
-	fieldErrs := newObj.Validate()
+	err = beforeCreate(ctx, newObj)
+	if err != nil {
+		return nil, err
+	}
+	fieldErrs := validateObject(ctx, newObj)
 	if fieldErrs != nil {
 		return nil, fieldErrs
 	}
-	err = newObj.Save()
+	err = saveObject(ctx, newObj)
 	if err != nil {
-		return nil, errors.New("error saving new object")
+		return nil, fmt.Errorf("error saving new object: %w", err)
+	}
+	afterCommit(ctx, func() { afterCreate(ctx, newObj) })
+	if resource.Changes != nil {
+		publishChange(ctx, resource.Changes, ChangeCreated, resource.Collection, resource.keyOf(newObj), newObj, resource.Fields)
+	}
+	return &JSONReadOnlyResource{Object: newObj, Fields: resource.Fields}, nil
+}
+
+func validateObject(ctx context.Context, obj Validatable) FieldErrors {
+	_, span := startSpan(ctx, "Validate")
+	defer span.End()
+	fieldErrs := obj.Validate()
+	if fieldErrs != nil {
+		span.RecordError(fieldErrs)
+	}
+	return fieldErrs
+}
+
+func (resource *JSONListResource) keyOf(obj interface{}) string {
+	if resource.KeyOf != nil {
+		return resource.KeyOf(obj)
+	}
+	var key string
+	var err error
+	if repositoryObject, isRepositoryObject := obj.(*RepositoryObject); isRepositoryObject {
+		key, err = repositoryObjectID(repositoryObject.Repository, repositoryObject.Object)
+	} else {
+		key, err = objectID(obj)
+	}
+	if err != nil {
+		return ""
+	}
+	return key
+}
+
+func saveObject(ctx context.Context, obj Savable) error {
+	ctx, span := startSpan(ctx, "Save")
+	contextSavable, isContextSavable := obj.(ContextSavable)
+	if isContextSavable {
+		return endSpan(span, contextSavable.SaveContext(ctx))
+	}
+	return endSpan(span, obj.Save())
+}
+
+func deleteObject(ctx context.Context, obj Deletable) error {
+	ctx, span := startSpan(ctx, "Delete object")
+	contextDeletable, isContextDeletable := obj.(ContextDeletable)
+	if isContextDeletable {
+		return endSpan(span, contextDeletable.DeleteContext(ctx))
+	}
+	return endSpan(span, obj.Delete())
+}
+
+// Synchronises access to an object shared between requests. write serialises
+// updates, rw guards the object's contents while they are read or replaced. Locks
+// are counted and dropped once no request holds them, so objects are not retained.
+type objectLock struct {
+	write sync.Mutex
+	rw    sync.RWMutex
+	key   interface{}
+	refs  int
+}
+
+var objectLocks = struct {
+	sync.Mutex
+	locks map[interface{}]*objectLock
+}{locks: make(map[interface{}]*objectLock)}
+
+// Returns the lock of obj, which must be released when done with.
+func lockFor(obj interface{}) *objectLock {
+	if reflect.ValueOf(obj).Kind() != reflect.Ptr {
+		return &objectLock{}
+	}
+	objectLocks.Lock()
+	defer objectLocks.Unlock()
+	lock, ok := objectLocks.locks[obj]
+	if !ok {
+		lock = &objectLock{key: obj}
+		objectLocks.locks[obj] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (lock *objectLock) release() {
+	if lock.key == nil {
+		return
+	}
+	objectLocks.Lock()
+	defer objectLocks.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(objectLocks.locks, lock.key)
+	}
+}
+
+// Replaces the contents of dst, a pointer, with those of src.
+func swapObject(dst interface{}, src interface{}) {
+	dstRepositoryObject, isRepositoryObject := dst.(*RepositoryObject)
+	if isRepositoryObject {
+		srcRepositoryObject := src.(*RepositoryObject)
+		swapObject(dstRepositoryObject.Object, srcRepositoryObject.Object)
+		dstRepositoryObject.stored = srcRepositoryObject.stored
+		dstRepositoryObject.id = srcRepositoryObject.id
+		return
 	}
-	return &JSONReadOnlyResource{Object: newObj}, nil
+	reflect.ValueOf(dst).Elem().Set(reflect.ValueOf(src).Elem())
 }
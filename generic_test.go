@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"encoding/json"
+	"net/http"
+	"strconv"
 	"testing"
 )
 
@@ -290,3 +292,85 @@ func TestGenericJsonListResource(t *testing.T) {
 		t.Error("Person not added.")
 	}
 }
+
+type unsavablePerson struct {
+	Person
+}
+
+func (person *unsavablePerson) Save() error {
+	return NewStatusError(http.StatusServiceUnavailable, "store unavailable")
+}
+
+type unsavablePeople struct{}
+
+func (people unsavablePeople) Create() SafeSavable {
+	return &unsavablePerson{}
+}
+
+func TestGenericJsonListResourceFailedSave(t *testing.T) {
+	peopleResource := &JSONListResource{Creator: unsavablePeople{}}
+	_, err := peopleResource.Create([]byte(`{"name":"Dave"}`))
+	if errorStatus(err, http.StatusInternalServerError) != http.StatusServiceUnavailable {
+		t.Error("Save errors should be wrapped, not replaced.", err)
+	}
+}
+
+func TestGenericJsonResourceFailedUpdate(t *testing.T) {
+	person := Person{
+		Name: "Bob",
+		Age:  35,
+	}
+	personResource := &JSONResource{Object: &person}
+
+	err := personResource.PartialUpdate([]byte(`{"name":"Fred","age":40}`))
+	if err == nil {
+		t.Error("Invalid name should error.")
+	}
+	if person.Name != "Bob" || person.Age != 35 {
+		t.Error("Failed update should leave the object untouched.")
+	}
+
+	err = personResource.Update([]byte(`{"name":"Fred"}`))
+	if err == nil {
+		t.Error("Invalid name should error.")
+	}
+	if person.Name != "Bob" || person.Age != 35 {
+		t.Error("Failed update should not reset the object.")
+	}
+}
+
+func TestGenericJsonResourceConcurrentUpdates(t *testing.T) {
+	person := Person{
+		Name: "Bob",
+		Age:  35,
+	}
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func(age int) {
+			personResource := &JSONResource{Object: &person}
+			personResource.PartialUpdate([]byte(`{"age":` + strconv.Itoa(age) + `}`))
+			data, _ := personResource.Read()
+			returnedPerson := Person{}
+			if json.Unmarshal(data, &returnedPerson) != nil || returnedPerson.Name != "Bob" {
+				t.Error("Read observed a torn object.")
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+}
+
+func TestGenericJsonResourceLocksReleased(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		personResource := &JSONResource{Object: &Person{Name: "Bob"}}
+		personResource.Read()
+		personResource.PartialUpdate([]byte(`{"age":` + strconv.Itoa(i) + `}`))
+	}
+	objectLocks.Lock()
+	defer objectLocks.Unlock()
+	if len(objectLocks.locks) != 0 {
+		t.Error("Locks should be dropped once released.", len(objectLocks.locks))
+	}
+}
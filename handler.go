@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"time"
 )
 
 // Represents a REST endpoint. Should return the appropriate Resource for the given request. For
@@ -14,17 +17,128 @@ type Endpoint interface {
 // Implements a handler for a REST endpoint given the resource dispatcher.
 type EndpointHandler struct {
 	Endpoint Endpoint
+
+	// Identifies the endpoint in logs and metrics. Defaults to the Endpoint's type.
+	Name string
+
+	// Runs every write request in its own transaction when set.
+	Transactor Transactor
+
+	// Middleware wraps the whole endpoint, MethodMiddleware, keyed by method, the
+	// handler of a single method.
+	Middleware       []Middleware
+	MethodMiddleware map[string][]Middleware
+
+	// Requests must be authenticated before the resource is looked up, unless
+	// AllowAnonymous is set and the request carries no credentials. OPTIONS requests
+	// are not authenticated, browsers send CORS preflights without credentials.
+	Authenticator  Authenticator
+	AllowAnonymous bool
+
+	// Decides which methods the principal may use on the endpoint's resources, in
+	// addition to resources implementing Authorizer themselves. HideForbidden answers
+	// denied requests with a 404 rather than a 403.
+	Authorizer    Authorizer
+	HideForbidden bool
+
+	// Limits the requests made to the endpoint. Applied after authentication so
+	// requests can be limited per principal; failed authentications are limited by
+	// client IP, and an IP over its limit is refused before authenticating.
+	RateLimiter *RateLimiter
+
+	// Records request metrics for the endpoint, labelled with its Name.
+	Metrics *Metrics
+
+	// Traces requests to the endpoint, continuing traces propagated in the
+	// traceparent header.
+	Tracer Tracer
+	// Compresses responses in the coding negotiated with Accept-Encoding.
+	Compressor *Compressor
+
+	// Limits the size of request bodies after decoding their Content-Encoding.
+	// Defaults to 10MB.
+	MaxBodyBytes int64
+
+	// Caches GET responses, see ResponseCache.
+	Cache *ResponseCache
+
+	// Shares the Read of identical concurrent GETs, see ReadCoalescer.
+	Coalescer *ReadCoalescer
+
+	// The longest a long-polling GET may wait for a change, see Watchable. Defaults
+	// to 60s.
+	MaxWait time.Duration
 }
 
 func (handler EndpointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	resource := handler.Endpoint.GetResource(r)
+	var served http.Handler = Chain(http.HandlerFunc(handler.serve), handler.Middleware...)
+	if handler.Compressor != nil {
+		served = handler.Compressor.Middleware(served)
+	}
+	if handler.Tracer != nil {
+		served = traceHandler(handler.Tracer, handler.name(), served)
+	}
+	if handler.Metrics != nil {
+		served = handler.Metrics.instrument(handler.name(), served)
+	}
+	served.ServeHTTP(w, r)
+}
+
+func (handler EndpointHandler) serve(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), endpointContextKey{}, handler.Endpoint))
+	if handler.Authenticator != nil && r.Method != http.MethodOptions {
+		if handler.RateLimiter != nil && !handler.RateLimiter.allowAddress(w, r, handler.name()) {
+			return
+		}
+		var ok bool
+		r, ok = authenticate(w, r, handler.Authenticator, handler.AllowAnonymous)
+		if !ok {
+			if handler.RateLimiter != nil {
+				handler.RateLimiter.countFailure(r, handler.name())
+			}
+			return
+		}
+	}
+	if handler.RateLimiter != nil && !handler.RateLimiter.allow(w, r, handler.name()) {
+		return
+	}
+	ctx, span := startSpan(r.Context(), "GetResource")
+	resource := handler.Endpoint.GetResource(r.WithContext(ctx))
+	span.End()
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.endpoint = handler.name()
+		if resource != nil {
+			info.resource = fmt.Sprintf("%T", resource)
+		}
+	}
 	if resource == nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", resource.GetContentType())
 	methodHandler := HTTPMethodHandler{
-		dispatcher: restHandlerDispatcher{resource: resource},
+		dispatcher: restHandlerDispatcher{
+			resource:      resource,
+			transactor:    handler.Transactor,
+			middleware:    handler.MethodMiddleware,
+			authorizer:    handler.Authorizer,
+			hideForbidden: handler.HideForbidden,
+			maxBodyBytes:  handler.MaxBodyBytes,
+			cache:         handler.Cache,
+			coalescer:     handler.Coalescer,
+			metrics:       handler.Metrics,
+			endpoint:      handler.name(),
+			maxWait:       handler.MaxWait,
+		},
+	}
+	ctx, span = startSpan(r.Context(), r.Method+" handler")
+	defer span.End()
+	methodHandler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (handler EndpointHandler) name() string {
+	if handler.Name != "" {
+		return handler.Name
 	}
-	methodHandler.ServeHTTP(w, r)
+	return fmt.Sprintf("%T", handler.Endpoint)
 }
@@ -0,0 +1,151 @@
+package handlers
+
+import "context"
+
+// Lifecycle hooks run by JSONListResource.Create, JSONResource.Update, PartialUpdate
+// and Delete. They may be implemented by the object being written, in which case obj
+// is the object itself, or by the Endpoint serving the request. Object hooks run
+// before endpoint hooks. Before hooks run ahead of validation and may change the
+// object or abort the write by returning an error, see NewStatusError. After hooks run
+// once the object has been saved or deleted, and its transaction, if any, committed.
+// They receive the previous and new states.
+type BeforeCreateHook interface {
+	BeforeCreate(ctx context.Context, obj interface{}) error
+}
+
+type AfterCreateHook interface {
+	AfterCreate(ctx context.Context, obj interface{})
+}
+
+type BeforeUpdateHook interface {
+	BeforeUpdate(ctx context.Context, old interface{}, updated interface{}) error
+}
+
+type AfterUpdateHook interface {
+	AfterUpdate(ctx context.Context, old interface{}, updated interface{})
+}
+
+type BeforeDeleteHook interface {
+	BeforeDelete(ctx context.Context, obj interface{}) error
+}
+
+type AfterDeleteHook interface {
+	AfterDelete(ctx context.Context, old interface{})
+}
+
+type endpointContextKey struct{}
+
+// Returns the Endpoint serving the request, or nil outside of an EndpointHandler.
+func EndpointFromContext(ctx context.Context) Endpoint {
+	endpoint, _ := ctx.Value(endpointContextKey{}).(Endpoint)
+	return endpoint
+}
+
+// Returns the values whose hooks apply to obj, and the object passed to them.
+// Objects stored through a RepositoryObject are hooked as the wrapped object.
+func hookTargets(ctx context.Context, obj interface{}) ([]interface{}, interface{}) {
+	repositoryObject, isRepositoryObject := obj.(*RepositoryObject)
+	if isRepositoryObject {
+		obj = repositoryObject.Object
+	}
+	targets := []interface{}{obj}
+	endpoint := EndpointFromContext(ctx)
+	if endpoint != nil {
+		targets = append(targets, endpoint)
+	}
+	return targets, obj
+}
+
+func unwrapHookObject(obj interface{}) interface{} {
+	repositoryObject, isRepositoryObject := obj.(*RepositoryObject)
+	if isRepositoryObject {
+		return repositoryObject.Object
+	}
+	return obj
+}
+
+func hasUpdateHooks(ctx context.Context, obj interface{}) bool {
+	targets, _ := hookTargets(ctx, obj)
+	for _, target := range targets {
+		_, isBefore := target.(BeforeUpdateHook)
+		_, isAfter := target.(AfterUpdateHook)
+		if isBefore || isAfter {
+			return true
+		}
+	}
+	return false
+}
+
+func beforeCreate(ctx context.Context, obj interface{}) error {
+	targets, obj := hookTargets(ctx, obj)
+	for _, target := range targets {
+		hook, isHook := target.(BeforeCreateHook)
+		if isHook {
+			err := hook.BeforeCreate(ctx, obj)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func afterCreate(ctx context.Context, obj interface{}) {
+	targets, obj := hookTargets(ctx, obj)
+	for _, target := range targets {
+		hook, isHook := target.(AfterCreateHook)
+		if isHook {
+			hook.AfterCreate(ctx, obj)
+		}
+	}
+}
+
+func beforeUpdate(ctx context.Context, old interface{}, updated interface{}) error {
+	targets, updated := hookTargets(ctx, updated)
+	old = unwrapHookObject(old)
+	for _, target := range targets {
+		hook, isHook := target.(BeforeUpdateHook)
+		if isHook {
+			err := hook.BeforeUpdate(ctx, old, updated)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func afterUpdate(ctx context.Context, old interface{}, updated interface{}) {
+	targets, updated := hookTargets(ctx, updated)
+	old = unwrapHookObject(old)
+	for _, target := range targets {
+		hook, isHook := target.(AfterUpdateHook)
+		if isHook {
+			hook.AfterUpdate(ctx, old, updated)
+		}
+	}
+}
+
+func beforeDelete(ctx context.Context, obj interface{}) error {
+	targets, obj := hookTargets(ctx, obj)
+	for _, target := range targets {
+		hook, isHook := target.(BeforeDeleteHook)
+		if isHook {
+			err := hook.BeforeDelete(ctx, obj)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func afterDelete(ctx context.Context, obj interface{}) {
+	targets, obj := hookTargets(ctx, obj)
+	for _, target := range targets {
+		hook, isHook := target.(AfterDeleteHook)
+		if isHook {
+			hook.AfterDelete(ctx, obj)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type hookedPet struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var hookedPets = make(map[string]*hookedPet)
+
+func (pet *hookedPet) Validate() FieldErrors {
+	if pet.Name == "" {
+		errs := NewFieldErrors()
+		errs.Add("name", "required")
+		return errs
+	}
+	return nil
+}
+
+func (pet *hookedPet) Save() error {
+	hookedPets[pet.ID] = pet
+	return nil
+}
+
+func (pet *hookedPet) Delete() error {
+	delete(hookedPets, pet.ID)
+	return nil
+}
+
+func (pet *hookedPet) Reset() {
+	*pet = hookedPet{ID: pet.ID, CreatedAt: pet.CreatedAt}
+}
+
+func (pet *hookedPet) BeforeCreate(ctx context.Context, obj interface{}) error {
+	pet.Name = strings.TrimSpace(pet.Name)
+	pet.CreatedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return nil
+}
+
+type hookedEndpoint struct {
+	updates [][2]string
+	deleted []string
+}
+
+func (endpoint *hookedEndpoint) GetResource(r *http.Request) Resource {
+	id := strings.Trim(r.URL.Path, "/")
+	if id == "" {
+		return &JSONListResource{Creator: endpoint}
+	}
+	pet := hookedPets[id]
+	if pet == nil {
+		return nil
+	}
+	return &JSONResource{Object: pet}
+}
+
+func (endpoint *hookedEndpoint) Create() SafeSavable {
+	return &hookedPet{}
+}
+
+func (endpoint *hookedEndpoint) BeforeCreate(ctx context.Context, obj interface{}) error {
+	if obj.(*hookedPet).Name == "Fred" {
+		return NewStatusError(http.StatusUnprocessableEntity, "no more Freds")
+	}
+	return nil
+}
+
+func (endpoint *hookedEndpoint) AfterUpdate(ctx context.Context, old interface{}, updated interface{}) {
+	endpoint.updates = append(endpoint.updates, [2]string{old.(*hookedPet).Name, updated.(*hookedPet).Name})
+}
+
+func (endpoint *hookedEndpoint) BeforeDelete(ctx context.Context, obj interface{}) error {
+	if obj.(*hookedPet).ID == "keep" {
+		return NewStatusError(http.StatusForbidden, "cannot delete")
+	}
+	return nil
+}
+
+func (endpoint *hookedEndpoint) AfterDelete(ctx context.Context, old interface{}) {
+	endpoint.deleted = append(endpoint.deleted, old.(*hookedPet).ID)
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	hookedPets = make(map[string]*hookedPet)
+	endpoint := &hookedEndpoint{}
+	handler := EndpointHandler{Endpoint: endpoint}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":"rex","name":"  Rex "}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatal("Create should succeed, got " + w.Body.String())
+	}
+	if hookedPets["rex"].Name != "Rex" || hookedPets["rex"].CreatedAt.IsZero() {
+		t.Error("Object before create hook should normalise and stamp the object.")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":"fred","name":"Fred"}`)))
+	if w.Code != http.StatusUnprocessableEntity || w.Body.String() != "no more Freds" {
+		t.Error("Endpoint before create hook should abort with its status.")
+	}
+	if hookedPets["fred"] != nil {
+		t.Error("Aborted object should not be saved.")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/rex", strings.NewReader(`{"name":"Max"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatal("Patch should succeed.")
+	}
+	if len(endpoint.updates) != 1 || endpoint.updates[0] != [2]string{"Rex", "Max"} {
+		t.Error("After update hook should receive the old and new state.")
+	}
+
+	hookedPets["keep"] = &hookedPet{ID: "keep", Name: "Keep"}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/keep", nil))
+	if w.Code != http.StatusForbidden || hookedPets["keep"] == nil {
+		t.Error("Before delete hook should abort the delete.")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/rex", nil))
+	if w.Code != http.StatusOK || len(endpoint.deleted) != 1 || endpoint.deleted[0] != "rex" {
+		t.Error("After delete hook should receive the deleted object.")
+	}
+}
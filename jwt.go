@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A set of JSON Web Keys used to verify tokens, keyed by key id. Supports "oct" keys
+// for HS256, "RSA" keys for RS256 and P-256 "EC" keys for ES256.
+type JWKS struct {
+	keys map[string]interface{}
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Reads a JWKS document, {"keys": [...]}, from a local file.
+func LoadJWKS(path string) (*JWKS, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+func ParseJWKS(data []byte) (*JWKS, error) {
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(data, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks := &JWKS{keys: make(map[string]interface{})}
+	for _, jwk := range document.Keys {
+		var key interface{}
+		switch jwk.Kty {
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(jwk.K)
+		case "RSA":
+			var n, e []byte
+			n, err = base64.RawURLEncoding.DecodeString(jwk.N)
+			if err == nil {
+				e, err = base64.RawURLEncoding.DecodeString(jwk.E)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				return nil, fmt.Errorf("handlers: unsupported curve %q for key %q", jwk.Crv, jwk.Kid)
+			}
+			var x, y []byte
+			x, err = base64.RawURLEncoding.DecodeString(jwk.X)
+			if err == nil {
+				y, err = base64.RawURLEncoding.DecodeString(jwk.Y)
+			}
+			key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			return nil, fmt.Errorf("handlers: unsupported key type %q for key %q", jwk.Kty, jwk.Kid)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("handlers: invalid key %q: %w", jwk.Kid, err)
+		}
+		jwks.keys[jwk.Kid] = key
+	}
+	return jwks, nil
+}
+
+// Authenticates requests carrying a JWT bearer token signed with HS256, RS256 or
+// ES256 by one of Keys. The token's "exp" and "nbf" claims are enforced, as are "iss"
+// and "aud" when Issuer and Audience are set. The principal's subject is the "sub"
+// claim and its roles the string array in RolesClaim, "roles" by default.
+type JWTAuthenticator struct {
+	Keys       *JWKS
+	Issuer     string
+	Audience   string
+	RolesClaim string
+	Realm      string
+	Leeway     time.Duration
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+func (authenticator *JWTAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+	claims, err := authenticator.verify(strings.TrimSpace(authorization[7:]))
+	if err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{Claims: claims}
+	principal.Subject, _ = claims["sub"].(string)
+	rolesClaim := authenticator.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	roles, _ := claims[rolesClaim].([]interface{})
+	for _, role := range roles {
+		if role, ok := role.(string); ok {
+			principal.Roles = append(principal.Roles, role)
+		}
+	}
+	return principal, nil
+}
+
+func (authenticator *JWTAuthenticator) Challenge() string {
+	challenge := "Bearer"
+	if authenticator.Realm != "" {
+		challenge += ` realm="` + authenticator.Realm + `"`
+	}
+	return challenge
+}
+
+func (authenticator *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeJWTSegment(parts[0], &header)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if authenticator.Keys == nil {
+		return nil, errInvalidToken
+	}
+	key, ok := authenticator.Keys.keys[header.Kid]
+	if !ok {
+		return nil, errInvalidToken
+	}
+	if !verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, errInvalidToken
+	}
+
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(base64.NewDecoder(base64.RawURLEncoding, strings.NewReader(parts[1])))
+	decoder.UseNumber()
+	err = decoder.Decode(&claims)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	exp, hasExp, err := numericClaim(claims, "exp")
+	if err != nil {
+		return nil, err
+	}
+	nbf, hasNbf, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if hasExp && now.After(exp.Add(authenticator.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if hasNbf && now.Add(authenticator.Leeway).Before(nbf) {
+		return nil, errors.New("token not yet valid")
+	}
+	if authenticator.Issuer != "" && claims["iss"] != authenticator.Issuer {
+		return nil, errInvalidToken
+	}
+	if authenticator.Audience != "" && !hasAudience(claims["aud"], authenticator.Audience) {
+		return nil, errInvalidToken
+	}
+	return claims, nil
+}
+
+// Checks the signature for alg, refusing keys of the wrong type so that, for instance,
+// an RSA public key can never be used as an HMAC secret.
+func verifyJWTSignature(alg string, key interface{}, signed []byte, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS256":
+		publicKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	case "ES256":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(publicKey, digest[:], r, s)
+	}
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// Returns the time in a NumericDate claim, and whether the claim is present. Claims
+// that are present but not numbers are rejected rather than ignored, so that a token
+// cannot escape expiry with "exp": "never".
+func numericClaim(claims map[string]interface{}, name string) (time.Time, bool, error) {
+	value, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, true, errInvalidToken
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, true, errInvalidToken
+	}
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+func hasAudience(claim interface{}, audience string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == audience
+	case []interface{}:
+		for _, value := range claim {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	secret := []byte("hmac-secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "hs", "kty": "oct", "k": encode(secret)},
+		{"kid": "rs", "kty": "RSA", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "es", "kty": "EC", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	ioutil.WriteFile(path, jwks, 0644)
+	keys, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := &JWTAuthenticator{Keys: keys, Issuer: "issuer", Audience: "pets", Realm: "pets"}
+	claims := map[string]interface{}{
+		"sub":   "bob",
+		"iss":   "issuer",
+		"aud":   []string{"pets"},
+		"roles": []string{"admin"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	authenticate := func(token string) (*Principal, error) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return authenticator.Authenticate(r)
+	}
+
+	for _, test := range []struct {
+		alg string
+		kid string
+		key interface{}
+	}{{"HS256", "hs", secret}, {"RS256", "rs", rsaKey}, {"ES256", "es", ecKey}} {
+		principal, err := authenticate(signJWT(t, test.alg, test.kid, test.key, claims))
+		if err != nil {
+			t.Error(test.alg + " token should authenticate: " + err.Error())
+			continue
+		}
+		if principal.Subject != "bob" || !principal.HasRole("admin") {
+			t.Error(test.alg + " principal not populated from claims.")
+		}
+	}
+
+	// An RSA public key must not be accepted as an HMAC secret.
+	if _, err := authenticate(signJWT(t, "HS256", "rs", secret, claims)); err == nil {
+		t.Error("Token signed for the wrong key type should fail.")
+	}
+	if _, err := authenticate(signJWT(t, "HS256", "hs", []byte("wrong"), claims)); err == nil {
+		t.Error("Token with a bad signature should fail.")
+	}
+
+	expired := map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "pets", "exp": time.Now().Add(-time.Hour).Unix()}
+	if _, err := authenticate(signJWT(t, "HS256", "hs", secret, expired)); err == nil {
+		t.Error("Expired token should fail.")
+	}
+	for _, claim := range []string{"exp", "nbf"} {
+		malformed := map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "pets", claim: "never"}
+		if _, err := authenticate(signJWT(t, "HS256", "hs", secret, malformed)); err == nil {
+			t.Error("Token with a non-numeric " + claim + " should fail.")
+		}
+	}
+	wrongAudience := map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "other"}
+	if _, err := authenticate(signJWT(t, "HS256", "hs", secret, wrongAudience)); err == nil {
+		t.Error("Token for another audience should fail.")
+	}
+
+	handler := EndpointHandler{Endpoint: principalEndpoint{}, Authenticator: authenticator}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer not.a.token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="pets"` {
+		t.Error("Invalid token should give a 401 with a bearer challenge.")
+	}
+}
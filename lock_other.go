@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package handlers
+
+import (
+	"errors"
+	"runtime"
+)
+
+// These platforms have no file lock, and without one processes sharing a
+// FileRepository could lose each other's updates.
+func lockFile(path string) (func(), error) {
+	return nil, errors.New("handlers: FileRepository is not supported on " + runtime.GOOS + ", it has no file locks")
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package handlers
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const lockfileExclusiveLock = 0x2
+
+// Takes an exclusive lock on the first byte of path, creating it if needed. The
+// returned function releases the lock.
+func lockFile(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	handle := file.Fd()
+	overlapped := new(syscall.Overlapped)
+	ok, _, err := procLockFileEx.Call(handle, lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+	if ok == 0 {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		procUnlockFileEx.Call(handle, 0, 1, 0, uintptr(unsafe.Pointer(overlapped)))
+		file.Close()
+	}, nil
+}
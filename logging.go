@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+// Headers that are always redacted when logged.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"}
+
+// Logs one structured record per request with log/slog: method, path, matched
+// endpoint, resource type, status, response bytes, latency, request ID and principal.
+// Error responses also log the error that caused them. Successful requests are logged
+// at Info, 4xx responses at Warn and 5xx responses at Error.
+type AccessLogger struct {
+	Logger *slog.Logger // Defaults to slog.Default().
+
+	// Request headers to log. Sensitive headers, and those in RedactHeaders, are
+	// logged as [REDACTED].
+	Headers       []string
+	RedactHeaders []string
+
+	// Log JSON request bodies of up to MaxBodyBytes, 4KB by default, with the values
+	// of RedactFields, at any depth, replaced by [REDACTED].
+	LogBody      bool
+	MaxBodyBytes int
+	RedactFields []string
+}
+
+func (logger *AccessLogger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+
+		var body []byte
+		if logger.LogBody && r.Body != nil {
+			body, r.Body = logger.peekBody(r.Body)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.statusCode()
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Duration("latency", time.Since(start)),
+		}
+		if info.endpoint != "" {
+			attrs = append(attrs, slog.String("endpoint", info.endpoint))
+		}
+		if info.resource != "" {
+			attrs = append(attrs, slog.String("resource", info.resource))
+		}
+		if requestID := requestIDOf(r); requestID != "" {
+			attrs = append(attrs, slog.String("request_id", requestID))
+		}
+		if info.principal != nil {
+			attrs = append(attrs, slog.String("principal", info.principal.Subject))
+		}
+		if len(logger.Headers) > 0 {
+			attrs = append(attrs, logger.headerAttrs(r.Header))
+		}
+		if len(body) > 0 {
+			attrs = append(attrs, slog.String("body", logger.redactBody(body)))
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		if status >= http.StatusBadRequest && info.err != nil {
+			attrs = append(attrs, slog.String("error", info.err.Error()))
+		}
+
+		logger.logger().LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+func (logger *AccessLogger) logger() *slog.Logger {
+	if logger.Logger == nil {
+		return slog.Default()
+	}
+	return logger.Logger
+}
+
+// Reads the start of body for logging and returns a body that still yields all of it.
+func (logger *AccessLogger) peekBody(body io.ReadCloser) ([]byte, io.ReadCloser) {
+	limit := logger.MaxBodyBytes
+	if limit <= 0 {
+		limit = 4 << 10
+	}
+	peeked, _ := ioutil.ReadAll(io.LimitReader(body, int64(limit)))
+	return peeked, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), body), body}
+}
+
+func (logger *AccessLogger) headerAttrs(header http.Header) slog.Attr {
+	attrs := make([]any, 0, len(logger.Headers))
+	for _, name := range logger.Headers {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if containsFold(sensitiveHeaders, name) || containsFold(logger.RedactHeaders, name) {
+			value = redacted
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.Group("headers", attrs...)
+}
+
+func (logger *AccessLogger) redactBody(body []byte) string {
+	var value interface{}
+	if json.Unmarshal(body, &value) != nil {
+		if len(logger.RedactFields) > 0 {
+			// A body that cannot be parsed cannot be redacted either.
+			return redacted
+		}
+		return string(body)
+	}
+	data, err := json.Marshal(redactFields(value, logger.RedactFields))
+	if err != nil {
+		return redacted
+	}
+	return string(data)
+}
+
+func redactFields(value interface{}, fields []string) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if containsFold(fields, key) {
+				value[key] = redacted
+			} else {
+				value[key] = redactFields(field, fields)
+			}
+		}
+	case []interface{}:
+		for i, element := range value {
+			value[i] = redactFields(element, fields)
+		}
+	}
+	return value
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type failingDeletable struct {
+	resource
+}
+
+func (deletable failingDeletable) Delete() error {
+	return errDatabaseDown
+}
+
+var errDatabaseDown = errors.New("database down")
+
+type failingEndpoint struct{}
+
+func (endpoint failingEndpoint) GetResource(r *http.Request) Resource {
+	return failingDeletable{}
+}
+
+func TestAccessLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger := &AccessLogger{
+		Logger:       slog.New(slog.NewJSONHandler(&output, nil)),
+		Headers:      []string{"X-API-Key", "User-Agent"},
+		LogBody:      true,
+		RedactFields: []string{"password"},
+	}
+	handler := Chain(EndpointHandler{
+		Endpoint:       PetListResourceDispatcher{},
+		Name:           "pets",
+		Authenticator:  &APIKeyAuthenticator{Keys: map[string]*Principal{"secret": {Subject: "bob"}}},
+		AllowAnonymous: true,
+	}, (&RequestID{}).Middleware, logger.Middleware)
+
+	dataStore = make(map[string]*PetObject)
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":"foo","name":"Foo","password":"hunter2"}`))
+	r.Header.Set("X-API-Key", "secret")
+	r.Header.Set("User-Agent", "test")
+	r.Header.Set("X-Request-ID", "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusCreated || dataStore["foo"] == nil || dataStore["foo"].Name != "Foo" {
+		t.Fatal("Logging should not change the request.")
+	}
+
+	var record map[string]interface{}
+	json.Unmarshal(output.Bytes(), &record)
+	if record["level"] != "INFO" || record["method"] != "POST" || record["status"] != float64(201) ||
+		record["endpoint"] != "pets" || record["resource"] != "*handlers.PetList" ||
+		record["principal"] != "bob" || record["request_id"] != "abc" || record["bytes"] == float64(0) {
+		t.Error("Missing request attributes " + output.String())
+	}
+	headers, _ := record["headers"].(map[string]interface{})
+	if headers["X-API-Key"] != redacted || headers["User-Agent"] != "test" {
+		t.Error("Sensitive headers should be redacted " + output.String())
+	}
+	if strings.Contains(output.String(), "hunter2") || !strings.Contains(output.String(), `\"name\":\"Foo\"`) {
+		t.Error("Body fields should be redacted " + output.String())
+	}
+
+	output.Reset()
+	errorHandler := Chain(EndpointHandler{Endpoint: failingEndpoint{}}, logger.Middleware)
+	w = httptest.NewRecorder()
+	errorHandler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/", nil))
+	record = map[string]interface{}{}
+	json.Unmarshal(output.Bytes(), &record)
+	if record["level"] != "ERROR" || record["error"] != "database down" {
+		t.Error("Server errors should be logged with their cause " + output.String())
+	}
+}
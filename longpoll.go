@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Readable resource implementing Watchable can be long polled: a GET with a
+// `Prefer: wait=30` header or `?wait=30s` query parameter and an If-None-Match header
+// matching the resource's current ETag waits until the resource changes, or the wait
+// elapses, before it is answered with the new body or a 304.
+type Watchable interface {
+	// Returns a subscription to the changes of the resource, or nil if its changes
+	// are not published.
+	Watch() *Subscription
+}
+
+// The longest a GET may wait for a change when none is configured.
+const defaultMaxWait = 60 * time.Second
+
+// Returns the strong ETag of a response body.
+func entityTag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Returns whether the If-None-Match header value matches etag, using the weak
+// comparison so that ETags weakened by compression still match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how long the request asks to wait for a change, at most max, and whether
+// the wait was asked for with the Prefer header.
+func longPollWait(r *http.Request, max time.Duration) (time.Duration, bool) {
+	if max <= 0 {
+		max = defaultMaxWait
+	}
+	wait, preferred := time.Duration(0), false
+	if value := r.URL.Query().Get("wait"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			seconds, _ := strconv.Atoi(value)
+			duration = time.Duration(seconds) * time.Second
+		}
+		wait = duration
+	}
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			preference, _, _ = strings.Cut(preference, ";")
+			name, argument, _ := strings.Cut(strings.TrimSpace(preference), "=")
+			if strings.EqualFold(name, "wait") {
+				seconds, err := strconv.Atoi(strings.Trim(argument, `"`))
+				if err == nil {
+					wait, preferred = time.Duration(seconds)*time.Second, true
+				}
+			}
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait, preferred
+}
+
+// Returns whether the request is a long poll, see Watchable.
+func isLongPoll(r *http.Request) bool {
+	wait, _ := longPollWait(r, 0)
+	return wait > 0 && r.Header.Get("If-None-Match") != ""
+}
+
+// Waits until a change to the resource gives it an ETag other than that of data, the
+// wait elapses or the client goes away, and returns the resource as last read.
+func (handler getHandler) waitForChange(r *http.Request, subscription *Subscription, wait time.Duration, data []byte) ([]byte, error) {
+	etag := entityTag(data)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return data, nil
+		case <-timer.C:
+			return data, nil
+		case _, ok := <-subscription.Events():
+			// Not coalesced, a shared read may have started before the change.
+			changed, err := readResource(r.Context(), handler.readable)
+			if err != nil || !ok || entityTag(changed) != etag {
+				return changed, err
+			}
+		}
+	}
+}
+
+func (resource *JSONResource) Watch() *Subscription {
+	if resource.Changes == nil {
+		return nil
+	}
+	return resource.Changes.Subscribe(resource.Collection, resource.Key)
+}
+
+func (resource *JSONListResource) Watch() *Subscription {
+	if resource.Changes == nil {
+		return nil
+	}
+	return resource.Changes.Subscribe(resource.Collection, "")
+}
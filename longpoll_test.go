@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLongPollServer() *httptest.Server {
+	bus := &ChangeBus{}
+	return httptest.NewServer(EndpointHandler{
+		Endpoint: livePeopleEndpoint{people: map[string]*Person{"bob": {Name: "Bob", Age: 35}}, bus: bus},
+		MaxWait:  2 * time.Second,
+	})
+}
+
+func longPoll(t *testing.T, url string, etag string, prefer string) *http.Response {
+	request, _ := http.NewRequest(http.MethodGet, url, nil)
+	request.Header.Set("If-None-Match", etag)
+	if prefer != "" {
+		request.Header.Set("Prefer", prefer)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestGetETag(t *testing.T) {
+	server := newLongPollServer()
+	defer server.Close()
+
+	response, _ := http.Get(server.URL + "/people/bob")
+	etag := response.Header.Get("ETag")
+	if etag == "" || response.StatusCode != http.StatusOK {
+		t.Fatal("GET responses should have an ETag.")
+	}
+	response = longPoll(t, server.URL+"/people/bob", "W/"+etag, "")
+	if response.StatusCode != http.StatusNotModified {
+		t.Error("Matching If-None-Match headers should get a 304.")
+	}
+	response = longPoll(t, server.URL+"/people/bob", `"other"`, "")
+	if response.StatusCode != http.StatusOK {
+		t.Error("Other ETags should get the body.")
+	}
+}
+
+func TestLongPollChange(t *testing.T) {
+	server := newLongPollServer()
+	defer server.Close()
+	response, _ := http.Get(server.URL + "/people/bob")
+	etag := response.Header.Get("ETag")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		request, _ := http.NewRequest(http.MethodPatch, server.URL+"/people/bob", strings.NewReader(`{"age":36}`))
+		http.DefaultClient.Do(request)
+	}()
+	start := time.Now()
+	response = longPoll(t, server.URL+"/people/bob", etag, "wait=10")
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), `"age":36`) {
+		t.Error("Long polls should return the changed resource.", response.StatusCode, string(body))
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Long polls should return when the resource changes.")
+	}
+	if response.Header.Get("Preference-Applied") != "wait=2" {
+		t.Error("The wait should be capped at MaxWait.", response.Header.Get("Preference-Applied"))
+	}
+	if response.Header.Get("ETag") == etag {
+		t.Error("The new ETag should be returned.")
+	}
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	server := newLongPollServer()
+	defer server.Close()
+	response, _ := http.Get(server.URL + "/people/bob")
+	etag := response.Header.Get("ETag")
+
+	start := time.Now()
+	response = longPoll(t, server.URL+"/people/bob?wait=200ms", etag, "")
+	if response.StatusCode != http.StatusNotModified || response.Header.Get("ETag") != etag {
+		t.Error("Long polls should return a 304 when the wait elapses.")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Error("Long polls should wait for the requested time.", elapsed)
+	}
+	if response.Header.Get("Preference-Applied") != "" {
+		t.Error("Waits asked for in the query should not be reported as applied preferences.")
+	}
+
+	// Changes that leave the resource as it was keep the request waiting.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		request, _ := http.NewRequest(http.MethodPatch, server.URL+"/people/bob", strings.NewReader(`{"age":35}`))
+		http.DefaultClient.Do(request)
+	}()
+	start = time.Now()
+	response = longPoll(t, server.URL+"/people/bob?wait=300ms", etag, "")
+	if response.StatusCode != http.StatusNotModified || time.Since(start) < 300*time.Millisecond {
+		t.Error("Unchanged resources should not end the wait.")
+	}
+}
+
+func TestConditionalWrite(t *testing.T) {
+	server := newLongPollServer()
+	defer server.Close()
+
+	for _, method := range []string{http.MethodPut, http.MethodPatch} {
+		request, _ := http.NewRequest(method, server.URL+"/people/bob?wait=10s", strings.NewReader(`{"name":"Bob","age":40}`))
+		request.Header.Set("If-None-Match", "*")
+		request.Header.Set("Prefer", "wait=10")
+		start := time.Now()
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK || !strings.Contains(string(body), `"age":40`) {
+			t.Error("Writes should return the written resource.", method, response.StatusCode)
+		}
+		if time.Since(start) > time.Second {
+			t.Error("Writes should not wait for changes.", method)
+		}
+	}
+}
+
+func TestLongPollWait(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/?wait=5", nil)
+	if wait, preferred := longPollWait(request, 0); wait != 5*time.Second || preferred {
+		t.Error("Waits in the query may be given in seconds.")
+	}
+	request.Header.Set("Prefer", `return=minimal, wait=500; foo="bar"`)
+	if wait, preferred := longPollWait(request, 0); wait != defaultMaxWait || !preferred {
+		t.Error("Prefer headers should be parsed and capped.", wait)
+	}
+}
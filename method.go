@@ -1,11 +1,17 @@
 package handlers
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
 type HandlerDispatcher interface {
 	GetMethodHandler(requestMethod string) http.Handler
 }
 
+// Dispatches to a handler per method. MethodMiddleware, keyed by method, wraps the
+// handler of that method. Without an OPTIONS handler, OPTIONS requests are answered
+// with the methods that have a handler.
 type HTTPMethodDispatcher struct {
 	GET     http.Handler
 	POST    http.Handler
@@ -13,6 +19,8 @@ type HTTPMethodDispatcher struct {
 	PUT     http.Handler
 	DELETE  http.Handler
 	OPTIONS http.Handler
+
+	MethodMiddleware map[string][]Middleware
 }
 
 func (handler HTTPMethodDispatcher) GetMethodHandler(requestMethod string) http.Handler {
@@ -34,11 +42,17 @@ func (handler HTTPMethodDispatcher) GetMethodHandler(requestMethod string) http.
 		break
 	case http.MethodOptions:
 		method = handler.OPTIONS
+		if method == nil {
+			method = optionsHandler{allowed: handler.allowedMethods()}
+		}
 		break
 	default:
 		break
 	}
 
+	if method != nil {
+		method = Chain(method, handler.MethodMiddleware[requestMethod]...)
+	}
 	return method
 }
 
@@ -54,3 +68,33 @@ func (handler HTTPMethodHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	}
 	method.ServeHTTP(w, r)
 }
+
+func (handler HTTPMethodDispatcher) allowedMethods() []string {
+	allowed := make([]string, 0)
+	methods := []struct {
+		name    string
+		handler http.Handler
+	}{
+		{http.MethodGet, handler.GET},
+		{http.MethodPost, handler.POST},
+		{http.MethodPut, handler.PUT},
+		{http.MethodPatch, handler.PATCH},
+		{http.MethodDelete, handler.DELETE},
+	}
+	for _, method := range methods {
+		if method.handler != nil {
+			allowed = append(allowed, method.name)
+		}
+	}
+	return append(allowed, http.MethodOptions)
+}
+
+// Answers OPTIONS requests with the allowed methods in the Allow header.
+type optionsHandler struct {
+	allowed []string
+}
+
+func (handler optionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(handler.allowed, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	DefaultSizeBuckets     = []float64{100, 1000, 10000, 100000, 1000000, 10000000}
+)
+
+// Collects request metrics and exposes them in the Prometheus text format from
+// Handler. Set Metrics on EndpointHandler to instrument an endpoint, or use
+// Middleware to instrument any handler, which then takes the endpoint label from
+// the EndpointHandler it wraps, if any.
+//
+// The series, prefixed with Namespace, are
+//
+//	http_requests_total{endpoint, method, code}
+//	http_request_duration_seconds{endpoint, method, code}
+//	http_response_size_bytes{endpoint, method, code}
+//	http_requests_in_flight{endpoint, method}
+//	http_request_errors_total{endpoint, method, kind}
+//	coalesced_reads_total{endpoint, result}
+//
+// where method is "other" for methods not defined by HTTP, so clients cannot grow the
+// number of series, code is the status class, e.g. "2xx", and kind is "validation" for
+// requests rejected with FieldErrors, "client" for other 4xx responses and "server"
+// for 5xx responses. For endpoints with a ReadCoalescer, result is "executed" for
+// GETs that called Read and "shared" for those that waited for another's Read.
+type Metrics struct {
+	Namespace       string // Defaults to "handlers".
+	DurationBuckets []float64
+	SizeBuckets     []float64
+
+	mu       sync.Mutex
+	requests map[metricLabels]*requestSeries
+	inFlight map[metricLabels]int64
+	errors   map[metricLabels]uint64
+	reads    map[metricLabels]uint64
+}
+
+type requestSeries struct {
+	count    uint64
+	duration *histogram
+	size     *histogram
+}
+
+// The labels of a series. code holds the status class, or the error kind.
+type metricLabels struct {
+	endpoint string
+	method   string
+	code     string
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (histogram *histogram) observe(value float64) {
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.sum += value
+	histogram.count++
+}
+
+func (metrics *Metrics) Middleware(next http.Handler) http.Handler {
+	endpoint := ""
+	switch handler := next.(type) {
+	case EndpointHandler:
+		endpoint = handler.name()
+	case *EndpointHandler:
+		endpoint = handler.name()
+	}
+	return metrics.instrument(endpoint, next)
+}
+
+func (metrics *Metrics) instrument(endpoint string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		gauge := metricLabels{endpoint: endpoint, method: methodLabel(r.Method)}
+		metrics.addInFlight(gauge, 1)
+		defer metrics.addInFlight(gauge, -1)
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		labels := metricLabels{endpoint: endpoint, method: methodLabel(r.Method)}
+		if labels.endpoint == "" {
+			labels.endpoint = info.endpoint
+		}
+		metrics.observe(labels, recorder.statusCode(), recorder.bytes, time.Since(start), info.err)
+	})
+}
+
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+func (metrics *Metrics) addInFlight(labels metricLabels, delta int64) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.inFlight == nil {
+		metrics.inFlight = make(map[metricLabels]int64)
+	}
+	metrics.inFlight[labels] += delta
+}
+
+func (metrics *Metrics) observe(labels metricLabels, status int, size int, duration time.Duration, err error) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.requests == nil {
+		metrics.requests = make(map[metricLabels]*requestSeries)
+		metrics.errors = make(map[metricLabels]uint64)
+	}
+
+	errorLabels := labels
+	_, isFieldErrors := err.(FieldErrors)
+	switch {
+	case status >= http.StatusInternalServerError:
+		errorLabels.code = "server"
+	case isFieldErrors:
+		errorLabels.code = "validation"
+	case status >= http.StatusBadRequest:
+		errorLabels.code = "client"
+	}
+	if errorLabels.code != "" {
+		metrics.errors[errorLabels]++
+	}
+
+	labels.code = strconv.Itoa(status/100) + "xx"
+	series := metrics.requests[labels]
+	if series == nil {
+		series = &requestSeries{
+			duration: newHistogram(metrics.durationBuckets()),
+			size:     newHistogram(metrics.sizeBuckets()),
+		}
+		metrics.requests[labels] = series
+	}
+	series.count++
+	series.duration.observe(duration.Seconds())
+	series.size.observe(float64(size))
+}
+
+func (metrics *Metrics) observeRead(endpoint string, shared bool) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if metrics.reads == nil {
+		metrics.reads = make(map[metricLabels]uint64)
+	}
+	labels := metricLabels{endpoint: endpoint, code: "executed"}
+	if shared {
+		labels.code = "shared"
+	}
+	metrics.reads[labels]++
+}
+
+func (metrics *Metrics) durationBuckets() []float64 {
+	if len(metrics.DurationBuckets) == 0 {
+		return DefaultDurationBuckets
+	}
+	return metrics.DurationBuckets
+}
+
+func (metrics *Metrics) sizeBuckets() []float64 {
+	if len(metrics.SizeBuckets) == 0 {
+		return DefaultSizeBuckets
+	}
+	return metrics.SizeBuckets
+}
+
+func (metrics *Metrics) namespace() string {
+	if metrics.Namespace == "" {
+		return "handlers"
+	}
+	return metrics.Namespace
+}
+
+// Returns a handler serving the metrics in the Prometheus text exposition format.
+func (metrics *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(metrics.exposition()))
+	})
+}
+
+func (metrics *Metrics) exposition() string {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	prefix := metrics.namespace() + "_"
+	var builder strings.Builder
+
+	requests := make([]metricLabels, 0, len(metrics.requests))
+	for labels := range metrics.requests {
+		requests = append(requests, labels)
+	}
+	sortLabels(requests)
+	writeHeader(&builder, prefix+"http_requests_total", "counter", "Requests served.")
+	for _, labels := range requests {
+		writeSample(&builder, prefix+"http_requests_total", labels.format("code"), "", float64(metrics.requests[labels].count))
+	}
+	writeHeader(&builder, prefix+"http_request_duration_seconds", "histogram", "Time taken to serve requests.")
+	for _, labels := range requests {
+		writeHistogram(&builder, prefix+"http_request_duration_seconds", labels.format("code"), metrics.requests[labels].duration)
+	}
+	writeHeader(&builder, prefix+"http_response_size_bytes", "histogram", "Size of response bodies.")
+	for _, labels := range requests {
+		writeHistogram(&builder, prefix+"http_response_size_bytes", labels.format("code"), metrics.requests[labels].size)
+	}
+
+	inFlight := make([]metricLabels, 0, len(metrics.inFlight))
+	for labels := range metrics.inFlight {
+		inFlight = append(inFlight, labels)
+	}
+	sortLabels(inFlight)
+	writeHeader(&builder, prefix+"http_requests_in_flight", "gauge", "Requests being served.")
+	for _, labels := range inFlight {
+		writeSample(&builder, prefix+"http_requests_in_flight", labels.format(""), "", float64(metrics.inFlight[labels]))
+	}
+
+	errors := make([]metricLabels, 0, len(metrics.errors))
+	for labels := range metrics.errors {
+		errors = append(errors, labels)
+	}
+	sortLabels(errors)
+	writeHeader(&builder, prefix+"http_request_errors_total", "counter", "Failed requests by kind: validation, client or server.")
+	for _, labels := range errors {
+		writeSample(&builder, prefix+"http_request_errors_total", labels.format("kind"), "", float64(metrics.errors[labels]))
+	}
+
+	if len(metrics.reads) > 0 {
+		reads := make([]metricLabels, 0, len(metrics.reads))
+		for labels := range metrics.reads {
+			reads = append(reads, labels)
+		}
+		sortLabels(reads)
+		writeHeader(&builder, prefix+"coalesced_reads_total", "counter", "Reads of coalesced GETs by result: executed or shared.")
+		for _, labels := range reads {
+			formatted := `endpoint="` + escapeLabel(labels.endpoint) + `",result="` + labels.code + `"`
+			writeSample(&builder, prefix+"coalesced_reads_total", formatted, "", float64(metrics.reads[labels]))
+		}
+	}
+	return builder.String()
+}
+
+// Returns the labels in Prometheus syntax, naming the code label codeName, or
+// leaving it out if codeName is empty.
+func (labels metricLabels) format(codeName string) string {
+	formatted := `endpoint="` + escapeLabel(labels.endpoint) + `",method="` + escapeLabel(labels.method) + `"`
+	if codeName != "" {
+		formatted += "," + codeName + `="` + escapeLabel(labels.code) + `"`
+	}
+	return formatted
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func sortLabels(labels []metricLabels) {
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].format("code") < labels[j].format("code")
+	})
+}
+
+func writeHeader(builder *strings.Builder, name string, metricType string, help string) {
+	fmt.Fprintf(builder, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(builder *strings.Builder, name string, labels string, extra string, value float64) {
+	if extra != "" {
+		labels += "," + extra
+	}
+	fmt.Fprintf(builder, "%s{%s} %s\n", name, labels, formatFloat(value))
+}
+
+func writeHistogram(builder *strings.Builder, name string, labels string, histogram *histogram) {
+	for i, bound := range histogram.buckets {
+		writeSample(builder, name+"_bucket", labels, `le="`+formatFloat(bound)+`"`, float64(histogram.counts[i]))
+	}
+	writeSample(builder, name+"_bucket", labels, `le="+Inf"`, float64(histogram.count))
+	writeSample(builder, name+"_sum", labels, "", histogram.sum)
+	writeSample(builder, name+"_count", labels, "", float64(histogram.count))
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := &Metrics{}
+	handler := EndpointHandler{Endpoint: PetListResourceDispatcher{}, Name: "pets", Metrics: metrics}
+	dataStore = make(map[string]*PetObject)
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":"foo","name":"Foo"}`)),
+		httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":"bar","name":"Bar","Age":11}`)),
+		httptest.NewRequest(http.MethodGet, "/", nil),
+		httptest.NewRequest("PURGE-1", "/", nil),
+		httptest.NewRequest("PURGE-2", "/", nil),
+	}
+	for _, r := range requests {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Error("Wrong content type.")
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	expected := []string{
+		"# TYPE handlers_http_requests_total counter",
+		`handlers_http_requests_total{endpoint="pets",method="POST",code="2xx"} 1`,
+		`handlers_http_requests_total{endpoint="pets",method="POST",code="4xx"} 1`,
+		`handlers_http_requests_total{endpoint="pets",method="GET",code="2xx"} 1`,
+		"# TYPE handlers_http_request_duration_seconds histogram",
+		`handlers_http_request_duration_seconds_bucket{endpoint="pets",method="GET",code="2xx",le="+Inf"} 1`,
+		`handlers_http_request_duration_seconds_count{endpoint="pets",method="GET",code="2xx"} 1`,
+		`handlers_http_response_size_bytes_bucket{endpoint="pets",method="GET",code="2xx",le="100000"} 1`,
+		`handlers_http_requests_in_flight{endpoint="pets",method="GET"} 0`,
+		`handlers_http_request_errors_total{endpoint="pets",method="POST",kind="validation"} 1`,
+		`handlers_http_requests_total{endpoint="pets",method="other",code="4xx"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Error("Missing " + line + " in\n" + string(body))
+		}
+	}
+	if strings.Contains(string(body), "PURGE") {
+		t.Error("Unknown methods should not get series of their own.")
+	}
+	if strings.Contains(string(body), `kind="server"`) {
+		t.Error("Validation failures should not count as server errors.")
+	}
+}
+
+func TestMetricsServerErrors(t *testing.T) {
+	metrics := &Metrics{Namespace: "app"}
+	handler := metrics.Middleware(EndpointHandler{Endpoint: failingEndpoint{}, Name: "failing"})
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/", nil))
+
+	exposition := metrics.exposition()
+	if !strings.Contains(exposition, `app_http_request_errors_total{endpoint="failing",method="DELETE",kind="server"} 1`) ||
+		!strings.Contains(exposition, `app_http_requests_total{endpoint="failing",method="DELETE",code="5xx"} 1`) {
+		t.Error("Server errors should be counted.\n" + exposition)
+	}
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import "net/http"
+
+// Wraps a handler, for instance to authenticate, log or alter requests. A middleware
+// short circuits the request by writing a response and not calling next.
+//
+// Middleware can be attached at three levels. Wrap the server's handler with Chain
+// for global middleware, set EndpointHandler.Middleware for middleware around a whole
+// endpoint, including Endpoint.GetResource, and set MethodMiddleware on an
+// EndpointHandler or HTTPMethodDispatcher for middleware around a single method.
+// Global middleware runs first, then endpoint middleware, then method middleware.
+// Method middleware only runs for methods the resource or dispatcher supports.
+type Middleware func(next http.Handler) http.Handler
+
+// Wraps handler in middleware. The first middleware is the outermost, so it runs
+// first.
+func Chain(handler http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
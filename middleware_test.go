@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	calls := []string{}
+	endpoint := EndpointHandler{
+		Endpoint:   PetListResourceDispatcher{},
+		Middleware: []Middleware{recordingMiddleware("endpoint1", &calls), recordingMiddleware("endpoint2", &calls)},
+		MethodMiddleware: map[string][]Middleware{
+			http.MethodGet:  {recordingMiddleware("get", &calls)},
+			http.MethodPost: {recordingMiddleware("post", &calls)},
+		},
+	}
+	handler := Chain(endpoint, recordingMiddleware("global", &calls))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Join(calls, ",") != "global,endpoint1,endpoint2,get" {
+		t.Error("Wrong middleware order " + strings.Join(calls, ","))
+	}
+
+	calls = []string{}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/", nil))
+	if w.Code != http.StatusMethodNotAllowed || strings.Join(calls, ",") != "global,endpoint1,endpoint2" {
+		t.Error("Method middleware should not run for unsupported methods.")
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	deny := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+	}
+	dispatcher := HTTPMethodDispatcher{
+		GET:              testDispatcher.GET,
+		POST:             testDispatcher.GET,
+		MethodMiddleware: map[string][]Middleware{http.MethodPost: {deny}},
+	}
+	handler := HTTPMethodHandler{dispatcher: dispatcher}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, getRequest)
+	if w.Code != http.StatusOK || w.Body.String() != testMessage {
+		t.Error("GET should not be affected by POST middleware.")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, postRequest)
+	if w.Code != http.StatusForbidden || w.Body.Len() != 0 {
+		t.Error("Middleware should be able to short circuit the handler.")
+	}
+}
@@ -0,0 +1,755 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A change recorded in an outbox, to be relayed to sinks after the transaction that
+// recorded it commits. Messages are delivered at least once: consumers may receive a
+// message again, with the same ID, and should ignore it, see IdempotentConsumer.
+type OutboxMessage struct {
+	ID         string          `json:"id"`
+	Sequence   uint64          `json:"sequence"` // Assigned by the store, increasing.
+	Type       string          `json:"type"`
+	Collection string          `json:"collection"`
+	Key        string          `json:"key"`
+	Payload    json.RawMessage `json:"payload"`
+	Time       time.Time       `json:"time"`
+	Error      string          `json:"error,omitempty"` // Why the relay gave up, see MarkFailed.
+}
+
+// Stores outbox messages. Record is called with the context of the write that
+// produced the message, so a store in the same database as the repository records
+// the message in the write's transaction, see TxFromContext.
+type OutboxStore interface {
+	Record(ctx context.Context, message OutboxMessage) error
+	// Returns up to limit undelivered messages with a Sequence above after, in
+	// Sequence order. Failed messages are not pending.
+	Pending(ctx context.Context, after uint64, limit int) ([]OutboxMessage, error)
+	MarkDelivered(ctx context.Context, id string) error
+	// Records that the relay gave up delivering a message, for the reason given.
+	MarkFailed(ctx context.Context, id string, reason string) error
+}
+
+// Wraps a Repository to record a message in Outbox for every insert, update and
+// delete. The message is recorded with the context of the write, so that it is
+// committed or rolled back with it, and a failure to record it fails the write.
+// Messages are keyed by the object's primary key and carry its JSON, deletes carry a
+// null payload.
+type OutboxRepository struct {
+	Repository Repository
+	Outbox     OutboxStore
+	Collection string
+}
+
+func (repo *OutboxRepository) jsonPrimaryKey() string {
+	return jsonPrimaryKeyOf(repo.Repository)
+}
+
+func (repo *OutboxRepository) Get(ctx context.Context, id string, dest interface{}) error {
+	return repo.Repository.Get(ctx, id, dest)
+}
+
+func (repo *OutboxRepository) List(ctx context.Context, params ListParams, dest interface{}) error {
+	return repo.Repository.List(ctx, params, dest)
+}
+
+func (repo *OutboxRepository) Insert(ctx context.Context, obj interface{}) error {
+	err := repo.Repository.Insert(ctx, obj)
+	if err != nil {
+		return err
+	}
+	return repo.record(ctx, ChangeCreated, obj)
+}
+
+func (repo *OutboxRepository) Update(ctx context.Context, obj interface{}) error {
+	err := repo.Repository.Update(ctx, obj)
+	if err != nil {
+		return err
+	}
+	return repo.record(ctx, ChangeUpdated, obj)
+}
+
+func (repo *OutboxRepository) Delete(ctx context.Context, id string) error {
+	err := repo.Repository.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+	return repo.Outbox.Record(ctx, repo.message(ChangeDeleted, id, json.RawMessage("null")))
+}
+
+func (repo *OutboxRepository) record(ctx context.Context, messageType string, obj interface{}) error {
+	key, err := repositoryObjectID(repo.Repository, obj)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return repo.Outbox.Record(ctx, repo.message(messageType, key, payload))
+}
+
+func (repo *OutboxRepository) message(messageType string, key string, payload json.RawMessage) OutboxMessage {
+	return OutboxMessage{
+		ID:         NewUUIDv7(),
+		Type:       messageType,
+		Collection: repo.Collection,
+		Key:        key,
+		Payload:    payload,
+		Time:       time.Now(),
+	}
+}
+
+// An OutboxStore keeping messages in memory, for tests and for repositories without
+// transactions of their own such as FileRepository. It is also a Transactor: messages
+// recorded in its transactions are only stored when the transaction commits. Messages
+// are lost when the process exits.
+type MemoryOutboxStore struct {
+	mu       sync.Mutex
+	sequence uint64
+	messages []OutboxMessage
+	failed   []OutboxMessage
+}
+
+type memoryOutboxTx struct {
+	store    *MemoryOutboxStore
+	mu       sync.Mutex
+	messages []OutboxMessage
+	done     bool
+}
+
+func (store *MemoryOutboxStore) Begin(ctx context.Context) (Tx, error) {
+	return &memoryOutboxTx{store: store}, nil
+}
+
+func (tx *memoryOutboxTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	for _, message := range tx.messages {
+		tx.store.append(message)
+	}
+	return nil
+}
+
+func (tx *memoryOutboxTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	tx.messages = nil
+	return nil
+}
+
+func (store *MemoryOutboxStore) Record(ctx context.Context, message OutboxMessage) error {
+	tx, isOwnTx := TxFromContext(ctx).(*memoryOutboxTx)
+	if !isOwnTx || tx.store != store {
+		store.append(message)
+		return nil
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.messages = append(tx.messages, message)
+	return nil
+}
+
+func (store *MemoryOutboxStore) append(message OutboxMessage) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.sequence++
+	message.Sequence = store.sequence
+	store.messages = append(store.messages, message)
+}
+
+func (store *MemoryOutboxStore) Pending(ctx context.Context, after uint64, limit int) ([]OutboxMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	messages := make([]OutboxMessage, 0)
+	for _, message := range store.messages {
+		if limit > 0 && len(messages) == limit {
+			break
+		}
+		if message.Sequence > after {
+			messages = append(messages, message)
+		}
+	}
+	return messages, nil
+}
+
+func (store *MemoryOutboxStore) MarkDelivered(ctx context.Context, id string) error {
+	_, err := store.remove(id)
+	return err
+}
+
+func (store *MemoryOutboxStore) MarkFailed(ctx context.Context, id string, reason string) error {
+	message, err := store.remove(id)
+	if err != nil {
+		return err
+	}
+	message.Error = reason
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.failed = append(store.failed, message)
+	return nil
+}
+
+// Returns the messages the relay gave up delivering, oldest first.
+func (store *MemoryOutboxStore) Failed(ctx context.Context) ([]OutboxMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return append([]OutboxMessage(nil), store.failed...), nil
+}
+
+func (store *MemoryOutboxStore) remove(id string) (OutboxMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for i, message := range store.messages {
+		if message.ID == id {
+			store.messages = append(store.messages[:i:i], store.messages[i+1:]...)
+			return message, nil
+		}
+	}
+	return OutboxMessage{}, ErrNotFound
+}
+
+// An OutboxStore keeping messages in a table of the repository's database, so that
+// they are recorded in the transaction of the write when Begin is the repository's.
+// The table needs the columns
+//
+//	sequence   integer primary key, generated (AUTOINCREMENT, BIGSERIAL)
+//	id         text, unique
+//	type, collection, key, payload  text
+//	created    bigint, unix nanoseconds
+//	delivered  bigint, null until delivered
+//	failed     text, null unless the relay gave up delivering the message
+type SQLOutboxStore struct {
+	DB      *sql.DB
+	Table   string  // Defaults to "outbox".
+	Dialect Dialect // Defaults to SQLiteDialect.
+}
+
+func (store *SQLOutboxStore) dialect() Dialect {
+	if store.Dialect == nil {
+		return SQLiteDialect
+	}
+	return store.Dialect
+}
+
+func (store *SQLOutboxStore) table() string {
+	if store.Table == "" {
+		return store.dialect().Quote("outbox")
+	}
+	return store.dialect().Quote(store.Table)
+}
+
+func (store *SQLOutboxStore) querier(ctx context.Context) querier {
+	tx, isSQLTx := TxFromContext(ctx).(*sql.Tx)
+	if isSQLTx {
+		return tx
+	}
+	return store.DB
+}
+
+func (store *SQLOutboxStore) Record(ctx context.Context, message OutboxMessage) error {
+	dialect := store.dialect()
+	query := "INSERT INTO " + store.table() + " (" + dialect.Quote("id") + ", " + dialect.Quote("type") + ", " +
+		dialect.Quote("collection") + ", " + dialect.Quote("key") + ", " + dialect.Quote("payload") + ", " +
+		dialect.Quote("created") + ") VALUES (" + dialect.Placeholder(1) + ", " + dialect.Placeholder(2) + ", " +
+		dialect.Placeholder(3) + ", " + dialect.Placeholder(4) + ", " + dialect.Placeholder(5) + ", " +
+		dialect.Placeholder(6) + ")"
+	_, err := store.querier(ctx).ExecContext(ctx, query, message.ID, message.Type, message.Collection,
+		message.Key, string(message.Payload), message.Time.UnixNano())
+	return translateSQLError(err)
+}
+
+func (store *SQLOutboxStore) Pending(ctx context.Context, after uint64, limit int) ([]OutboxMessage, error) {
+	dialect := store.dialect()
+	return store.query(ctx, " WHERE "+dialect.Quote("delivered")+" IS NULL AND "+dialect.Quote("failed")+
+		" IS NULL AND "+dialect.Quote("sequence")+" > "+dialect.Placeholder(1), after, limit)
+}
+
+// Returns up to limit messages the relay gave up delivering, oldest first.
+func (store *SQLOutboxStore) Failed(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	return store.query(ctx, " WHERE "+store.dialect().Quote("failed")+" IS NOT NULL", nil, limit)
+}
+
+func (store *SQLOutboxStore) query(ctx context.Context, where string, after interface{}, limit int) ([]OutboxMessage, error) {
+	dialect := store.dialect()
+	args := make([]interface{}, 0, 2)
+	if after != nil {
+		args = append(args, after)
+	}
+	query := "SELECT " + dialect.Quote("sequence") + ", " + dialect.Quote("id") + ", " + dialect.Quote("type") + ", " +
+		dialect.Quote("collection") + ", " + dialect.Quote("key") + ", " + dialect.Quote("payload") + ", " +
+		dialect.Quote("created") + ", " + dialect.Quote("failed") + " FROM " + store.table() + where +
+		" ORDER BY " + dialect.Quote("sequence")
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT " + dialect.Placeholder(len(args))
+	}
+	rows, err := store.querier(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, translateSQLError(err)
+	}
+	defer rows.Close()
+
+	messages := make([]OutboxMessage, 0)
+	for rows.Next() {
+		var message OutboxMessage
+		var payload string
+		var created int64
+		var failed sql.NullString
+		err = rows.Scan(&message.Sequence, &message.ID, &message.Type, &message.Collection, &message.Key, &payload, &created, &failed)
+		if err != nil {
+			return nil, translateSQLError(err)
+		}
+		message.Payload = json.RawMessage(payload)
+		message.Time = time.Unix(0, created)
+		message.Error = failed.String
+		messages = append(messages, message)
+	}
+	return messages, translateSQLError(rows.Err())
+}
+
+func (store *SQLOutboxStore) MarkDelivered(ctx context.Context, id string) error {
+	return store.mark(ctx, id, "delivered", time.Now().UnixNano())
+}
+
+func (store *SQLOutboxStore) MarkFailed(ctx context.Context, id string, reason string) error {
+	return store.mark(ctx, id, "failed", reason)
+}
+
+func (store *SQLOutboxStore) mark(ctx context.Context, id string, column string, value interface{}) error {
+	dialect := store.dialect()
+	query := "UPDATE " + store.table() + " SET " + dialect.Quote(column) + " = " + dialect.Placeholder(1) +
+		" WHERE " + dialect.Quote("id") + " = " + dialect.Placeholder(2)
+	result, err := store.querier(ctx).ExecContext(ctx, query, value, id)
+	if err != nil {
+		return translateSQLError(err)
+	}
+	return requireRowsAffected(result)
+}
+
+// Receives the messages relayed from an outbox.
+type OutboxSink interface {
+	Deliver(ctx context.Context, message OutboxMessage) error
+}
+
+// Adapts a function to an OutboxSink.
+type OutboxSinkFunc func(ctx context.Context, message OutboxMessage) error
+
+func (fn OutboxSinkFunc) Deliver(ctx context.Context, message OutboxMessage) error {
+	return fn(ctx, message)
+}
+
+// Publishes the relayed messages of Collection to a ChangeBus, and so to its change
+// streams, WebSocket subscribers and webhooks. Payloads are decoded into objects made
+// by Creator, so that events are redacted for each subscriber by Fields and the
+// objects' field rules, and hidden from those the objects' RowAuthorizer denies.
+// Messages of other collections are ignored.
+type ChangeBusSink struct {
+	Changes    *ChangeBus
+	Collection string
+	Creator    Factory
+	Fields     *FieldPolicy
+}
+
+func (sink ChangeBusSink) Deliver(ctx context.Context, message OutboxMessage) error {
+	if message.Collection != sink.Collection {
+		return nil
+	}
+	var object interface{}
+	if len(message.Payload) > 0 && string(message.Payload) != "null" {
+		decoded := sink.Creator.Create()
+		err := json.Unmarshal(message.Payload, decoded)
+		if err != nil {
+			return err
+		}
+		object = decoded
+	}
+	sink.Changes.Publish(ChangeEvent{
+		Type:       message.Type,
+		Collection: message.Collection,
+		Key:        message.Key,
+		Object:     object,
+		Time:       message.Time,
+		fields:     sink.Fields,
+	})
+	return nil
+}
+
+// Relays the pending messages of an outbox to its sinks, marking them delivered once
+// every sink has accepted them. A message is delivered again if the process stops
+// before it is marked, or if one of the sinks fails, in which case it is retried with
+// exponential backoff. After MaxAttempts failed attempts the relay gives up on the
+// message and marks it failed, see OutboxStore.MarkFailed. Messages with the same
+// collection and key are delivered in the order they were recorded: later messages
+// wait while an earlier one is retried, and are delivered once it is delivered or
+// failed. Messages of other keys are not held up. Run a single relay per store.
+type OutboxRelay struct {
+	Store OutboxStore
+	Sinks []OutboxSink
+
+	Interval  time.Duration // Between polls of the store. Defaults to 1s.
+	BatchSize int           // Deliveries attempted per poll. Defaults to 100.
+
+	InitialBackoff time.Duration // Defaults to 1s, doubled after each failure.
+	MaxBackoff     time.Duration // Defaults to 1m.
+	MaxAttempts    int           // Defaults to 10.
+
+	Logger *slog.Logger // If set, logs failed deliveries.
+
+	mu       sync.Mutex
+	failures map[string]*outboxFailure
+}
+
+type outboxFailure struct {
+	attempts int
+	retryAt  time.Time
+}
+
+// Relays messages until ctx is done.
+func (relay *OutboxRelay) Run(ctx context.Context) error {
+	interval := relay.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := relay.RelayPending(ctx)
+		if err != nil && relay.Logger != nil {
+			relay.Logger.Error("outbox relay failed", slog.String("error", err.Error()))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Delivers a batch of pending messages and returns how many were delivered. Messages
+// waiting behind an earlier message of their key are skipped, and do not count
+// towards the batch.
+func (relay *OutboxRelay) RelayPending(ctx context.Context) (int, error) {
+	batchSize := relay.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	maxAttempts := relay.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+
+	delivered, attempted := 0, 0
+	blocked := make(map[string]bool)
+	var after uint64
+	for {
+		messages, err := relay.Store.Pending(ctx, after, batchSize)
+		if err != nil {
+			return delivered, err
+		}
+		for _, message := range messages {
+			after = message.Sequence
+			orderingKey := message.Collection + "\n" + message.Key
+			if blocked[orderingKey] || !relay.due(message.ID) {
+				blocked[orderingKey] = true
+				continue
+			}
+			if attempted == batchSize {
+				return delivered, nil
+			}
+			attempted++
+			err = relay.deliver(ctx, message)
+			if err == nil {
+				err = relay.Store.MarkDelivered(ctx, message.ID)
+				if err != nil {
+					return delivered, err
+				}
+				delivered++
+				continue
+			}
+			if relay.fail(message, err) < maxAttempts {
+				blocked[orderingKey] = true
+				continue
+			}
+			err = relay.Store.MarkFailed(ctx, message.ID, err.Error())
+			if err != nil {
+				return delivered, err
+			}
+			relay.forget(message.ID)
+			if relay.Logger != nil {
+				relay.Logger.Error("outbox delivery abandoned",
+					slog.String("message", message.ID),
+					slog.String("collection", message.Collection),
+					slog.String("key", message.Key))
+			}
+		}
+		if len(messages) < batchSize {
+			return delivered, nil
+		}
+	}
+}
+
+// Returns whether a message that failed before may be retried.
+func (relay *OutboxRelay) due(id string) bool {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	failure, failed := relay.failures[id]
+	return !failed || !time.Now().Before(failure.retryAt)
+}
+
+func (relay *OutboxRelay) deliver(ctx context.Context, message OutboxMessage) error {
+	for _, sink := range relay.Sinks {
+		err := sink.Deliver(ctx, message)
+		if err != nil {
+			return err
+		}
+	}
+	relay.forget(message.ID)
+	return nil
+}
+
+func (relay *OutboxRelay) forget(id string) {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	delete(relay.failures, id)
+}
+
+// Records a failed attempt and returns the number of attempts so far.
+func (relay *OutboxRelay) fail(message OutboxMessage, err error) int {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if relay.failures == nil {
+		relay.failures = make(map[string]*outboxFailure)
+	}
+	failure, failed := relay.failures[message.ID]
+	if !failed {
+		failure = &outboxFailure{}
+		relay.failures[message.ID] = failure
+	}
+	failure.attempts++
+
+	backoff := relay.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := relay.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	for i := 1; i < failure.attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	failure.retryAt = time.Now().Add(backoff)
+
+	if relay.Logger != nil {
+		relay.Logger.Warn("outbox delivery failed",
+			slog.String("message", message.ID),
+			slog.String("collection", message.Collection),
+			slog.String("key", message.Key),
+			slog.Int("attempt", failure.attempts),
+			slog.String("error", err.Error()))
+	}
+	return failure.attempts
+}
+
+// Records which messages a consumer has processed.
+type ProcessedStore interface {
+	Processed(ctx context.Context, id string) (bool, error)
+	MarkProcessed(ctx context.Context, id string) error
+}
+
+// A ProcessedStore remembering the IDs of the latest Size messages in memory.
+type MemoryProcessedStore struct {
+	Size int // Defaults to 10000.
+
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	order []string
+}
+
+func (store *MemoryProcessedStore) Processed(ctx context.Context, id string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, processed := store.ids[id]
+	return processed, nil
+}
+
+func (store *MemoryProcessedStore) MarkProcessed(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.ids == nil {
+		store.ids = make(map[string]struct{})
+	}
+	if _, processed := store.ids[id]; processed {
+		return nil
+	}
+	store.ids[id] = struct{}{}
+	store.order = append(store.order, id)
+	size := store.Size
+	if size <= 0 {
+		size = 10000
+	}
+	for len(store.order) > size {
+		delete(store.ids, store.order[0])
+		store.order = store.order[1:]
+	}
+	return nil
+}
+
+// A ProcessedStore that can record messages in the transaction of a context, such as
+// SQLProcessedStore.
+type TransactionalProcessedStore interface {
+	ProcessedStore
+	// Returns whether MarkProcessed records in the transaction of ctx.
+	InTransaction(ctx context.Context) bool
+}
+
+// A ProcessedStore keeping the IDs of processed messages in a SQL table. IDs are
+// recorded in the *sql.Tx of the context, if any, so that an IdempotentConsumer whose
+// Transactor uses the same database records messages in the handler's transaction.
+// The table needs a single column:
+//
+//	id  text, primary key
+type SQLProcessedStore struct {
+	DB      *sql.DB
+	Table   string  // Defaults to "processed_messages".
+	Dialect Dialect // Defaults to SQLiteDialect.
+}
+
+func (store *SQLProcessedStore) dialect() Dialect {
+	if store.Dialect == nil {
+		return SQLiteDialect
+	}
+	return store.Dialect
+}
+
+func (store *SQLProcessedStore) table() string {
+	if store.Table == "" {
+		return store.dialect().Quote("processed_messages")
+	}
+	return store.dialect().Quote(store.Table)
+}
+
+func (store *SQLProcessedStore) querier(ctx context.Context) querier {
+	tx, isSQLTx := TxFromContext(ctx).(*sql.Tx)
+	if isSQLTx {
+		return tx
+	}
+	return store.DB
+}
+
+func (store *SQLProcessedStore) InTransaction(ctx context.Context) bool {
+	_, isSQLTx := TxFromContext(ctx).(*sql.Tx)
+	return isSQLTx
+}
+
+func (store *SQLProcessedStore) Processed(ctx context.Context, id string) (bool, error) {
+	dialect := store.dialect()
+	query := "SELECT COUNT(*) FROM " + store.table() + " WHERE " + dialect.Quote("id") + " = " + dialect.Placeholder(1)
+	var count int
+	err := store.querier(ctx).QueryRowContext(ctx, query, id).Scan(&count)
+	return count > 0, translateSQLError(err)
+}
+
+// Returns an error wrapping ErrConflict if the message was already recorded.
+func (store *SQLProcessedStore) MarkProcessed(ctx context.Context, id string) error {
+	dialect := store.dialect()
+	query := "INSERT INTO " + store.table() + " (" + dialect.Quote("id") + ") VALUES (" + dialect.Placeholder(1) + ")"
+	_, err := store.querier(ctx).ExecContext(ctx, query, id)
+	return translateSQLError(err)
+}
+
+// An OutboxSink calling Handler once per message ID, so redelivered messages are
+// ignored. Messages are handled one at a time. If Transactor is set, Handler runs in a
+// transaction. When Processed records in that transaction, see
+// TransactionalProcessedStore, a message is either handled and recorded or neither.
+// Otherwise it is recorded after the transaction commits, and a message whose
+// recording fails, or is interrupted, is handled again when it is redelivered.
+type IdempotentConsumer struct {
+	Handler    func(ctx context.Context, message OutboxMessage) error
+	Processed  ProcessedStore // Defaults to a MemoryProcessedStore.
+	Transactor Transactor
+
+	mu sync.Mutex
+}
+
+var errNoHandler = errors.New("idempotent consumer has no handler")
+
+func (consumer *IdempotentConsumer) Deliver(ctx context.Context, message OutboxMessage) error {
+	if consumer.Handler == nil {
+		return errNoHandler
+	}
+	consumer.mu.Lock()
+	defer consumer.mu.Unlock()
+	if consumer.Processed == nil {
+		consumer.Processed = &MemoryProcessedStore{}
+	}
+
+	processed, err := consumer.Processed.Processed(ctx, message.ID)
+	if err != nil || processed {
+		return err
+	}
+	if consumer.Transactor == nil {
+		err = consumer.Handler(ctx, message)
+		if err != nil {
+			return err
+		}
+		return consumer.Processed.MarkProcessed(ctx, message.ID)
+	}
+
+	tx, err := consumer.Transactor.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	txCtx := ContextWithTx(ctx, tx)
+	err = consumer.Handler(txCtx, message)
+	if err != nil {
+		return err
+	}
+	transactional, isTransactional := consumer.Processed.(TransactionalProcessedStore)
+	if isTransactional && transactional.InTransaction(txCtx) {
+		err = consumer.Processed.MarkProcessed(txCtx, message.ID)
+		if errors.Is(err, ErrConflict) {
+			// Handled concurrently, by another process.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		committed = true
+		return tx.Commit()
+	}
+	committed = true
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	return consumer.Processed.MarkProcessed(ctx, message.ID)
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutboxRepository(t *testing.T) {
+	store := &MemoryOutboxStore{}
+	repo := &OutboxRepository{
+		Repository: &FileRepository{Path: filepath.Join(t.TempDir(), "pets")},
+		Outbox:     store,
+		Collection: "pets",
+	}
+
+	tx, _ := store.Begin(context.Background())
+	ctx := ContextWithTx(context.Background(), tx)
+	repo.Insert(ctx, &filePet{Name: "Rex"})
+	tx.Rollback()
+	if pending, _ := store.Pending(context.Background(), 0, 0); len(pending) != 0 {
+		t.Error("Messages of rolled back transactions should not be stored.")
+	}
+
+	tx, _ = store.Begin(context.Background())
+	ctx = ContextWithTx(context.Background(), tx)
+	fido := filePet{Name: "Fido"}
+	repo.Insert(ctx, &fido)
+	fido.Age = 4
+	repo.Update(ctx, &fido)
+	if pending, _ := store.Pending(context.Background(), 0, 0); len(pending) != 0 {
+		t.Error("Messages should not be stored before the transaction commits.")
+	}
+	tx.Commit()
+	repo.Delete(context.Background(), "2")
+
+	pending, _ := store.Pending(context.Background(), 0, 0)
+	if len(pending) != 3 {
+		t.Fatal("Every write should be recorded.", pending)
+	}
+	if pending[0].Type != ChangeCreated || pending[0].Key != "2" || pending[0].Collection != "pets" ||
+		pending[1].Type != ChangeUpdated || string(pending[1].Payload) != `{"id":2,"name":"Fido","age":4}` ||
+		pending[2].Type != ChangeDeleted || string(pending[2].Payload) != "null" {
+		t.Error("Wrong messages recorded.", pending)
+	}
+	if pending[0].Sequence >= pending[1].Sequence || pending[0].ID == pending[1].ID {
+		t.Error("Messages should have increasing sequences and unique IDs.")
+	}
+
+	if repo.Update(context.Background(), &filePet{ID: 9}) == nil {
+		t.Error("Failed writes should fail.")
+	}
+	if pending, _ := store.Pending(context.Background(), 0, 0); len(pending) != 3 {
+		t.Error("Failed writes should not be recorded.")
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	store := &MemoryOutboxStore{}
+	for _, key := range []string{"a", "b", "a"} {
+		payload := json.RawMessage(`{"id":"` + key + `","name":"Rex","notes":"bites"}`)
+		store.Record(context.Background(), OutboxMessage{ID: NewUUIDv7(), Type: ChangeUpdated, Collection: "pets", Key: key, Payload: payload})
+	}
+	store.Record(context.Background(), OutboxMessage{ID: NewUUIDv7(), Type: ChangeUpdated, Collection: "owners", Key: "c"})
+
+	delivered := make([]OutboxMessage, 0)
+	failing := true
+	bus := &ChangeBus{}
+	subscription := bus.Subscribe("pets", "")
+	relay := &OutboxRelay{
+		Store: store,
+		Sinks: []OutboxSink{
+			OutboxSinkFunc(func(ctx context.Context, message OutboxMessage) error {
+				if failing && message.Key == "a" {
+					return errors.New("unavailable")
+				}
+				delivered = append(delivered, message)
+				return nil
+			}),
+			ChangeBusSink{Changes: bus, Collection: "pets", Creator: &guardedPet{}},
+		},
+		InitialBackoff: 20 * time.Millisecond,
+	}
+
+	count, err := relay.RelayPending(context.Background())
+	if err != nil || count != 2 || delivered[0].Key != "b" {
+		t.Fatal("Messages of other keys should be delivered.", count, err)
+	}
+	event := <-subscription.Events()
+	if pet, ok := event.Object.(*guardedPet); event.Key != "b" || !ok || pet.Name != "Rex" {
+		t.Fatal("Messages should be published to the bus as objects.")
+	}
+	rendered, _ := event.render(context.Background())
+	if !strings.Contains(string(rendered), "Rex") || strings.Contains(string(rendered), "bites") {
+		t.Error("Published objects should be redacted.", string(rendered))
+	}
+
+	failing = false
+	if count, _ = relay.RelayPending(context.Background()); count != 0 {
+		t.Error("Failed messages should be retried after a backoff.")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if count, _ = relay.RelayPending(context.Background()); count != 2 {
+		t.Fatal("Failed messages should be retried.", count)
+	}
+	if delivered[2].Sequence != 1 || delivered[3].Sequence != 3 {
+		t.Error("Messages of a key should be delivered in order.")
+	}
+	if pending, _ := store.Pending(context.Background(), 0, 0); len(pending) != 0 {
+		t.Error("Delivered messages should be marked.")
+	}
+}
+
+func TestOutboxRelayFailures(t *testing.T) {
+	store := &MemoryOutboxStore{}
+	for _, key := range []string{"a", "a", "a", "b", "c"} {
+		store.Record(context.Background(), OutboxMessage{ID: NewUUIDv7(), Type: ChangeUpdated, Collection: "pets", Key: key})
+	}
+	pending, _ := store.Pending(context.Background(), 0, 0)
+	poisoned := pending[0].ID
+
+	delivered := make([]uint64, 0)
+	relay := &OutboxRelay{
+		Store: store,
+		Sinks: []OutboxSink{OutboxSinkFunc(func(ctx context.Context, message OutboxMessage) error {
+			if message.ID == poisoned {
+				return errors.New("unavailable")
+			}
+			delivered = append(delivered, message.Sequence)
+			return nil
+		})},
+		BatchSize:      2,
+		MaxAttempts:    2,
+		InitialBackoff: time.Nanosecond,
+	}
+
+	if count, _ := relay.RelayPending(context.Background()); count != 1 || delivered[0] != 4 {
+		t.Fatal("Messages of other keys should be delivered past a blocked key.", count, delivered)
+	}
+	if count, _ := relay.RelayPending(context.Background()); count != 1 || delivered[1] != 2 {
+		t.Fatal("Messages should be given up after MaxAttempts.", count, delivered)
+	}
+	if count, _ := relay.RelayPending(context.Background()); count != 2 || delivered[2] != 3 || delivered[3] != 5 {
+		t.Error("Later messages should be delivered in order.", count, delivered)
+	}
+
+	failed, _ := store.Failed(context.Background())
+	if len(failed) != 1 || failed[0].ID != poisoned || failed[0].Error != "unavailable" {
+		t.Error("Abandoned messages should be marked failed.", failed)
+	}
+	if pending, _ := store.Pending(context.Background(), 0, 0); len(pending) != 0 {
+		t.Error("Failed messages should not be pending.")
+	}
+}
+
+func TestIdempotentConsumer(t *testing.T) {
+	handled := 0
+	fail := true
+	transactor := &testTransactor{}
+	consumer := &IdempotentConsumer{
+		Transactor: transactor,
+		Handler: func(ctx context.Context, message OutboxMessage) error {
+			if TxFromContext(ctx) == nil {
+				t.Error("Handlers should run in a transaction.")
+			}
+			if fail {
+				return errors.New("failed")
+			}
+			handled++
+			return nil
+		},
+	}
+	message := OutboxMessage{ID: NewUUIDv7()}
+
+	if consumer.Deliver(context.Background(), message) == nil || !transactor.txs[0].rolledBack {
+		t.Error("Failed messages should be rolled back.")
+	}
+	fail = false
+	consumer.Deliver(context.Background(), message)
+	consumer.Deliver(context.Background(), message)
+	if handled != 1 || !transactor.txs[1].committed || len(transactor.txs) != 2 {
+		t.Error("Messages should be handled once.", handled)
+	}
+
+	transactor.commitErr = errors.New("commit failed")
+	message = OutboxMessage{ID: NewUUIDv7()}
+	if consumer.Deliver(context.Background(), message) == nil {
+		t.Error("Failed commits should fail the delivery.")
+	}
+	if seen, _ := consumer.Processed.Processed(context.Background(), message.ID); seen {
+		t.Error("Messages should only be recorded once their transaction commits.")
+	}
+
+	processed := &MemoryProcessedStore{Size: 1}
+	processed.MarkProcessed(context.Background(), "1")
+	processed.MarkProcessed(context.Background(), "2")
+	if seen, _ := processed.Processed(context.Background(), "1"); seen {
+		t.Error("Only the latest Size IDs should be remembered.")
+	}
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allows Requests per Period on average, with bursts of up to Burst requests. Burst
+// defaults to Requests.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+func (limit RateLimit) burst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return limit.Requests
+}
+
+// Holds rate limiter state, the theoretical arrival time of the next request per key.
+// Shared stores, for instance backed by Redis, let several processes enforce a
+// common limit.
+type RateLimitStore interface {
+	// Returns the stored time for key, or the zero time.
+	Get(ctx context.Context, key string) (time.Time, error)
+	// Stores new for key if the stored time is still old, reporting whether it did.
+	// The entry may be dropped after ttl.
+	CompareAndSwap(ctx context.Context, key string, old time.Time, new time.Time, ttl time.Duration) (bool, error)
+}
+
+// Limits requests with the generic cell rate algorithm. Requests are keyed by Key,
+// which defaults to the authenticated principal's subject, or else the client IP.
+// Keys are namespaced by endpoint, so a limiter or Store shared by several
+// EndpointHandlers limits each separately. Methods sets limits for individual
+// methods, others use Limit; a zero limit does not limit. Responses carry
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers and rejected
+// requests get a 429 with Retry-After.
+//
+// Set a RateLimiter on EndpointHandler to limit requests by principal once they are
+// authenticated, or use Middleware to limit any handler. EndpointHandler also counts
+// requests that fail to authenticate against their client IP, and refuses an IP over
+// its limit before checking its credentials, so they cannot be guessed without limit.
+type RateLimiter struct {
+	Limit   RateLimit
+	Methods map[string]RateLimit
+	Key     func(r *http.Request) string
+	Store   RateLimitStore // Defaults to an in-memory store.
+
+	// Trust X-Forwarded-For, for servers behind a proxy. The client IP is the
+	// rightmost address in the header that is not one of TrustedProxies, as clients
+	// can send the header with any addresses they like.
+	TrustForwardedFor bool
+	TrustedProxies    []*net.IPNet // Proxies in front of the one connecting, if any.
+
+	once  sync.Once
+	store RateLimitStore
+}
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+func (limiter *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter.allow(w, r, "") {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Checks the request against the limit, writing the rate limit headers and, if the
+// request is rejected, the 429 response. Keys are namespaced by endpoint, empty for
+// Middleware.
+func (limiter *RateLimiter) allow(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	return limiter.check(w, r, endpoint, limiter.key(r), true)
+}
+
+// Refuses the request if its client IP is over its limit, without counting it.
+func (limiter *RateLimiter) allowAddress(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	return limiter.check(w, r, endpoint, limiter.addressKey(r), false)
+}
+
+// Counts a request that failed to authenticate against its client IP.
+func (limiter *RateLimiter) countFailure(r *http.Request, endpoint string) {
+	limit, key := limiter.limitFor(r, endpoint, limiter.addressKey(r))
+	if limit.Requests > 0 && limit.Period > 0 {
+		limiter.take(r.Context(), key, limit, true)
+	}
+}
+
+// Returns the limit for the request and the key to count it under for client.
+func (limiter *RateLimiter) limitFor(r *http.Request, endpoint string, client string) (RateLimit, string) {
+	if limit, ok := limiter.Methods[r.Method]; ok {
+		return limit, endpoint + "\n" + r.Method + " " + client
+	}
+	return limiter.Limit, endpoint + "\n" + client
+}
+
+// Checks the request against the limit of client, counting it if count is set.
+func (limiter *RateLimiter) check(w http.ResponseWriter, r *http.Request, endpoint string, client string, count bool) bool {
+	limit, key := limiter.limitFor(r, endpoint, client)
+	if limit.Requests <= 0 || limit.Period <= 0 {
+		return true
+	}
+
+	result, err := limiter.take(r.Context(), key, limit, count)
+	if err != nil {
+		// Fail open, an unavailable store should not take the service down with it.
+		return true
+	}
+	if !count && result.allowed {
+		return true
+	}
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(result.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+	if !result.allowed {
+		recordError(r, errRateLimited)
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.retryAfter)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// Returns whether a request under key is allowed, counting it if count is set.
+func (limiter *RateLimiter) take(ctx context.Context, key string, limit RateLimit, count bool) (rateLimitResult, error) {
+	limiter.once.Do(func() {
+		limiter.store = limiter.Store
+		if limiter.store == nil {
+			limiter.store = &MemoryRateLimitStore{}
+		}
+	})
+
+	interval := limit.Period / time.Duration(limit.Requests)
+	burst := limit.burst()
+	tolerance := interval * time.Duration(burst)
+	for {
+		now := time.Now()
+		stored, err := limiter.store.Get(ctx, key)
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		arrival := stored
+		if arrival.Before(now) {
+			arrival = now
+		}
+		next := arrival.Add(interval)
+		allowAt := next.Add(-tolerance)
+		if now.Before(allowAt) {
+			return rateLimitResult{
+				limit:      burst,
+				reset:      arrival.Sub(now),
+				retryAfter: allowAt.Sub(now),
+			}, nil
+		}
+		if !count {
+			return rateLimitResult{allowed: true}, nil
+		}
+
+		swapped, err := limiter.store.CompareAndSwap(ctx, key, stored, next, next.Sub(now))
+		if err != nil {
+			return rateLimitResult{}, err
+		}
+		if swapped {
+			remaining := int((tolerance - next.Sub(now)) / interval)
+			return rateLimitResult{allowed: true, limit: burst, remaining: remaining, reset: next.Sub(now)}, nil
+		}
+	}
+}
+
+func (limiter *RateLimiter) key(r *http.Request) string {
+	if limiter.Key != nil {
+		return limiter.Key(r)
+	}
+	if principal := PrincipalFromContext(r.Context()); principal != nil && principal.Subject != "" {
+		return "principal:" + principal.Subject
+	}
+	return limiter.addressKey(r)
+}
+
+func (limiter *RateLimiter) addressKey(r *http.Request) string {
+	return "ip:" + limiter.clientIP(r)
+}
+
+func (limiter *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !limiter.TrustForwardedFor {
+		return host
+	}
+	// Each proxy appends the address it received the request from, so walk back
+	// from the proxy that connected to us until an address we do not trust.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !limiter.trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+func (limiter *RateLimiter) trustedProxy(ip net.IP) bool {
+	for _, network := range limiter.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
+
+// The default RateLimitStore, holding state in memory for a single process.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	entries map[string]rateLimitEntry
+	sweep   time.Time
+}
+
+type rateLimitEntry struct {
+	arrival time.Time
+	expires time.Time
+}
+
+func (store *MemoryRateLimitStore) Get(ctx context.Context, key string) (time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	entry, ok := store.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return time.Time{}, nil
+	}
+	return entry.arrival, nil
+}
+
+func (store *MemoryRateLimitStore) CompareAndSwap(ctx context.Context, key string, old time.Time, new time.Time, ttl time.Duration) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	if store.entries == nil {
+		store.entries = make(map[string]rateLimitEntry)
+	}
+	entry, ok := store.entries[key]
+	current := time.Time{}
+	if ok && now.Before(entry.expires) {
+		current = entry.arrival
+	}
+	if !current.Equal(old) {
+		return false, nil
+	}
+	store.entries[key] = rateLimitEntry{arrival: new, expires: now.Add(ttl)}
+
+	// Drop expired entries now and then so idle clients do not accumulate.
+	if now.After(store.sweep) {
+		for key, entry := range store.entries {
+			if now.After(entry.expires) {
+				delete(store.entries, key)
+			}
+		}
+		store.sweep = now.Add(time.Minute)
+	}
+	return true, nil
+}
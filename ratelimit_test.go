@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	handler := EndpointHandler{
+		Endpoint: PetListResourceDispatcher{},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{
+			"bob": {Subject: "bob"},
+			"jim": {Subject: "jim"},
+		}},
+		RateLimiter: &RateLimiter{
+			Limit:   RateLimit{Requests: 10, Period: time.Minute},
+			Methods: map[string]RateLimit{http.MethodPost: {Requests: 2, Period: time.Hour}},
+		},
+	}
+	request := func(method string, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(`{"id":"`+key+`"}`))
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request(http.MethodPost, "bob")
+	if w.Code != http.StatusCreated {
+		t.Fatal("First request should be allowed.")
+	}
+	if w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != "1" {
+		t.Error("Wrong rate limit headers " + w.Header().Get("RateLimit-Limit") + " " + w.Header().Get("RateLimit-Remaining"))
+	}
+	request(http.MethodPost, "bob")
+	w = request(http.MethodPost, "bob")
+	if w.Code != http.StatusTooManyRequests {
+		t.Error("Requests over the limit should give a 429.")
+	}
+	if w.Header().Get("Retry-After") != "1800" {
+		t.Error("Wrong Retry-After " + w.Header().Get("Retry-After"))
+	}
+
+	if w := request(http.MethodGet, "bob"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "10" {
+		t.Error("Methods should be limited separately.")
+	}
+	if w := request(http.MethodPost, "jim"); w.Code != http.StatusCreated {
+		t.Error("Principals should be limited separately.")
+	}
+}
+
+func TestRateLimiterFailedAuthentication(t *testing.T) {
+	handler := EndpointHandler{
+		Endpoint:      PetListResourceDispatcher{},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{"bob": {Subject: "bob"}}},
+		RateLimiter:   &RateLimiter{Limit: RateLimit{Requests: 3, Period: time.Minute}},
+	}
+	request := func(key string, remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-API-Key", key)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := request("guess", "1.1.1.1:1234"); code != http.StatusUnauthorized {
+			t.Fatal("Bad credentials should be rejected.", code)
+		}
+	}
+	if request("guess", "1.1.1.1:1234") != http.StatusTooManyRequests {
+		t.Error("Repeated bad credentials should be limited.")
+	}
+	if request("bob", "1.1.1.1:1234") != http.StatusTooManyRequests {
+		t.Error("An address over its limit should be refused before authenticating.")
+	}
+	if request("bob", "2.2.2.2:1234") != http.StatusOK {
+		t.Error("Other addresses should not be limited.")
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := &RateLimiter{Limit: RateLimit{Requests: 1, Period: time.Second}}
+	handler := limiter.Middleware(testDispatcher.GET)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Error("First request should be allowed.")
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-API-Key", "unverified")
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Error("Second request from the same IP should be limited, whatever its headers.")
+	}
+}
+
+func TestRateLimiterForwardedFor(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	limiter := &RateLimiter{Limit: RateLimit{Requests: 1, Period: time.Second}, TrustForwardedFor: true}
+	handler := limiter.Middleware(testDispatcher.GET)
+	request := func(forwardedFor string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	request("1.1.1.1, 10.0.0.1")
+	if request("9.9.9.9, 10.0.0.1") != http.StatusTooManyRequests {
+		t.Error("The address added by the proxy should be used, not one sent by the client.")
+	}
+	limiter.TrustedProxies = []*net.IPNet{proxies}
+	if request("2.2.2.2, 10.0.0.2") != http.StatusOK || request("3.3.3.3, 10.0.0.2") != http.StatusOK {
+		t.Error("Trusted proxies should be skipped.")
+	}
+	if request("4.4.4.4, 2.2.2.2, 10.0.0.2") != http.StatusTooManyRequests {
+		t.Error("Addresses before an untrusted hop should not be used.")
+	}
+}
+
+func TestRateLimiterEndpoints(t *testing.T) {
+	limiter := &RateLimiter{Limit: RateLimit{Requests: 1, Period: time.Minute}}
+	request := func(name string) int {
+		handler := EndpointHandler{Endpoint: PetListResourceDispatcher{}, Name: name, RateLimiter: limiter}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		return w.Code
+	}
+
+	if request("pets") != http.StatusOK || request("owners") != http.StatusOK {
+		t.Error("Endpoints should be limited separately.")
+	}
+	if request("pets") != http.StatusTooManyRequests {
+		t.Error("Requests to the same endpoint should be limited.")
+	}
+}
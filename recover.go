@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recovers from panics in the handlers it wraps, answering with a 500
+// application/problem+json response instead of dropping the connection. Use
+// Middleware around an EndpointHandler or HTTPMethodHandler, or add it to
+// EndpointHandler.Middleware.
+//
+// If the response headers were already sent when the panic happened the response
+// cannot be replaced, so the request is aborted with http.ErrAbortHandler rather than
+// leaving the client with a truncated body that looks complete.
+type Recoverer struct {
+	Logger *slog.Logger // Logs the panic and stack. Defaults to slog.Default().
+
+	// Called with every recovered panic, for instance to send it to an error reporting
+	// service.
+	Report func(r *http.Request, recovered interface{}, stack []byte)
+}
+
+// The error recorded for a request that panicked.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
+func (recoverer *Recoverer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// Deliberate aborts are not errors, let net/http handle them.
+				panic(recovered)
+			}
+			stack := debug.Stack()
+			recoverer.handle(r, recovered, stack)
+			if recorder.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(w, r, http.StatusInternalServerError, "")
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+func (recoverer *Recoverer) handle(r *http.Request, recovered interface{}, stack []byte) {
+	recordError(r, &PanicError{Value: recovered, Stack: stack})
+	logger := recoverer.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("panic", fmt.Sprint(recovered)),
+		slog.String("stack", string(stack)),
+	}
+	requestID := requestIDOf(r)
+	if requestID != "" {
+		attrs = append(attrs, slog.String("request_id", requestID))
+	}
+	logger.LogAttrs(r.Context(), slog.LevelError, "panic serving request", attrs...)
+	if recoverer.Report != nil {
+		recoverer.Report(r, recovered, stack)
+	}
+}
+
+// An RFC 9457 problem details response body.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	data, _ := json.Marshal(problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		RequestID: requestIDOf(r),
+	})
+	header := w.Header()
+	for _, name := range []string{"Content-Encoding", "Content-Length", "ETag", "Last-Modified"} {
+		header.Del(name)
+	}
+	header.Set("Content-Type", "application/problem+json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type panickingResource struct {
+	resource
+}
+
+func (resource panickingResource) Read() ([]byte, error) {
+	var pet *PetObject
+	return []byte(pet.Name), nil
+}
+
+type panickingEndpoint struct{}
+
+func (endpoint panickingEndpoint) GetResource(r *http.Request) Resource {
+	return panickingResource{}
+}
+
+func TestRecoverer(t *testing.T) {
+	var output bytes.Buffer
+	var reported interface{}
+	recoverer := &Recoverer{
+		Logger: slog.New(slog.NewJSONHandler(&output, nil)),
+		Report: func(r *http.Request, recovered interface{}, stack []byte) {
+			reported = recovered
+		},
+	}
+	handler := Chain(EndpointHandler{Endpoint: panickingEndpoint{}}, (&RequestID{}).Middleware, recoverer.Middleware)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatal("A panic should produce a 500 problem response.")
+	}
+	var body problem
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Status != http.StatusInternalServerError || body.Title != "Internal Server Error" || body.RequestID != "abc" {
+		t.Error("Wrong problem body " + w.Body.String())
+	}
+	if reported == nil {
+		t.Error("The panic should be reported.")
+	}
+	if !strings.Contains(output.String(), `"request_id":"abc"`) || !strings.Contains(output.String(), "panickingResource.Read") {
+		t.Error("The panic should be logged with its stack and request ID " + output.String())
+	}
+}
+
+func TestRecovererHeadersSent(t *testing.T) {
+	recoverer := &Recoverer{Logger: slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))}
+	handler := recoverer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("failed")
+	}))
+
+	defer func() {
+		if recover() != http.ErrAbortHandler {
+			t.Error("A panic after the headers were sent should abort the response.")
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -0,0 +1,520 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Returned by a Repository when the requested object does not exist. Handlers
+	// respond with a 404.
+	ErrNotFound = errors.New("not found")
+
+	// Returned by a Repository when a write conflicts with an existing object, for
+	// instance a duplicate primary key. Handlers respond with a 409.
+	ErrConflict = errors.New("conflict")
+)
+
+// Stores the objects of a single collection. Objects are pointers to structs, dest
+// arguments are pointers to a struct for Get and pointers to a slice of structs
+// (or struct pointers) for List.
+type Repository interface {
+	Get(ctx context.Context, id string, dest interface{}) error
+	List(ctx context.Context, params ListParams, dest interface{}) error
+	Insert(ctx context.Context, obj interface{}) error
+	Update(ctx context.Context, obj interface{}) error
+	Delete(ctx context.Context, id string) error
+}
+
+// A comparison used to filter a list.
+type FilterOp string
+
+const (
+	OpEq   FilterOp = "eq"
+	OpNe   FilterOp = "ne"
+	OpLt   FilterOp = "lt"
+	OpLte  FilterOp = "lte"
+	OpGt   FilterOp = "gt"
+	OpGte  FilterOp = "gte"
+	OpLike FilterOp = "like"
+	OpIn   FilterOp = "in"
+)
+
+// Restricts a list to objects whose Field compares to Value using Op. Values for
+// OpIn are comma separated.
+type Filter struct {
+	Field string
+	Op    FilterOp
+	Value string
+}
+
+// Orders a list by Field.
+type Sort struct {
+	Field      string
+	Descending bool
+}
+
+// Filtering, ordering and pagination for Repository.List. A zero Limit means no limit.
+type ListParams struct {
+	Filters []Filter
+	Sort    []Sort
+	Limit   int
+	Offset  int
+}
+
+// Parses list parameters from a query string. "limit" and "offset" paginate, "sort"
+// is a comma separated list of fields where a leading "-" sorts descending and every
+// other key is a filter, either "field=value" or "field[op]=value". Errors are
+// returned as FieldErrors keyed by the offending parameter.
+func ParseListParams(query url.Values) (ListParams, error) {
+	params := ListParams{}
+	fieldErrs := NewFieldErrors()
+	hasErrs := false
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		values := query[key]
+		if len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		switch key {
+		case "limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil || limit < 0 {
+				fieldErrs.Add(key, "must be a non-negative integer")
+				hasErrs = true
+			}
+			params.Limit = limit
+		case "offset":
+			offset, err := strconv.Atoi(value)
+			if err != nil || offset < 0 {
+				fieldErrs.Add(key, "must be a non-negative integer")
+				hasErrs = true
+			}
+			params.Offset = offset
+		case "sort":
+			for _, field := range strings.Split(value, ",") {
+				field = strings.TrimSpace(field)
+				if field == "" {
+					continue
+				}
+				order := Sort{Field: field}
+				if strings.HasPrefix(field, "-") {
+					order = Sort{Field: field[1:], Descending: true}
+				}
+				params.Sort = append(params.Sort, order)
+			}
+		default:
+			field, op := key, OpEq
+			if open := strings.Index(key, "["); open > 0 && strings.HasSuffix(key, "]") {
+				field, op = key[:open], FilterOp(key[open+1:len(key)-1])
+			}
+			if !op.valid() {
+				fieldErrs.Add(key, "unknown filter operator")
+				hasErrs = true
+				continue
+			}
+			for _, value := range values {
+				params.Filters = append(params.Filters, Filter{Field: field, Op: op, Value: value})
+			}
+		}
+	}
+
+	if hasErrs {
+		return params, fieldErrs
+	}
+	return params, nil
+}
+
+func (op FilterOp) valid() bool {
+	switch op {
+	case OpEq, OpNe, OpLt, OpLte, OpGt, OpGte, OpLike, OpIn:
+		return true
+	}
+	return false
+}
+
+// Applies params to items in memory, for repositories that cannot filter on the
+// storage side. items hold structs described by mapping.
+func applyListParams(items []reflect.Value, mapping *tableMapping, params ListParams) ([]reflect.Value, error) {
+	fieldErrs := NewFieldErrors()
+	hasErrs := false
+	type condition struct {
+		col  *column
+		op   FilterOp
+		args []interface{}
+		like *regexp.Regexp
+	}
+	conditions := make([]condition, 0, len(params.Filters))
+	for _, filter := range params.Filters {
+		col := mapping.fields[filter.Field]
+		if col == nil {
+			fieldErrs.Add(filter.Field, "unknown field")
+			hasErrs = true
+			continue
+		}
+		cond := condition{col: col, op: filter.Op}
+		switch filter.Op {
+		case OpLike:
+			cond.like = likePattern(filter.Value)
+		case OpIn:
+			for _, part := range strings.Split(filter.Value, ",") {
+				arg, err := col.parse(part)
+				if err != nil {
+					fieldErrs.Add(filter.Field, "invalid value")
+					hasErrs = true
+				}
+				cond.args = append(cond.args, arg)
+			}
+		default:
+			if !filter.Op.valid() {
+				fieldErrs.Add(filter.Field, "unknown filter operator")
+				hasErrs = true
+				continue
+			}
+			arg, err := col.parse(filter.Value)
+			if err != nil {
+				fieldErrs.Add(filter.Field, "invalid value")
+				hasErrs = true
+			}
+			cond.args = []interface{}{arg}
+		}
+		conditions = append(conditions, cond)
+	}
+	orders := make([]*column, len(params.Sort))
+	for i, order := range params.Sort {
+		orders[i] = mapping.fields[order.Field]
+		if orders[i] == nil {
+			fieldErrs.Add("sort", "unknown field "+order.Field)
+			hasErrs = true
+		}
+	}
+	if hasErrs {
+		return nil, fieldErrs
+	}
+
+	result := make([]reflect.Value, 0, len(items))
+	for _, item := range items {
+		matches := true
+		for _, cond := range conditions {
+			value, ok := comparableValue(item.FieldByIndex(cond.col.index))
+			if !ok {
+				matches = false
+				break
+			}
+			switch cond.op {
+			case OpLike:
+				matches = cond.like.MatchString(fmt.Sprint(value))
+			case OpIn:
+				matches = false
+				for _, arg := range cond.args {
+					if compareValues(value, arg) == 0 {
+						matches = true
+					}
+				}
+			default:
+				comparison := compareValues(value, cond.args[0])
+				matches = (cond.op == OpEq && comparison == 0) || (cond.op == OpNe && comparison != 0) ||
+					(cond.op == OpLt && comparison < 0) || (cond.op == OpLte && comparison <= 0) ||
+					(cond.op == OpGt && comparison > 0) || (cond.op == OpGte && comparison >= 0)
+			}
+			if !matches {
+				break
+			}
+		}
+		if matches {
+			result = append(result, item)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		for k, col := range orders {
+			a, _ := comparableValue(result[i].FieldByIndex(col.index))
+			b, _ := comparableValue(result[j].FieldByIndex(col.index))
+			comparison := compareValues(a, b)
+			if comparison == 0 {
+				continue
+			}
+			if params.Sort[k].Descending {
+				return comparison > 0
+			}
+			return comparison < 0
+		}
+		return false
+	})
+
+	if params.Offset > 0 {
+		if params.Offset >= len(result) {
+			return result[:0], nil
+		}
+		result = result[params.Offset:]
+	}
+	if params.Limit > 0 && params.Limit < len(result) {
+		result = result[:params.Limit]
+	}
+	return result, nil
+}
+
+// Returns field as one of the types produced by column.parse. Nil pointers are not
+// comparable.
+func comparableValue(field reflect.Value) (interface{}, bool) {
+	for field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			return nil, false
+		}
+		field = field.Elem()
+	}
+	if t, ok := field.Interface().(time.Time); ok {
+		return t, true
+	}
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return field.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return field.Uint(), true
+	case reflect.Float32, reflect.Float64:
+		return field.Float(), true
+	case reflect.Bool:
+		return field.Bool(), true
+	case reflect.String:
+		return field.String(), true
+	}
+	return fmt.Sprint(field.Interface()), true
+}
+
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case int64:
+		b, _ := b.(int64)
+		if a == b {
+			return 0
+		} else if a < b {
+			return -1
+		}
+		return 1
+	case uint64:
+		b, _ := b.(uint64)
+		if a == b {
+			return 0
+		} else if a < b {
+			return -1
+		}
+		return 1
+	case float64:
+		b, _ := b.(float64)
+		if a == b {
+			return 0
+		} else if a < b {
+			return -1
+		}
+		return 1
+	case string:
+		b, _ := b.(string)
+		return strings.Compare(a, b)
+	case bool:
+		b, _ := b.(bool)
+		if a == b {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case time.Time:
+		b, _ := b.(time.Time)
+		return a.Compare(b)
+	}
+	return 0
+}
+
+// Converts a SQL LIKE pattern into a case insensitive regular expression.
+func likePattern(pattern string) *regexp.Regexp {
+	var expression strings.Builder
+	expression.WriteString("(?is)^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expression.WriteString(".*")
+		case '_':
+			expression.WriteString(".")
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expression.WriteString("$")
+	return regexp.MustCompile(expression.String())
+}
+
+// Adapts an object stored in a Repository to a ResourceObject so it can back a
+// JSONResource or be created by a JSONListResource through RepositoryFactory. Save
+// inserts the object the first time and updates it afterwards, Delete removes it.
+// The wrapped Object is validated and reset if it implements Validatable or has a
+// Reset method. Its primary key cannot be changed once stored: saving it with another
+// key fails rather than overwriting the object with that key.
+type RepositoryObject struct {
+	Repository Repository
+	Object     interface{}
+	stored     bool
+	id         string // The primary key the object is stored under.
+}
+
+var errPrimaryKeyChanged = NewStatusError(http.StatusBadRequest, "the primary key cannot be changed")
+
+// Wraps obj, which was loaded from repo, so that saving it updates the stored copy.
+func NewRepositoryObject(repo Repository, obj interface{}) *RepositoryObject {
+	id, _ := repositoryObjectID(repo, obj)
+	return &RepositoryObject{Repository: repo, Object: obj, stored: true, id: id}
+}
+
+func (obj *RepositoryObject) MarshalJSON() ([]byte, error) {
+	return json.Marshal(obj.Object)
+}
+
+func (obj *RepositoryObject) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, obj.Object)
+}
+
+func (obj *RepositoryObject) Copy() interface{} {
+	duplicate, err := copyObject(obj.Object)
+	if err != nil {
+		duplicate = obj.Object
+	}
+	return &RepositoryObject{Repository: obj.Repository, Object: duplicate, stored: obj.stored, id: obj.id}
+}
+
+func (obj *RepositoryObject) Validate() FieldErrors {
+	validatable, ok := obj.Object.(Validatable)
+	if !ok {
+		return nil
+	}
+	return validatable.Validate()
+}
+
+func (obj *RepositoryObject) Save() error {
+	return obj.SaveContext(context.Background())
+}
+
+func (obj *RepositoryObject) SaveContext(ctx context.Context) error {
+	if obj.stored {
+		id, err := repositoryObjectID(obj.Repository, obj.Object)
+		if err == nil && obj.id != "" && id != obj.id {
+			return errPrimaryKeyChanged
+		}
+		return obj.Repository.Update(ctx, obj.Object)
+	}
+	err := obj.Repository.Insert(ctx, obj.Object)
+	if err == nil {
+		obj.stored = true
+		obj.id, _ = repositoryObjectID(obj.Repository, obj.Object)
+	}
+	return err
+}
+
+func (obj *RepositoryObject) Delete() error {
+	return obj.DeleteContext(context.Background())
+}
+
+func (obj *RepositoryObject) DeleteContext(ctx context.Context) error {
+	id, err := repositoryObjectID(obj.Repository, obj.Object)
+	if err != nil {
+		return err
+	}
+	return obj.Repository.Delete(ctx, id)
+}
+
+// Resets the object for a full update. The primary key is kept, also by objects with a
+// Reset method of their own, so the update is applied to the same stored object.
+func (obj *RepositoryObject) Reset() {
+	restore := obj.keepPrimaryKey()
+	if resettable, ok := obj.Object.(interface{ Reset() }); ok {
+		resettable.Reset()
+	} else if value, _, err := structValue(obj.Object); err == nil {
+		value.Set(reflect.Zero(value.Type()))
+	}
+	restore()
+}
+
+// Returns a function setting the object's primary key back to its current value.
+func (obj *RepositoryObject) keepPrimaryKey() func() {
+	if key := jsonPrimaryKeyOf(obj.Repository); key != "" {
+		data, err := json.Marshal(obj.Object)
+		var fields map[string]json.RawMessage
+		if err != nil || json.Unmarshal(data, &fields) != nil || fields[key] == nil {
+			return func() {}
+		}
+		pk, err := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		if err != nil {
+			return func() {}
+		}
+		return func() { json.Unmarshal(pk, obj.Object) }
+	}
+	value, mapping, err := structValue(obj.Object)
+	if err != nil {
+		return func() {}
+	}
+	pk := reflect.New(mapping.pk.typ).Elem()
+	pk.Set(value.FieldByIndex(mapping.pk.index))
+	return func() { value.FieldByIndex(mapping.pk.index).Set(pk) }
+}
+
+// A Factory creating new objects that are inserted into Repository when saved. New
+// returns a pointer to an empty object.
+type RepositoryFactory struct {
+	Repository Repository
+	New        func() interface{}
+}
+
+func (factory *RepositoryFactory) Create() SafeSavable {
+	return &RepositoryObject{Repository: factory.Repository, Object: factory.New()}
+}
+
+// Implemented by repositories identifying objects by a JSON field rather than their
+// primary key column, such as FileRepository. An empty name means the column.
+type jsonKeyedRepository interface {
+	jsonPrimaryKey() string
+}
+
+func jsonPrimaryKeyOf(repo Repository) string {
+	keyed, isKeyed := repo.(jsonKeyedRepository)
+	if !isKeyed {
+		return ""
+	}
+	return keyed.jsonPrimaryKey()
+}
+
+// Returns the key obj is stored under in repo.
+func repositoryObjectID(repo Repository, obj interface{}) (string, error) {
+	if key := jsonPrimaryKeyOf(repo); key != "" {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return "", err
+		}
+		return jsonFieldID(data, key)
+	}
+	return objectID(obj)
+}
+
+// Returns the primary key of a struct pointer as a string.
+func objectID(obj interface{}) (string, error) {
+	value, mapping, err := structValue(obj)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(value.FieldByIndex(mapping.pk.index).Interface()), nil
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseListParams(t *testing.T) {
+	query, _ := url.ParseQuery("name=Bob&age[gte]=30&sort=-age,name&limit=10&offset=20")
+	params, err := ParseListParams(query)
+	if err != nil {
+		t.Fatal("Valid query should parse, got " + err.Error())
+	}
+	if params.Limit != 10 || params.Offset != 20 {
+		t.Error("Limit and offset not parsed.")
+	}
+	if len(params.Sort) != 2 || params.Sort[0] != (Sort{Field: "age", Descending: true}) || params.Sort[1] != (Sort{Field: "name"}) {
+		t.Error("Sort not parsed.")
+	}
+	if len(params.Filters) != 2 {
+		t.Fatal("Filters not parsed.")
+	}
+	if params.Filters[0] != (Filter{Field: "age", Op: OpGte, Value: "30"}) {
+		t.Error("Filter with operator not parsed.")
+	}
+	if params.Filters[1] != (Filter{Field: "name", Op: OpEq, Value: "Bob"}) {
+		t.Error("Filter without operator should default to eq.")
+	}
+
+	query, _ = url.ParseQuery("limit=-1&age[between]=1")
+	_, err = ParseListParams(query)
+	fieldErrs, ok := err.(FieldErrors)
+	if !ok {
+		t.Fatal("Invalid query should return FieldErrors.")
+	}
+	if fieldErrs.Error() != `{"age[between]":"unknown filter operator","limit":"must be a non-negative integer"}` {
+		t.Error("Wrong errors returned " + fieldErrs.Error())
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+// Gives every request an ID, taken from the request's header if the client sent a
+// usable one and generated otherwise. The ID is stored in the request context, see
+// RequestIDFromContext, echoed in the response header, logged by AccessLogger and
+// Recoverer and included in the error bodies written by the method handlers, so a
+// failed request can be found in the logs. Use it as the outermost middleware.
+type RequestID struct {
+	Header   string        // Defaults to X-Request-ID.
+	Generate func() string // Defaults to NewUUIDv7.
+
+	// Always generate a new ID, ignoring the one sent by the client.
+	IgnoreIncoming bool
+}
+
+type requestIDContextKey struct{}
+
+// Returns the ID of the request, or "" if it has none.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+func (requestID *RequestID) Middleware(next http.Handler) http.Handler {
+	header := requestID.Header
+	if header == "" {
+		header = "X-Request-ID"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if requestID.IgnoreIncoming || !validRequestID(id) {
+			id = requestID.generate()
+		}
+		w.Header().Set(header, id)
+		r, info := withRequestInfo(r)
+		info.requestID = id
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+func (requestID *RequestID) generate() string {
+	if requestID.Generate != nil {
+		return requestID.Generate()
+	}
+	return NewUUIDv7()
+}
+
+// Returns the ID of the request, also when the RequestID middleware wraps the handler
+// asking, and so has not put it in r's context.
+func requestIDOf(r *http.Request) string {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		return id
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return info.requestID
+	}
+	return ""
+}
+
+// Accepts IDs that are safe to log and echo: up to 128 printable characters without
+// spaces or quotes.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a new RFC 9562 version 7 UUID: a millisecond timestamp followed by random
+// bits, so IDs sort by the time they were created.
+func NewUUIDv7() string {
+	var uuid [16]byte
+	rand.Read(uuid[6:])
+	millis := uint64(time.Now().UnixMilli())
+	for i := 0; i < 6; i++ {
+		uuid[i] = byte(millis >> (40 - 8*i))
+	}
+	uuid[6] = uuid[6]&0x0f | 0x70
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	encoded := hex.EncodeToString(uuid[:])
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:32]
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var uuidV7Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewUUIDv7(t *testing.T) {
+	first := NewUUIDv7()
+	second := NewUUIDv7()
+	if !uuidV7Pattern.MatchString(first) || first == second {
+		t.Error("Should generate version 7 UUIDs " + first)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := (&RequestID{}).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !uuidV7Pattern.MatchString(seen) || w.Header().Get("X-Request-ID") != seen {
+		t.Error("Should generate an ID and echo it.")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "client-id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if seen != "client-id" || w.Header().Get("X-Request-ID") != "client-id" {
+		t.Error("Should keep the client's ID.")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "bad id\"")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if seen == "bad id\"" {
+		t.Error("Should replace unsafe IDs.")
+	}
+}
+
+func TestRequestIDInErrorBodies(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	handler := Chain(EndpointHandler{Endpoint: PetListResourceDispatcher{}}, (&RequestID{}).Middleware)
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"id":"old","Age":11}`))
+	r.Header.Set("X-Request-ID", "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusBadRequest || body["request_id"] != "abc" || body["age"] != "Too old" {
+		t.Error("Field errors should include the request ID " + w.Body.String())
+	}
+
+	errorHandler := Chain(EndpointHandler{Endpoint: failingEndpoint{}}, (&RequestID{}).Middleware)
+	r = httptest.NewRequest(http.MethodDelete, "/", nil)
+	r.Header.Set("X-Request-ID", "def")
+	w = httptest.NewRecorder()
+	errorHandler.ServeHTTP(w, r)
+	if !strings.HasSuffix(w.Body.String(), "request ID: def") {
+		t.Error("Plain text errors should include the request ID " + w.Body.String())
+	}
+}
+
+type missingEndpoint struct{}
+
+func (endpoint missingEndpoint) GetResource(r *http.Request) Resource {
+	return missingReadable{}
+}
+
+type unavailableTransactor struct{}
+
+func (transactor unavailableTransactor) Begin(ctx context.Context) (Tx, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func TestRequestIDInDispatcherErrors(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	handlers := map[string]EndpointHandler{
+		"read":      {Endpoint: missingEndpoint{}},
+		"forbidden": {Endpoint: PetListResourceDispatcher{}, Authorizer: RolePolicy{}},
+		"hidden":    {Endpoint: PetListResourceDispatcher{}, Authorizer: RolePolicy{}, HideForbidden: true},
+		"begin":     {Endpoint: PetListResourceDispatcher{}, Transactor: unavailableTransactor{}},
+	}
+	expected := map[string]int{
+		"read":      http.StatusNotFound,
+		"forbidden": http.StatusForbidden,
+		"hidden":    http.StatusNotFound,
+		"begin":     http.StatusInternalServerError,
+	}
+	for name, endpointHandler := range handlers {
+		method := http.MethodGet
+		if name == "begin" {
+			method = http.MethodPost
+		}
+		r := httptest.NewRequest(method, "/", strings.NewReader(`{"id":"foo","name":"Foo"}`))
+		r.Header.Set("X-Request-ID", name)
+		w := httptest.NewRecorder()
+		Chain(endpointHandler, (&RequestID{}).Middleware).ServeHTTP(w, r)
+		if w.Code != expected[name] || !strings.HasSuffix(w.Body.String(), "request ID: "+name) {
+			t.Error("Errors should include the request ID", name, w.Code, w.Body.String())
+		}
+	}
+}
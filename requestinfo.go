@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+)
+
+// What the handlers learned about a request, filled in as it is served so that
+// middleware such as AccessLogger can report it afterwards.
+type requestInfo struct {
+	endpoint  string
+	resource  string
+	principal *Principal
+	requestID string
+	err       error
+}
+
+type requestInfoContextKey struct{}
+
+// Returns r with a requestInfo in its context, reusing one added by an outer
+// middleware.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := requestInfoFrom(r.Context())
+	if info != nil {
+		return r, info
+	}
+	info = &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoContextKey{}, info)), info
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return info
+}
+
+// Records the error behind an error response. The first error recorded wins.
+func recordError(r *http.Request, err error) {
+	info := requestInfoFrom(r.Context())
+	if info != nil && info.err == nil {
+		info.err = err
+	}
+}
@@ -0,0 +1,586 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Describes the SQL flavour spoken by a database.
+type Dialect interface {
+	// Returns the placeholder for the nth (1 based) query argument.
+	Placeholder(n int) string
+	// Quotes an identifier such as a table or column name.
+	Quote(identifier string) string
+	// Whether a generated primary key is read back with RETURNING rather than
+	// sql.Result.LastInsertId.
+	Returning() bool
+}
+
+var (
+	// The dialect for SQLite, usable with any database/sql SQLite driver.
+	SQLiteDialect Dialect = sqliteDialect{}
+	// The dialect for PostgreSQL.
+	PostgresDialect Dialect = postgresDialect{}
+)
+
+type sqliteDialect struct{}
+
+func (dialect sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (dialect sqliteDialect) Quote(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+func (dialect sqliteDialect) Returning() bool {
+	return false
+}
+
+type postgresDialect struct{}
+
+func (dialect postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (dialect postgresDialect) Quote(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+func (dialect postgresDialect) Returning() bool {
+	return true
+}
+
+// A Repository storing objects as rows of Table. Struct fields are mapped to columns
+// with the `db` struct tag, e.g. `db:"id,pk"`. The "pk" option marks the primary key,
+// which defaults to a column named "id". Fields tagged "-" are skipped and untagged
+// fields use their lower cased name. A zero primary key is generated by the database
+// on Insert and written back to the object.
+type SQLRepository struct {
+	DB         *sql.DB
+	Table      string
+	PrimaryKey string  // The primary key column, defaults to "id". Must be the struct's pk column.
+	Dialect    Dialect // Defaults to SQLiteDialect.
+	// Restricts the fields List may filter and sort by to those the request's
+	// principal may read, in addition to the `access` struct tags, see FieldPolicy.
+	Fields *FieldPolicy
+
+	mu sync.Mutex
+	pk *column // The primary key of the last struct handled, which Delete parses ids with.
+}
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (repo *SQLRepository) dialect() Dialect {
+	if repo.Dialect == nil {
+		return SQLiteDialect
+	}
+	return repo.Dialect
+}
+
+func (repo *SQLRepository) primaryKey() string {
+	if repo.PrimaryKey == "" {
+		return "id"
+	}
+	return repo.PrimaryKey
+}
+
+// Returns the value and mapping of obj, which must have the repository's primary key
+// so that Get, Update and Delete address rows by the same column.
+func (repo *SQLRepository) structValue(obj interface{}) (reflect.Value, *tableMapping, error) {
+	value, mapping, err := structValue(obj)
+	if err != nil {
+		return value, nil, err
+	}
+	if mapping.pk.name != repo.primaryKey() {
+		return value, nil, fmt.Errorf("handlers: primary key %s of %s is not the repository's primary key %s",
+			mapping.pk.name, value.Type(), repo.primaryKey())
+	}
+	repo.mu.Lock()
+	repo.pk = mapping.pk
+	repo.mu.Unlock()
+	return value, mapping, nil
+}
+
+// Begins a database transaction. Repository calls made with a context carrying it,
+// see ContextWithTx, run inside the transaction.
+func (repo *SQLRepository) Begin(ctx context.Context) (Tx, error) {
+	return repo.DB.BeginTx(ctx, nil)
+}
+
+func (repo *SQLRepository) querier(ctx context.Context) querier {
+	tx, isSQLTx := TxFromContext(ctx).(*sql.Tx)
+	if isSQLTx {
+		return tx
+	}
+	return repo.DB
+}
+
+func (repo *SQLRepository) Get(ctx context.Context, id string, dest interface{}) error {
+	value, mapping, err := repo.structValue(dest)
+	if err != nil {
+		return err
+	}
+	pk, err := mapping.pk.parse(id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	dialect := repo.dialect()
+	query := "SELECT " + mapping.columnList(dialect, false) + " FROM " + dialect.Quote(repo.Table) +
+		" WHERE " + dialect.Quote(mapping.pk.name) + " = " + dialect.Placeholder(1)
+	row := repo.querier(ctx).QueryRowContext(ctx, query, pk)
+	return translateSQLError(row.Scan(mapping.addresses(value, false)...))
+}
+
+func (repo *SQLRepository) List(ctx context.Context, params ListParams, dest interface{}) error {
+	slice := reflect.ValueOf(dest)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("handlers: List destination must be a pointer to a slice, got %T", dest)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+	structType := elemType
+	if elemType.Kind() == reflect.Ptr {
+		structType = elemType.Elem()
+	}
+	mapping, err := mappingFor(structType)
+	if err != nil {
+		return err
+	}
+	err = checkListParams(ctx, structType, mapping, repo.Fields, params)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := repo.selectQuery(mapping, params)
+	if err != nil {
+		return err
+	}
+	rows, err := repo.querier(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return translateSQLError(err)
+	}
+	defer rows.Close()
+
+	result := reflect.MakeSlice(slice.Type(), 0, 0)
+	for rows.Next() {
+		item := reflect.New(structType)
+		err = rows.Scan(mapping.addresses(item.Elem(), false)...)
+		if err != nil {
+			return translateSQLError(err)
+		}
+		if elemType.Kind() == reflect.Ptr {
+			result = reflect.Append(result, item)
+		} else {
+			result = reflect.Append(result, item.Elem())
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return translateSQLError(err)
+	}
+	slice.Set(result)
+	return nil
+}
+
+func (repo *SQLRepository) Insert(ctx context.Context, obj interface{}) error {
+	value, mapping, err := repo.structValue(obj)
+	if err != nil {
+		return err
+	}
+	pkField := value.FieldByIndex(mapping.pk.index)
+	generatePK := pkField.IsZero()
+
+	dialect := repo.dialect()
+	args := mapping.values(value, generatePK)
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = dialect.Placeholder(i + 1)
+	}
+	query := "INSERT INTO " + dialect.Quote(repo.Table) + " (" + mapping.columnList(dialect, generatePK) +
+		") VALUES (" + strings.Join(placeholders, ", ") + ")"
+
+	if generatePK && dialect.Returning() {
+		query += " RETURNING " + dialect.Quote(mapping.pk.name)
+		row := repo.querier(ctx).QueryRowContext(ctx, query, args...)
+		return translateSQLError(row.Scan(pkField.Addr().Interface()))
+	}
+
+	result, err := repo.querier(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return translateSQLError(err)
+	}
+	if generatePK {
+		id, err := result.LastInsertId()
+		if err == nil {
+			setInt(pkField, id)
+		}
+	}
+	return nil
+}
+
+func (repo *SQLRepository) Update(ctx context.Context, obj interface{}) error {
+	value, mapping, err := repo.structValue(obj)
+	if err != nil {
+		return err
+	}
+
+	dialect := repo.dialect()
+	args := mapping.values(value, true)
+	assignments := make([]string, 0, len(args))
+	for _, col := range mapping.columns {
+		if col.pk {
+			continue
+		}
+		assignments = append(assignments, dialect.Quote(col.name)+" = "+dialect.Placeholder(len(assignments)+1))
+	}
+	if len(assignments) == 0 {
+		// Nothing but the primary key to set, check the row exists as an update would.
+		query := "SELECT 1 FROM " + dialect.Quote(repo.Table) +
+			" WHERE " + dialect.Quote(mapping.pk.name) + " = " + dialect.Placeholder(1)
+		var exists int
+		row := repo.querier(ctx).QueryRowContext(ctx, query, value.FieldByIndex(mapping.pk.index).Interface())
+		return translateSQLError(row.Scan(&exists))
+	}
+	args = append(args, value.FieldByIndex(mapping.pk.index).Interface())
+	query := "UPDATE " + dialect.Quote(repo.Table) + " SET " + strings.Join(assignments, ", ") +
+		" WHERE " + dialect.Quote(mapping.pk.name) + " = " + dialect.Placeholder(len(args))
+
+	result, err := repo.querier(ctx).ExecContext(ctx, query, args...)
+	if err != nil {
+		return translateSQLError(err)
+	}
+	return requireRowsAffected(result)
+}
+
+// Deletes the row with id. The id is parsed as Get parses it once the repository has
+// handled an object of the table, as it has when deleting a RepositoryObject.
+func (repo *SQLRepository) Delete(ctx context.Context, id string) error {
+	var pk interface{} = id
+	repo.mu.Lock()
+	col := repo.pk
+	repo.mu.Unlock()
+	if col != nil {
+		var err error
+		pk, err = col.parse(id)
+		if err != nil {
+			return ErrNotFound
+		}
+	}
+
+	dialect := repo.dialect()
+	query := "DELETE FROM " + dialect.Quote(repo.Table) +
+		" WHERE " + dialect.Quote(repo.primaryKey()) + " = " + dialect.Placeholder(1)
+	result, err := repo.querier(ctx).ExecContext(ctx, query, pk)
+	if err != nil {
+		return translateSQLError(err)
+	}
+	return requireRowsAffected(result)
+}
+
+// Builds the SELECT statement for a List call. Filters and sorts may only reference
+// mapped columns, by column or JSON name, so no client input is interpolated into the
+// query; unknown fields are returned as FieldErrors.
+func (repo *SQLRepository) selectQuery(mapping *tableMapping, params ListParams) (string, []interface{}, error) {
+	dialect := repo.dialect()
+	fieldErrs := NewFieldErrors()
+	hasErrs := false
+	args := make([]interface{}, 0)
+	conditions := make([]string, 0, len(params.Filters))
+
+	for _, filter := range params.Filters {
+		col := mapping.fields[filter.Field]
+		if col == nil {
+			fieldErrs.Add(filter.Field, "unknown field")
+			hasErrs = true
+			continue
+		}
+		operator, ok := sqlOperators[filter.Op]
+		if !ok {
+			fieldErrs.Add(filter.Field, "unknown filter operator")
+			hasErrs = true
+			continue
+		}
+
+		if filter.Op == OpIn {
+			parts := strings.Split(filter.Value, ",")
+			placeholders := make([]string, len(parts))
+			for i, part := range parts {
+				arg, err := col.parse(part)
+				if err != nil {
+					fieldErrs.Add(filter.Field, "invalid value")
+					hasErrs = true
+				}
+				args = append(args, arg)
+				placeholders[i] = dialect.Placeholder(len(args))
+			}
+			conditions = append(conditions, dialect.Quote(col.name)+" IN ("+strings.Join(placeholders, ", ")+")")
+			continue
+		}
+
+		var arg interface{} = filter.Value
+		if filter.Op != OpLike {
+			var err error
+			arg, err = col.parse(filter.Value)
+			if err != nil {
+				fieldErrs.Add(filter.Field, "invalid value")
+				hasErrs = true
+			}
+		}
+		args = append(args, arg)
+		conditions = append(conditions, dialect.Quote(col.name)+" "+operator+" "+dialect.Placeholder(len(args)))
+	}
+
+	orders := make([]string, 0, len(params.Sort))
+	for _, order := range params.Sort {
+		col := mapping.fields[order.Field]
+		if col == nil {
+			fieldErrs.Add("sort", "unknown field "+order.Field)
+			hasErrs = true
+			continue
+		}
+		direction := " ASC"
+		if order.Descending {
+			direction = " DESC"
+		}
+		orders = append(orders, dialect.Quote(col.name)+direction)
+	}
+
+	if hasErrs {
+		return "", nil, fieldErrs
+	}
+
+	query := "SELECT " + mapping.columnList(dialect, false) + " FROM " + dialect.Quote(repo.Table)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if len(orders) > 0 {
+		query += " ORDER BY " + strings.Join(orders, ", ")
+	}
+	if params.Limit > 0 || params.Offset > 0 {
+		limit := int64(params.Limit)
+		if limit == 0 {
+			limit = math.MaxInt64
+		}
+		args = append(args, limit)
+		query += " LIMIT " + dialect.Placeholder(len(args))
+	}
+	if params.Offset > 0 {
+		args = append(args, params.Offset)
+		query += " OFFSET " + dialect.Placeholder(len(args))
+	}
+	return query, args, nil
+}
+
+var sqlOperators = map[FilterOp]string{
+	OpEq:   "=",
+	OpNe:   "<>",
+	OpLt:   "<",
+	OpLte:  "<=",
+	OpGt:   ">",
+	OpGte:  ">=",
+	OpLike: "LIKE",
+	OpIn:   "IN",
+}
+
+// Maps driver errors onto ErrNotFound and ErrConflict.
+func translateSQLError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	message := err.Error()
+	for _, conflict := range []string{"UNIQUE constraint failed", "PRIMARY KEY constraint failed", "duplicate key", "Duplicate entry"} {
+		if strings.Contains(message, conflict) {
+			return fmt.Errorf("%w: %s", ErrConflict, message)
+		}
+	}
+	return err
+}
+
+func requireRowsAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type column struct {
+	name     string
+	jsonName string
+	index    []int
+	pk       bool
+	typ      reflect.Type
+}
+
+type tableMapping struct {
+	columns []*column
+	pk      *column
+	fields  map[string]*column
+}
+
+var tableMappings sync.Map
+
+func mappingFor(structType reflect.Type) (*tableMapping, error) {
+	mapping, err := columnMapping(structType)
+	if err == nil && mapping.pk == nil {
+		return nil, fmt.Errorf("handlers: %s has no primary key column", structType)
+	}
+	return mapping, err
+}
+
+// Like mappingFor, for uses that do not need a primary key column.
+func columnMapping(structType reflect.Type) (*tableMapping, error) {
+	if cached, ok := tableMappings.Load(structType); ok {
+		return cached.(*tableMapping), nil
+	}
+	if structType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("handlers: %s is not a struct", structType)
+	}
+
+	mapping := &tableMapping{fields: make(map[string]*column)}
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("db")
+		if field.PkgPath != "" || tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, options = tag[:comma], tag[comma+1:]
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		col := &column{name: name, jsonName: jsonFieldName(field), index: field.Index, typ: field.Type}
+		for _, option := range strings.Split(options, ",") {
+			if option == "pk" {
+				col.pk = true
+				mapping.pk = col
+			}
+		}
+		mapping.columns = append(mapping.columns, col)
+		if col.jsonName != "" {
+			mapping.fields[col.jsonName] = col
+		}
+		mapping.fields[col.name] = col
+	}
+	if mapping.pk == nil {
+		for _, col := range mapping.columns {
+			if col.name == "id" {
+				col.pk = true
+				mapping.pk = col
+			}
+		}
+	}
+	tableMappings.Store(structType, mapping)
+	return mapping, nil
+}
+
+// Returns the name a struct field is encoded as by encoding/json, or "" if the field
+// is not encoded.
+func jsonFieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	if comma := strings.Index(tag, ","); comma >= 0 {
+		tag = tag[:comma]
+	}
+	if tag == "" {
+		return field.Name
+	}
+	return tag
+}
+
+func structValue(obj interface{}) (reflect.Value, *tableMapping, error) {
+	value := reflect.ValueOf(obj)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return reflect.Value{}, nil, fmt.Errorf("handlers: expected a pointer to a struct, got %T", obj)
+	}
+	value = value.Elem()
+	mapping, err := mappingFor(value.Type())
+	return value, mapping, err
+}
+
+func (mapping *tableMapping) columnList(dialect Dialect, skipPK bool) string {
+	names := make([]string, 0, len(mapping.columns))
+	for _, col := range mapping.columns {
+		if skipPK && col.pk {
+			continue
+		}
+		names = append(names, dialect.Quote(col.name))
+	}
+	return strings.Join(names, ", ")
+}
+
+func (mapping *tableMapping) addresses(value reflect.Value, skipPK bool) []interface{} {
+	addresses := make([]interface{}, 0, len(mapping.columns))
+	for _, col := range mapping.columns {
+		if skipPK && col.pk {
+			continue
+		}
+		addresses = append(addresses, value.FieldByIndex(col.index).Addr().Interface())
+	}
+	return addresses
+}
+
+func (mapping *tableMapping) values(value reflect.Value, skipPK bool) []interface{} {
+	values := make([]interface{}, 0, len(mapping.columns))
+	for _, col := range mapping.columns {
+		if skipPK && col.pk {
+			continue
+		}
+		values = append(values, value.FieldByIndex(col.index).Interface())
+	}
+	return values
+}
+
+// Converts a string from a URL into a value of the column's type.
+func (col *column) parse(value string) (interface{}, error) {
+	columnType := col.typ
+	for columnType.Kind() == reflect.Ptr {
+		columnType = columnType.Elem()
+	}
+	if columnType == reflect.TypeOf(time.Time{}) {
+		return time.Parse(time.RFC3339, value)
+	}
+	switch columnType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(value, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+func setInt(field reflect.Value, value int64) {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		field.SetInt(value)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		field.SetUint(uint64(value))
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type sqlPet struct {
+	ID      int64  `db:"id,pk" json:"id"`
+	Name    string `json:"name"`
+	Age     int    `db:"pet_age" json:"age"`
+	Ignored string `db:"-"`
+}
+
+func TestSQLMapping(t *testing.T) {
+	mapping, err := mappingFor(reflect.TypeOf(sqlPet{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mapping.columns) != 3 {
+		t.Error("Fields tagged - should not be mapped.")
+	}
+	if mapping.pk == nil || mapping.pk.name != "id" {
+		t.Error("Primary key not found.")
+	}
+	if mapping.fields["age"] != mapping.fields["pet_age"] {
+		t.Error("Columns should be addressable by column and JSON name.")
+	}
+
+	_, err = mappingFor(reflect.TypeOf(struct{ Name string }{}))
+	if err == nil {
+		t.Error("Struct without primary key should not map.")
+	}
+}
+
+func TestSQLSelectQuery(t *testing.T) {
+	mapping, _ := mappingFor(reflect.TypeOf(sqlPet{}))
+	repo := &SQLRepository{Table: "pets", Dialect: PostgresDialect}
+	params := ListParams{
+		Filters: []Filter{{Field: "age", Op: OpGte, Value: "3"}, {Field: "name", Op: OpIn, Value: "Rex,Fido"}},
+		Sort:    []Sort{{Field: "age", Descending: true}},
+		Limit:   5,
+		Offset:  10,
+	}
+	query, args, err := repo.selectQuery(mapping, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT "id", "name", "pet_age" FROM "pets" WHERE "pet_age" >= $1 AND "name" IN ($2, $3) ORDER BY "pet_age" DESC LIMIT $4 OFFSET $5`
+	if query != expected {
+		t.Error("Wrong query built " + query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{int64(3), "Rex", "Fido", int64(5), 10}) {
+		t.Error("Wrong query arguments.")
+	}
+
+	params = ListParams{Filters: []Filter{{Field: "age; DROP TABLE pets", Op: OpEq, Value: "1"}}}
+	_, _, err = repo.selectQuery(mapping, params)
+	if _, ok := err.(FieldErrors); !ok {
+		t.Error("Unknown fields should return FieldErrors.")
+	}
+
+	params = ListParams{Filters: []Filter{{Field: "age", Op: OpEq, Value: "old"}}}
+	_, _, err = repo.selectQuery(mapping, params)
+	if _, ok := err.(FieldErrors); !ok {
+		t.Error("Values not matching the column type should return FieldErrors.")
+	}
+}
+
+func TestSQLErrors(t *testing.T) {
+	err := translateSQLError(errors.New("UNIQUE constraint failed: pets.id"))
+	if !errors.Is(err, ErrConflict) {
+		t.Error("Unique constraint violations should be conflicts.")
+	}
+
+	dispatcher := restHandlerDispatcher{resource: missingReadable{}}
+	w := httptest.NewRecorder()
+	dispatcher.GetMethodHandler(http.MethodGet).ServeHTTP(w, getRequest)
+	if w.Code != http.StatusNotFound {
+		t.Error("ErrNotFound should give a 404.")
+	}
+
+	dispatcher = restHandlerDispatcher{resource: conflictingCreatable{}}
+	w = httptest.NewRecorder()
+	dispatcher.GetMethodHandler(http.MethodPost).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	if w.Code != http.StatusConflict {
+		t.Error("ErrConflict should give a 409.")
+	}
+}
+
+type missingReadable struct {
+	resource
+}
+
+func (readable missingReadable) Read() ([]byte, error) {
+	return nil, ErrNotFound
+}
+
+type conflictingCreatable struct {
+	resource
+}
+
+func (creatable conflictingCreatable) Create(data []byte) (Readable, error) {
+	return nil, translateSQLError(errors.New("duplicate key value violates unique constraint"))
+}
@@ -0,0 +1,274 @@
+//go:build sqlite
+
+// Round trip tests against an embedded SQLite database, run with
+//
+//	go get modernc.org/sqlite && go test -tags sqlite ./...
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T, schema ...string) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	for _, statement := range schema {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+const sqlPetSchema = `CREATE TABLE pets (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT UNIQUE, pet_age INTEGER)`
+
+func TestSQLiteRepository(t *testing.T) {
+	repo := &SQLRepository{DB: openSQLite(t, sqlPetSchema), Table: "pets"}
+	ctx := context.Background()
+
+	rex := sqlPet{Name: "Rex", Age: 3}
+	if err := repo.Insert(ctx, &rex); err != nil || rex.ID != 1 {
+		t.Fatal("Insert should generate the primary key.", err)
+	}
+	repo.Insert(ctx, &sqlPet{Name: "Fido", Age: 7})
+	repo.Insert(ctx, &sqlPet{Name: "Spot", Age: 5})
+	if err := repo.Insert(ctx, &sqlPet{Name: "Rex"}); !errors.Is(err, ErrConflict) {
+		t.Error("Unique violations should be conflicts.", err)
+	}
+
+	pet := sqlPet{}
+	if err := repo.Get(ctx, "1", &pet); err != nil || pet.Name != "Rex" || pet.Age != 3 {
+		t.Error("Get should load the row.", err, pet)
+	}
+	if err := repo.Get(ctx, "9", &pet); !errors.Is(err, ErrNotFound) {
+		t.Error("Missing rows should not be found.")
+	}
+
+	rex.Age = 4
+	if err := repo.Update(ctx, &rex); err != nil {
+		t.Error(err)
+	}
+	if err := repo.Update(ctx, &sqlPet{ID: 9}); !errors.Is(err, ErrNotFound) {
+		t.Error("Updating a missing row should not be found.")
+	}
+
+	var pets []*sqlPet
+	params := ListParams{Filters: []Filter{{Field: "age", Op: OpGte, Value: "4"}}, Sort: []Sort{{Field: "age", Descending: true}}, Limit: 2}
+	if err := repo.List(ctx, params, &pets); err != nil || len(pets) != 2 || pets[0].Name != "Fido" || pets[1].Name != "Spot" {
+		t.Error("List should filter, sort and limit.", err, pets)
+	}
+
+	if err := repo.Delete(ctx, "1"); err != nil {
+		t.Error(err)
+	}
+	if err := repo.Delete(ctx, "1"); !errors.Is(err, ErrNotFound) {
+		t.Error("Deleting a missing row should not be found.")
+	}
+	if err := repo.Get(ctx, "1", &pet); !errors.Is(err, ErrNotFound) {
+		t.Error("Deleted rows should be gone.")
+	}
+}
+
+func TestSQLiteTransactions(t *testing.T) {
+	repo := &SQLRepository{DB: openSQLite(t, sqlPetSchema), Table: "pets"}
+	ctx := context.Background()
+
+	tx, _ := repo.Begin(ctx)
+	repo.Insert(ContextWithTx(ctx, tx), &sqlPet{Name: "Rex"})
+	tx.Rollback()
+	tx, _ = repo.Begin(ctx)
+	repo.Insert(ContextWithTx(ctx, tx), &sqlPet{Name: "Fido"})
+	tx.Commit()
+
+	var pets []sqlPet
+	repo.List(ctx, ListParams{}, &pets)
+	if len(pets) != 1 || pets[0].Name != "Fido" {
+		t.Error("Only committed writes should be stored.", pets)
+	}
+}
+
+type sqlOwner struct {
+	OwnerID int64 `db:"owner_id,pk"`
+	Name    string
+}
+
+func TestSQLitePrimaryKey(t *testing.T) {
+	db := openSQLite(t, `CREATE TABLE owners (owner_id INTEGER PRIMARY KEY, name TEXT)`)
+	ctx := context.Background()
+
+	repo := &SQLRepository{DB: db, Table: "owners"}
+	if err := repo.Insert(ctx, &sqlOwner{Name: "Bob"}); err == nil {
+		t.Error("A struct keyed by another column than PrimaryKey should be refused.")
+	}
+
+	repo.PrimaryKey = "owner_id"
+	owner := sqlOwner{Name: "Bob"}
+	repo.Insert(ctx, &owner)
+	if err := repo.Get(ctx, "1", &sqlOwner{}); err != nil {
+		t.Error(err)
+	}
+	if err := repo.Delete(ctx, "1"); err != nil {
+		t.Error("Delete should use the same primary key.", err)
+	}
+}
+
+func TestSQLiteDeleteParsesIDs(t *testing.T) {
+	repo := &SQLRepository{DB: openSQLite(t, sqlPetSchema), Table: "pets"}
+	ctx := context.Background()
+	repo.Insert(ctx, &sqlPet{Name: "Rex"})
+
+	// SQLite would compare the text "1.0" to the integer 1 as equal.
+	if err := repo.Get(ctx, "1.0", &sqlPet{}); !errors.Is(err, ErrNotFound) {
+		t.Fatal("Get should not find a malformed id.", err)
+	}
+	if err := repo.Delete(ctx, "1.0"); !errors.Is(err, ErrNotFound) {
+		t.Error("Delete should parse the id as Get does.", err)
+	}
+	if err := repo.Delete(ctx, "1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSQLiteListHiddenFields(t *testing.T) {
+	repo := &SQLRepository{
+		DB:     openSQLite(t, sqlPetSchema),
+		Table:  "pets",
+		Fields: &FieldPolicy{ReadRoles: map[string][]string{"age": {"vet"}}},
+	}
+	ctx := context.Background()
+	repo.Insert(ctx, &sqlPet{Name: "Rex", Age: 3})
+
+	var pets []sqlPet
+	params := ListParams{Filters: []Filter{{Field: "pet_age", Op: OpLt, Value: "4"}}}
+	if _, ok := repo.List(ctx, params, &pets).(FieldErrors); !ok {
+		t.Error("Filtering by fields the principal may not read should be rejected.")
+	}
+	vet := ContextWithPrincipal(ctx, &Principal{Roles: []string{"vet"}})
+	if err := repo.List(vet, params, &pets); err != nil || len(pets) != 1 {
+		t.Error("Principals that may read a field should filter by it.", err)
+	}
+}
+
+type sqlTag struct {
+	Name string `db:"name,pk"`
+}
+
+func TestSQLiteUpdatePrimaryKeyOnly(t *testing.T) {
+	repo := &SQLRepository{DB: openSQLite(t, `CREATE TABLE tags (name TEXT PRIMARY KEY)`), Table: "tags", PrimaryKey: "name"}
+	ctx := context.Background()
+	repo.Insert(ctx, &sqlTag{Name: "good"})
+
+	if err := repo.Update(ctx, &sqlTag{Name: "good"}); err != nil {
+		t.Error("Updating a row with nothing but its key should succeed.", err)
+	}
+	if err := repo.Update(ctx, &sqlTag{Name: "bad"}); !errors.Is(err, ErrNotFound) {
+		t.Error("Updating a missing row should not be found.", err)
+	}
+}
+
+const sqlOutboxSchema = `CREATE TABLE outbox (sequence INTEGER PRIMARY KEY AUTOINCREMENT, id TEXT UNIQUE,
+	type TEXT, collection TEXT, key TEXT, payload TEXT, created INTEGER, delivered INTEGER, failed TEXT)`
+
+func TestSQLiteOutboxStore(t *testing.T) {
+	db := openSQLite(t, sqlPetSchema, sqlOutboxSchema)
+	repo := &OutboxRepository{
+		Repository: &SQLRepository{DB: db, Table: "pets"},
+		Outbox:     &SQLOutboxStore{DB: db},
+		Collection: "pets",
+	}
+	store := repo.Outbox.(*SQLOutboxStore)
+	sqlRepo := repo.Repository.(*SQLRepository)
+	ctx := context.Background()
+
+	tx, _ := sqlRepo.Begin(ctx)
+	repo.Insert(ContextWithTx(ctx, tx), &sqlPet{Name: "Rex"})
+	tx.Rollback()
+	tx, _ = sqlRepo.Begin(ctx)
+	repo.Insert(ContextWithTx(ctx, tx), &sqlPet{Name: "Fido", Age: 2})
+	tx.Commit()
+	repo.Delete(ctx, "1")
+
+	pending, err := store.Pending(ctx, 0, 0)
+	if err != nil || len(pending) != 2 {
+		t.Fatal("Only messages of committed writes should be pending.", err, pending)
+	}
+	if pending[0].Type != ChangeCreated || pending[0].Key != "1" || !strings.Contains(string(pending[0].Payload), `"name":"Fido"`) ||
+		pending[0].Time.IsZero() || pending[1].Type != ChangeDeleted || string(pending[1].Payload) != "null" {
+		t.Error("Messages should round trip.", pending)
+	}
+	if page, _ := store.Pending(ctx, pending[0].Sequence, 1); len(page) != 1 || page[0].ID != pending[1].ID {
+		t.Error("Pending should page by sequence.", page)
+	}
+
+	if err := store.MarkDelivered(ctx, pending[0].ID); err != nil {
+		t.Error(err)
+	}
+	if err := store.MarkFailed(ctx, pending[1].ID, "unavailable"); err != nil {
+		t.Error(err)
+	}
+	if err := store.MarkDelivered(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("Marking a missing message should not be found.", err)
+	}
+	if pending, _ := store.Pending(ctx, 0, 0); len(pending) != 0 {
+		t.Error("Delivered and failed messages should not be pending.", pending)
+	}
+	failed, _ := store.Failed(ctx, 10)
+	if len(failed) != 1 || failed[0].ID != pending[1].ID || failed[0].Error != "unavailable" {
+		t.Error("Failed messages should be listed with their reason.", failed)
+	}
+}
+
+func TestSQLiteProcessedStore(t *testing.T) {
+	db := openSQLite(t, sqlPetSchema, `CREATE TABLE processed_messages (id TEXT PRIMARY KEY)`)
+	repo := &SQLRepository{DB: db, Table: "pets"}
+	processed := &SQLProcessedStore{DB: db}
+	ctx := context.Background()
+	fail := true
+	consumer := &IdempotentConsumer{
+		Processed:  processed,
+		Transactor: repo,
+		Handler: func(ctx context.Context, message OutboxMessage) error {
+			err := repo.Insert(ctx, &sqlPet{Name: message.Key})
+			if err != nil || fail {
+				return errors.New("failed")
+			}
+			return nil
+		},
+	}
+
+	message := OutboxMessage{ID: NewUUIDv7(), Key: "Rex"}
+	if consumer.Deliver(ctx, message) == nil {
+		t.Fatal("Failed messages should fail.")
+	}
+	var pets []*sqlPet
+	repo.List(ctx, ListParams{}, &pets)
+	if seen, _ := processed.Processed(ctx, message.ID); seen || len(pets) != 0 {
+		t.Error("Failed messages should be neither handled nor recorded.")
+	}
+
+	fail = false
+	if err := consumer.Deliver(ctx, message); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Deliver(ctx, message); err != nil {
+		t.Error("Redelivered messages should be ignored.", err)
+	}
+	repo.List(ctx, ListParams{}, &pets)
+	if seen, _ := processed.Processed(ctx, message.ID); !seen || len(pets) != 1 {
+		t.Error("Messages should be handled and recorded once.", len(pets))
+	}
+	if err := processed.MarkProcessed(ctx, message.ID); !errors.Is(err, ErrConflict) {
+		t.Error("Recording a message twice should conflict.", err)
+	}
+}
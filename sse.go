@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Streams the events of a ChangeBus as Server-Sent Events, for a whole collection or,
+// if Key is set, for the object it returns for the request. Each event is sent with
+// its ID and Type as the SSE id and event name and its JSON as data, with the
+// fields the principal may not read removed and the objects it may not read skipped.
+//
+// Clients reconnecting with a Last-Event-ID header, or a lastEventId query parameter,
+// first receive the events they missed. If some of those are no longer buffered a
+// "reset" event tells the client to reload the collection.
+//
+// Set Authenticator to only stream to authenticated principals, as EndpointHandler
+// does; without one the stream is public, and the objects without a RowAuthorizer
+// are sent to anyone.
+type ChangeStream struct {
+	Changes    *ChangeBus
+	Collection string
+	Key        func(r *http.Request) string
+
+	// Requests must be authenticated before subscribing, unless AllowAnonymous is set
+	// and the request carries no credentials.
+	Authenticator  Authenticator
+	AllowAnonymous bool
+
+	// Interval of the comments sent to keep idle connections open. Defaults to 30s.
+	Heartbeat time.Duration
+}
+
+func (stream *ChangeStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if stream.Authenticator != nil {
+		var ok bool
+		r, ok = authenticate(w, r, stream.Authenticator, stream.AllowAnonymous)
+		if !ok {
+			return
+		}
+	}
+	controller := http.NewResponseController(w)
+	key := ""
+	if stream.Key != nil {
+		key = stream.Key(r)
+	}
+
+	var subscription *Subscription
+	var missed []ChangeEvent
+	complete := true
+	lastEventID, resuming := parseLastEventID(r)
+	if resuming {
+		subscription, missed, complete = stream.Changes.Resume(stream.Collection, key, lastEventID)
+	} else {
+		subscription = stream.Changes.Subscribe(stream.Collection, key)
+	}
+	defer subscription.Close()
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		w.Write([]byte("event: reset\ndata: {}\n\n"))
+	}
+	for _, event := range missed {
+		writeServerSentEvent(w, r, event)
+	}
+	if controller.Flush() != nil {
+		return
+	}
+
+	heartbeat := stream.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = 30 * time.Second
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			w.Write([]byte(": heartbeat\n\n"))
+		case event, ok := <-subscription.Events():
+			if !ok {
+				// Dropped for falling behind, the client reconnects and resumes.
+				return
+			}
+			writeServerSentEvent(w, r, event)
+		}
+		if controller.Flush() != nil {
+			return
+		}
+	}
+}
+
+func parseLastEventID(r *http.Request) (uint64, bool) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	return id, err == nil
+}
+
+func writeServerSentEvent(w http.ResponseWriter, r *http.Request, event ChangeEvent) {
+	if !event.visible(r.Context()) {
+		return
+	}
+	data, err := event.render(r.Context())
+	if err != nil {
+		return
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("id: " + strconv.FormatUint(event.ID, 10) + "\n")
+	buffer.WriteString("event: " + event.Type + "\n")
+	buffer.WriteString("data: ")
+	buffer.Write(data)
+	buffer.WriteString("\n\n")
+	w.Write(buffer.Bytes())
+}
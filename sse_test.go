@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Reads the next event from an SSE stream, skipping comments.
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(event) > 0 {
+				return event
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ": ")
+		event[name] = value
+	}
+}
+
+func openChangeStream(t *testing.T, url string, lastEventID string) (*bufio.Reader, func()) {
+	r, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventID != "" {
+		r.Header.Set("Last-Event-ID", lastEventID)
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Wrong content type.")
+	}
+	return bufio.NewReader(response.Body), func() { response.Body.Close() }
+}
+
+func TestChangeStream(t *testing.T) {
+	bus := &ChangeBus{}
+	server := httptest.NewServer(&ChangeStream{Changes: bus, Collection: "people"})
+	defer server.Close()
+	reader, closeStream := openChangeStream(t, server.URL, "")
+	defer closeStream()
+
+	people.store = nil
+	list := &JSONListResource{
+		Creator:    &people,
+		Changes:    bus,
+		Collection: "people",
+		KeyOf:      func(obj interface{}) string { return obj.(*Person).Name },
+	}
+	readable, err := list.Create([]byte(`{"name":"Bob","age":35}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := readServerSentEvent(t, reader)
+	if event["event"] != ChangeCreated || event["id"] != "1" || !strings.Contains(event["data"], `"key":"Bob"`) ||
+		!strings.Contains(event["data"], `"age":35`) {
+		t.Error("Should stream created events.", event)
+	}
+
+	person := readable.(*JSONReadOnlyResource).Object.(*Person)
+	resource := &JSONResource{Object: person, Changes: bus, Collection: "people", Key: "Bob"}
+	err = resource.PartialUpdate([]byte(`{"age":36}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	event = readServerSentEvent(t, reader)
+	if event["event"] != ChangeUpdated || !strings.Contains(event["data"], `"age":36`) {
+		t.Error("Should stream updated events.", event)
+	}
+
+	bus.Publish(ChangeEvent{Type: ChangeCreated, Collection: "pets", Key: "Rex"})
+	resource.Delete()
+	event = readServerSentEvent(t, reader)
+	if event["event"] != ChangeDeleted || event["id"] != "4" {
+		t.Error("Should only stream the collection's events.", event)
+	}
+
+	resumed, closeResumed := openChangeStream(t, server.URL, "1")
+	defer closeResumed()
+	event = readServerSentEvent(t, resumed)
+	if event["id"] != "2" || event["event"] != ChangeUpdated {
+		t.Error("Should replay the events after Last-Event-ID.", event)
+	}
+	event = readServerSentEvent(t, resumed)
+	if event["id"] != "4" {
+		t.Error("Should replay every missed event.", event)
+	}
+}
+
+func TestChangeStreamAuthentication(t *testing.T) {
+	bus := &ChangeBus{}
+	server := httptest.NewServer(&ChangeStream{
+		Changes:       bus,
+		Collection:    "people",
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{"key": {Subject: "alice"}}},
+	})
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized || response.Header.Get("WWW-Authenticate") == "" {
+		t.Error("Unauthenticated streams should be rejected.", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	request.Header.Set("X-API-Key", "key")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Error("Authenticated streams should be served.", response.StatusCode)
+	}
+}
+
+func TestChangeStreamItemAndReset(t *testing.T) {
+	bus := &ChangeBus{ReplaySize: 2}
+	for _, key := range []string{"a", "b", "a", "a"} {
+		bus.Publish(ChangeEvent{Type: ChangeUpdated, Collection: "items", Key: key})
+	}
+	server := httptest.NewServer(&ChangeStream{
+		Changes:    bus,
+		Collection: "items",
+		Key:        func(r *http.Request) string { return strings.TrimPrefix(r.URL.Path, "/") },
+	})
+	defer server.Close()
+
+	reader, closeStream := openChangeStream(t, server.URL+"/a", "0")
+	defer closeStream()
+	if event := readServerSentEvent(t, reader); event["event"] != "reset" {
+		t.Error("Should ask clients to reload when events are no longer buffered.", event)
+	}
+	if event := readServerSentEvent(t, reader); event["id"] != "3" {
+		t.Error("Should replay the buffered events of the item.", event)
+	}
+	if event := readServerSentEvent(t, reader); event["id"] != "4" {
+		t.Error("Should replay the buffered events of the item.", event)
+	}
+	bus.Publish(ChangeEvent{Type: ChangeDeleted, Collection: "items", Key: "b"})
+	bus.Publish(ChangeEvent{Type: ChangeDeleted, Collection: "items", Key: "a"})
+	if event := readServerSentEvent(t, reader); event["id"] != "6" {
+		t.Error("Should only stream the item's events.", event)
+	}
+}
+
+func TestChangeBusDropsSlowSubscribers(t *testing.T) {
+	bus := &ChangeBus{}
+	subscription := bus.Subscribe("", "")
+	for i := 0; i <= subscriptionBuffer; i++ {
+		bus.Publish(ChangeEvent{Type: ChangeCreated})
+	}
+	if !subscription.Dropped() {
+		t.Error("Subscribers that fall behind should be dropped.")
+	}
+	count := 0
+	for range subscription.Events() {
+		count++
+	}
+	if count != subscriptionBuffer {
+		t.Error("Buffered events should still be delivered.")
+	}
+}
+
+func TestChangeBusResume(t *testing.T) {
+	bus := &ChangeBus{}
+	bus.Publish(ChangeEvent{Type: ChangeCreated, Collection: "items"})
+	bus.Publish(ChangeEvent{Type: ChangeUpdated, Collection: "items"})
+
+	if _, missed, complete := bus.Resume("items", "", 1); !complete || len(missed) != 1 || missed[0].ID != 2 {
+		t.Error("Buffered events should be replayed.", missed)
+	}
+	if _, missed, complete := bus.Resume("items", "", 2); !complete || len(missed) != 0 {
+		t.Error("Up to date subscribers should miss nothing.", missed)
+	}
+	if _, _, complete := bus.Resume("items", "", 5); complete {
+		t.Error("Events the bus did not issue should not be taken as complete.")
+	}
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Starts spans. Set a Tracer on EndpointHandler to trace its requests; spans are
+// opened for the request, Endpoint.GetResource, the method handler and the Read,
+// Create, Update, Validate, Save and Delete calls it makes. Adapt a tracing library,
+// such as OpenTelemetry, by implementing Tracer, or use BasicTracer.
+type Tracer interface {
+	// Starts a span named name, a child of the span in ctx, and returns ctx with the
+	// new span in it.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+	SpanContext() SpanContext
+}
+
+// Identifies a span across processes, as carried by the W3C traceparent and
+// tracestate headers.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+	Remote     bool
+}
+
+func (spanContext SpanContext) IsValid() bool {
+	return spanContext.TraceID != [16]byte{} && spanContext.SpanID != [8]byte{}
+}
+
+// Returns the traceparent header value for the span context.
+func (spanContext SpanContext) TraceParent() string {
+	flags := "00"
+	if spanContext.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(spanContext.TraceID[:]) + "-" + hex.EncodeToString(spanContext.SpanID[:]) + "-" + flags
+}
+
+var errInvalidTraceParent = errors.New("invalid traceparent")
+
+// Parses a W3C traceparent header value.
+func ParseTraceParent(value string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, errInvalidTraceParent
+	}
+	// Version 00 has exactly four fields, later versions may append more.
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, errInvalidTraceParent
+	}
+	var spanContext SpanContext
+	var flags [1]byte
+	_, err1 := hex.Decode(spanContext.TraceID[:], []byte(parts[1]))
+	_, err2 := hex.Decode(spanContext.SpanID[:], []byte(parts[2]))
+	_, err3 := hex.Decode(flags[:], []byte(parts[3]))
+	if err1 != nil || err2 != nil || err3 != nil || !spanContext.IsValid() {
+		return SpanContext{}, errInvalidTraceParent
+	}
+	spanContext.Sampled = flags[0]&1 == 1
+	spanContext.Remote = true
+	return spanContext, nil
+}
+
+// Returns the span context propagated in the traceparent and tracestate headers.
+func ExtractTraceContext(header http.Header) (SpanContext, bool) {
+	spanContext, err := ParseTraceParent(header.Get("traceparent"))
+	if err != nil {
+		return SpanContext{}, false
+	}
+	spanContext.TraceState = strings.Join(header.Values("tracestate"), ",")
+	return spanContext, true
+}
+
+// Sets the traceparent and tracestate headers for the span in ctx, for instance on
+// outgoing requests.
+func InjectTraceContext(ctx context.Context, header http.Header) {
+	spanContext := SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return
+	}
+	header.Set("traceparent", spanContext.TraceParent())
+	if spanContext.TraceState != "" {
+		header.Set("tracestate", spanContext.TraceState)
+	} else {
+		header.Del("tracestate")
+	}
+}
+
+type spanContextKey struct{}
+type remoteSpanContextKey struct{}
+type tracerContextKey struct{}
+
+// Returns a copy of ctx carrying span.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+// Returns the current span of ctx, or nil.
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanContextKey{}).(Span)
+	return span
+}
+
+// Returns a copy of ctx with a span context received from another process, which
+// becomes the parent of the next span started.
+func ContextWithRemoteSpanContext(ctx context.Context, spanContext SpanContext) context.Context {
+	return context.WithValue(ctx, remoteSpanContextKey{}, spanContext)
+}
+
+// Returns the span context of the current span of ctx, or of the remote parent if
+// no span has been started yet.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.SpanContext()
+	}
+	spanContext, _ := ctx.Value(remoteSpanContextKey{}).(SpanContext)
+	return spanContext
+}
+
+// Starts a span with the tracer of the request, doing nothing if it is not traced.
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	tracer, _ := ctx.Value(tracerContextKey{}).(Tracer)
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, name)
+}
+
+// Ends span, recording err on it if not nil, and returns err.
+func endSpan(span Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	return err
+}
+
+type noopSpan struct{}
+
+func (span noopSpan) SetAttribute(key string, value interface{}) {}
+func (span noopSpan) RecordError(err error)                      {}
+func (span noopSpan) End()                                       {}
+func (span noopSpan) SpanContext() SpanContext                   { return SpanContext{} }
+
+// Traces the request: continues the trace in the request's traceparent header and
+// starts the server span, named after the method and endpoint.
+func traceHandler(tracer Tracer, endpoint string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), tracerContextKey{}, tracer)
+		if parent, ok := ExtractTraceContext(r.Header); ok {
+			ctx = ContextWithRemoteSpanContext(ctx, parent)
+		}
+		ctx, span := tracer.Start(ctx, r.Method+" "+endpoint)
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		span.SetAttribute("endpoint", endpoint)
+
+		r, info := withRequestInfo(r.WithContext(ctx))
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		span.SetAttribute("http.status_code", recorder.statusCode())
+		if info.err != nil {
+			span.RecordError(info.err)
+		}
+	})
+}
+
+// Receives spans as they end.
+type SpanExporter interface {
+	Export(span SpanData)
+}
+
+// A finished span.
+type SpanData struct {
+	Name        string
+	SpanContext SpanContext
+	Parent      SpanContext
+	Start       time.Time
+	End         time.Time
+	Attributes  map[string]interface{}
+	Errors      []error
+}
+
+// A Tracer creating spans with random IDs and passing them to Exporter when they
+// end. Spans are sampled if their remote parent is, or if they start a trace.
+type BasicTracer struct {
+	Exporter SpanExporter
+}
+
+func (tracer *BasicTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+	span := &basicSpan{exporter: tracer.Exporter}
+	span.data.Name = name
+	span.data.Start = time.Now()
+	span.data.Parent = parent
+	span.data.Attributes = make(map[string]interface{})
+	if parent.IsValid() {
+		span.data.SpanContext.TraceID = parent.TraceID
+		span.data.SpanContext.Sampled = parent.Sampled
+		span.data.SpanContext.TraceState = parent.TraceState
+	} else {
+		rand.Read(span.data.SpanContext.TraceID[:])
+		span.data.SpanContext.Sampled = true
+	}
+	rand.Read(span.data.SpanContext.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+type basicSpan struct {
+	mu       sync.Mutex
+	data     SpanData
+	ended    bool
+	exporter SpanExporter
+}
+
+func (span *basicSpan) SetAttribute(key string, value interface{}) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	if !span.ended {
+		span.data.Attributes[key] = value
+	}
+}
+
+func (span *basicSpan) RecordError(err error) {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+	if !span.ended {
+		span.data.Errors = append(span.data.Errors, err)
+	}
+}
+
+func (span *basicSpan) End() {
+	span.mu.Lock()
+	if span.ended {
+		span.mu.Unlock()
+		return
+	}
+	span.ended = true
+	span.data.End = time.Now()
+	data := span.data
+	span.mu.Unlock()
+	if span.exporter != nil && data.SpanContext.Sampled {
+		span.exporter.Export(data)
+	}
+}
+
+func (span *basicSpan) SpanContext() SpanContext {
+	return span.data.SpanContext
+}
+
+// Keeps exported spans in memory, for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (exporter *InMemoryExporter) Export(span SpanData) {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	exporter.spans = append(exporter.spans, span)
+}
+
+// Returns the spans exported so far, in the order they ended.
+func (exporter *InMemoryExporter) Spans() []SpanData {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	return append([]SpanData(nil), exporter.spans...)
+}
+
+func (exporter *InMemoryExporter) Reset() {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	exporter.spans = nil
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type peopleEndpoint struct{}
+
+func (endpoint peopleEndpoint) GetResource(r *http.Request) Resource {
+	return &JSONListResource{ObjectList: people.InterfaceList(), Creator: &people}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	spanContext, err := ParseTraceParent(header)
+	if err != nil || !spanContext.Sampled || !spanContext.Remote {
+		t.Fatal("Should parse a valid traceparent.")
+	}
+	if spanContext.TraceParent() != header {
+		t.Error("Should format the traceparent it parsed.")
+	}
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, value := range invalid {
+		if _, err := ParseTraceParent(value); err == nil {
+			t.Error("Should reject " + value)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	handler := EndpointHandler{Endpoint: peopleEndpoint{}, Name: "people", Tracer: &BasicTracer{Exporter: exporter}}
+	people.store = nil
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"Bob","age":35}`))
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "vendor=value")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := exporter.Spans()
+	names := make([]string, len(spans))
+	byName := make(map[string]SpanData)
+	for i, span := range spans {
+		names[i] = span.Name
+		byName[span.Name] = span
+	}
+	if strings.Join(names, ",") != "GetResource,Validate,Save,Create,Read,POST handler,POST people" {
+		t.Fatal("Wrong spans " + strings.Join(names, ","))
+	}
+	server := byName["POST people"]
+	if server.SpanContext.TraceParent()[3:35] != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		server.Parent.TraceParent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" ||
+		server.SpanContext.TraceState != "vendor=value" {
+		t.Error("The server span should continue the propagated trace.")
+	}
+	if server.Attributes["http.status_code"] != http.StatusCreated {
+		t.Error("The server span should record the status.")
+	}
+	if byName["Save"].Parent.SpanID != byName["Create"].SpanContext.SpanID ||
+		byName["Create"].Parent.SpanID != byName["POST handler"].SpanContext.SpanID ||
+		byName["POST handler"].Parent.SpanID != server.SpanContext.SpanID {
+		t.Error("Spans should be nested.")
+	}
+
+	exporter.Reset()
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"Fred"}`))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	for _, span := range exporter.Spans() {
+		if (span.Name == "Validate" || span.Name == "Create" || span.Name == "POST people") && len(span.Errors) != 1 {
+			t.Error("The validation error should be recorded on " + span.Name)
+		}
+	}
+}
+
+func TestInjectTraceContext(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	ctx, span := (&BasicTracer{Exporter: exporter}).Start(ContextWithRemoteSpanContext(
+		httptest.NewRequest(http.MethodGet, "/", nil).Context(),
+		SpanContext{TraceID: [16]byte{1}, SpanID: [8]byte{2}, TraceState: "a=b"},
+	), "outgoing")
+	header := http.Header{}
+	InjectTraceContext(ctx, header)
+	span.End()
+	if header.Get("traceparent") != span.SpanContext().TraceParent() || header.Get("tracestate") != "a=b" {
+		t.Error("Should inject the current span.")
+	}
+	if len(exporter.Spans()) != 0 {
+		t.Error("Spans of unsampled traces should not be exported.")
+	}
+}
+
+type spanRecordingEndpoint struct {
+	spans *[]SpanContext
+}
+
+func (endpoint spanRecordingEndpoint) GetResource(r *http.Request) Resource {
+	*endpoint.spans = append(*endpoint.spans, SpanFromContext(r.Context()).SpanContext())
+	return nil
+}
+
+func TestTracingGetResource(t *testing.T) {
+	exporter := &InMemoryExporter{}
+	spans := make([]SpanContext, 0)
+	handler := EndpointHandler{Endpoint: spanRecordingEndpoint{spans: &spans}, Tracer: &BasicTracer{Exporter: exporter}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	exported := exporter.Spans()
+	if len(exported) == 0 || exported[0].Name != "GetResource" || len(spans) != 1 || spans[0].SpanID != exported[0].SpanContext.SpanID {
+		t.Error("GetResource should run in its span.")
+	}
+}
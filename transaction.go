@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Begins the transactions that write requests run in. Set on EndpointHandler to have
+// every POST, PUT, PATCH and DELETE committed when it succeeds and rolled back when it
+// fails. SQLRepository is a Transactor.
+type Transactor interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// A transaction started by a Transactor.
+type Tx interface {
+	Commit() error
+	Rollback() error
+}
+
+type txContextKey struct{}
+
+// Returns a copy of ctx carrying tx. Repositories look the transaction up with
+// TxFromContext.
+func ContextWithTx(ctx context.Context, tx Tx) context.Context {
+	return context.WithValue(ctx, txContextKey{}, tx)
+}
+
+// Returns the transaction the request is running in, or nil.
+func TxFromContext(ctx context.Context) Tx {
+	tx, _ := ctx.Value(txContextKey{}).(Tx)
+	return tx
+}
+
+// Functions to run once a transaction commits, see afterCommit, and once it ends
+// either way, see afterTransaction.
+type commitCallbacks struct {
+	mu      sync.Mutex
+	fns     []func()
+	finally []func()
+}
+
+type commitCallbacksContextKey struct{}
+
+// Runs fn once the transaction transactionHandler started for the request in ctx
+// commits, and never if it rolls back. Runs fn right away outside such transactions.
+func afterCommit(ctx context.Context, fn func()) {
+	callbacks, ok := ctx.Value(commitCallbacksContextKey{}).(*commitCallbacks)
+	if !ok {
+		fn()
+		return
+	}
+	callbacks.mu.Lock()
+	defer callbacks.mu.Unlock()
+	callbacks.fns = append(callbacks.fns, fn)
+}
+
+// Runs fn once the transaction transactionHandler started for the request in ctx
+// commits or rolls back, after the afterCommit functions. Returns false, without
+// running fn, outside such transactions.
+func afterTransaction(ctx context.Context, fn func()) bool {
+	callbacks, ok := ctx.Value(commitCallbacksContextKey{}).(*commitCallbacks)
+	if !ok {
+		return false
+	}
+	callbacks.mu.Lock()
+	defer callbacks.mu.Unlock()
+	callbacks.finally = append(callbacks.finally, fn)
+	return true
+}
+
+func (callbacks *commitCallbacks) run() {
+	callbacks.mu.Lock()
+	fns := callbacks.fns
+	callbacks.fns = nil
+	callbacks.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+func (callbacks *commitCallbacks) finish() {
+	callbacks.mu.Lock()
+	fns := callbacks.finally
+	callbacks.fns = nil
+	callbacks.finally = nil
+	callbacks.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Runs a write method handler in a transaction. The response is buffered so that it
+// is only sent once the transaction is committed; responses with an error status roll
+// the transaction back. Changes are published, and after hooks run, once it commits.
+type transactionHandler struct {
+	transactor Transactor
+	handler    http.Handler
+}
+
+func (handler transactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tx, err := handler.transactor.Begin(r.Context())
+	if err != nil {
+		writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	callbacks := &commitCallbacks{}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+		callbacks.finish()
+	}()
+
+	ctx := context.WithValue(ContextWithTx(r.Context(), tx), commitCallbacksContextKey{}, callbacks)
+	response := newBufferedResponse()
+	handler.handler.ServeHTTP(response, r.WithContext(ctx))
+	if response.status >= http.StatusBadRequest {
+		response.flush(w)
+		return
+	}
+
+	committed = true
+	err = tx.Commit()
+	if err != nil {
+		tx.Rollback()
+		callbacks.finish()
+		writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	callbacks.run()
+	callbacks.finish()
+	response.flush(w)
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testTx struct {
+	committed  bool
+	rolledBack bool
+	commitErr  error
+}
+
+func (tx *testTx) Commit() error {
+	tx.committed = true
+	return tx.commitErr
+}
+
+func (tx *testTx) Rollback() error {
+	tx.rolledBack = true
+	return nil
+}
+
+type testTransactor struct {
+	txs       []*testTx
+	commitErr error
+}
+
+func (transactor *testTransactor) Begin(ctx context.Context) (Tx, error) {
+	tx := &testTx{commitErr: transactor.commitErr}
+	transactor.txs = append(transactor.txs, tx)
+	return tx, nil
+}
+
+type txCreatable struct {
+	resource
+}
+
+func (creatable txCreatable) Create(data []byte) (Readable, error) {
+	return nil, errors.New("should be called with a context")
+}
+
+func (creatable txCreatable) CreateContext(ctx context.Context, data []byte) (Readable, error) {
+	if TxFromContext(ctx) == nil {
+		return nil, errors.New("no transaction")
+	}
+	if string(data) == "invalid" {
+		errs := NewFieldErrors()
+		errs.Add("data", "invalid")
+		return nil, errs
+	}
+	return readable{}, nil
+}
+
+type txEndpoint struct{}
+
+func (endpoint txEndpoint) GetResource(r *http.Request) Resource {
+	return txCreatable{}
+}
+
+func TestTransactions(t *testing.T) {
+	transactor := &testTransactor{}
+	handler := EndpointHandler{Endpoint: txEndpoint{}, Transactor: transactor}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("valid")))
+	if w.Code != http.StatusCreated {
+		t.Error("Valid create should give a 201, got " + w.Body.String())
+	}
+	if !transactor.txs[0].committed || transactor.txs[0].rolledBack {
+		t.Error("Successful write should be committed.")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("invalid")))
+	if w.Code != http.StatusBadRequest {
+		t.Error("Invalid create should give a 400.")
+	}
+	if transactor.txs[1].committed || !transactor.txs[1].rolledBack {
+		t.Error("Failed write should be rolled back.")
+	}
+
+	transactor.commitErr = ErrConflict
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("valid")))
+	if w.Code != http.StatusConflict {
+		t.Error("Failed commit should not report success.")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(transactor.txs) != 3 {
+		t.Error("Reads should not start transactions.")
+	}
+}
+
+func TestTransactionsPublishAfterCommit(t *testing.T) {
+	bus := &ChangeBus{}
+	transactor := &testTransactor{commitErr: ErrConflict}
+	handler := EndpointHandler{
+		Endpoint:   livePeopleEndpoint{people: map[string]*Person{"bob": {Name: "Bob", Age: 35}}, bus: bus},
+		Transactor: transactor,
+	}
+	subscription := bus.Subscribe("people", "")
+	defer subscription.Close()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/people/bob", strings.NewReader(`{"age":36}`)))
+	if w.Code != http.StatusConflict || len(subscription.Events()) != 0 {
+		t.Error("Changes should not be published when the transaction fails to commit.")
+	}
+
+	transactor.commitErr = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/people/bob", strings.NewReader(`{"age":37}`)))
+	if w.Code != http.StatusOK || len(subscription.Events()) != 1 {
+		t.Error("Changes should be published once committed.")
+	}
+}
+
+type hookedPeopleEndpoint struct {
+	livePeopleEndpoint
+	updates *int
+}
+
+func (endpoint hookedPeopleEndpoint) AfterUpdate(ctx context.Context, old interface{}, updated interface{}) {
+	*endpoint.updates++
+}
+
+func TestTransactionsApplyAfterCommit(t *testing.T) {
+	bob := &Person{Name: "Bob", Age: 35}
+	updates := 0
+	transactor := &testTransactor{commitErr: ErrConflict}
+	handler := EndpointHandler{
+		Endpoint:   hookedPeopleEndpoint{livePeopleEndpoint{people: map[string]*Person{"bob": bob}}, &updates},
+		Transactor: transactor,
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/people/bob", strings.NewReader(`{"age":36}`)))
+	if w.Code != http.StatusConflict || bob.Age != 35 || updates != 0 {
+		t.Error("Rolled back updates should neither change the object nor run after hooks.", bob.Age, updates)
+	}
+
+	transactor.commitErr = nil
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/people/bob", strings.NewReader(`{"age":37}`)))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"age":37`) || bob.Age != 37 || updates != 1 {
+		t.Error("Committed updates should be applied.", w.Body.String(), bob.Age, updates)
+	}
+}
+
+// A Transactor whose commits wait until the test lets them through.
+type blockingTransactor struct {
+	committing chan struct{}
+	proceed    chan struct{}
+}
+
+func (transactor blockingTransactor) Begin(ctx context.Context) (Tx, error) {
+	return blockingTx{transactor}, nil
+}
+
+type blockingTx struct {
+	blockingTransactor
+}
+
+func (tx blockingTx) Commit() error {
+	tx.committing <- struct{}{}
+	<-tx.proceed
+	return nil
+}
+
+func (tx blockingTx) Rollback() error {
+	return nil
+}
+
+type sharedResourceEndpoint struct {
+	resource *JSONResource
+}
+
+func (endpoint sharedResourceEndpoint) GetResource(r *http.Request) Resource {
+	return endpoint.resource
+}
+
+func TestTransactionsSerializeUpdates(t *testing.T) {
+	bob := &Person{Name: "Bob", Age: 35}
+	transactor := blockingTransactor{committing: make(chan struct{}), proceed: make(chan struct{})}
+	handler := EndpointHandler{Endpoint: sharedResourceEndpoint{&JSONResource{Object: bob}}, Transactor: transactor}
+	codes := make(chan int, 2)
+	patch := func(body string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(body)))
+		codes <- w.Code
+	}
+
+	go patch(`{"name":"Rob"}`)
+	<-transactor.committing
+	go patch(`{"age":36}`)
+	time.Sleep(20 * time.Millisecond) // Let the second update reach the lock.
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(w.Body.String(), `"name":"Rob"`) {
+		t.Error("The resource should read as its pending update.", w.Body.String())
+	}
+	transactor.proceed <- struct{}{}
+	<-transactor.committing
+	transactor.proceed <- struct{}{}
+
+	if <-codes != http.StatusOK || <-codes != http.StatusOK {
+		t.Fatal("Both updates should succeed.")
+	}
+	if bob.Name != "Rob" || bob.Age != 36 {
+		t.Error("Concurrent updates should not overwrite each other.", *bob)
+	}
+}
+
+func TestTransactionsRollBackPendingUpdates(t *testing.T) {
+	bob := &Person{Name: "Bob", Age: 35}
+	endpoint := sharedResourceEndpoint{&JSONResource{Object: bob}}
+	handler := EndpointHandler{Endpoint: endpoint, Transactor: &testTransactor{commitErr: ErrConflict}}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(`{"age":36}`)))
+	if w.Code != http.StatusConflict {
+		t.Fatal("The commit should fail.", w.Code)
+	}
+
+	data, _ := endpoint.resource.Read()
+	if !strings.Contains(string(data), `"age":35`) {
+		t.Error("Rolled back updates should not be read.", string(data))
+	}
+	err := endpoint.resource.PartialUpdate([]byte(`{"age":37}`))
+	if err != nil || bob.Age != 37 {
+		t.Error("The object should be unlocked once the transaction ends.", err)
+	}
+}
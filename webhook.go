@@ -0,0 +1,783 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The headers webhook deliveries are sent with. The ID is the same for every attempt
+// of a delivery, so receivers can ignore deliveries they already processed.
+const (
+	WebhookIDHeader        = "X-Webhook-ID"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// A subscription to the change events of a collection, or of one of its objects,
+// which are POSTed to URL. Events limits the event types delivered, all are delivered
+// if it is empty.
+type WebhookSubscription struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	Collection string   `json:"collection,omitempty"`
+	Key        string   `json:"key,omitempty"`
+	Events     []string `json:"events,omitempty"`
+	// Generated if empty. Only returned when the subscription is created.
+	Secret  string    `json:"secret,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+func (subscription WebhookSubscription) matches(event ChangeEvent) bool {
+	if subscription.Collection != "" && subscription.Collection != event.Collection {
+		return false
+	}
+	if subscription.Key != "" && subscription.Key != event.Key {
+		return false
+	}
+	return len(subscription.Events) == 0 || containsFold(subscription.Events, event.Type)
+}
+
+// Returns the errors of the subscription's URL and event types.
+func (subscription WebhookSubscription) Validate() FieldErrors {
+	var fieldErrs FieldErrors
+	add := func(field string, message string) {
+		if fieldErrs == nil {
+			fieldErrs = NewFieldErrors()
+		}
+		fieldErrs.Add(field, message)
+	}
+	target, err := url.Parse(subscription.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		add("url", "must be an absolute http or https URL")
+	}
+	for _, eventType := range subscription.Events {
+		if eventType != ChangeCreated && eventType != ChangeUpdated && eventType != ChangeDeleted {
+			add("events", "unknown event type "+eventType)
+		}
+	}
+	return fieldErrs
+}
+
+// An attempt to deliver an event to a subscription. Status is 0 if no response was
+// received.
+type WebhookDelivery struct {
+	ID             string        `json:"id"`
+	SubscriptionID string        `json:"subscription_id"`
+	EventID        uint64        `json:"event_id"`
+	EventType      string        `json:"event_type"`
+	Attempt        int           `json:"attempt"`
+	Status         int           `json:"status,omitempty"`
+	Error          string        `json:"error,omitempty"`
+	Duration       time.Duration `json:"duration"`
+	Time           time.Time     `json:"time"`
+}
+
+// A delivery that failed every attempt, or that the receiver refused. It can be sent
+// again with Redeliver.
+type WebhookDeadLetter struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	EventID        uint64          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts"`
+	Error          string          `json:"error"`
+	Time           time.Time       `json:"time"`
+}
+
+// Delivers the events of a ChangeBus to webhook subscriptions. Each event is POSTed
+// as the JSON of the ChangeEvent, rendered for the principal that created the
+// subscription, and signed with the subscription's secret, see SignWebhook.
+// Deliveries to a subscription are made one at a time in the order of the events.
+//
+// Deliveries that fail with a network error, a 408, 429 or 5xx are retried with
+// exponential backoff, honouring Retry-After, up to MaxAttempts times. Deliveries
+// that still fail, or that get another status, are added to the dead letters.
+//
+// Webhooks is also the Endpoint managing the subscriptions: serve it with
+// EndpointHandler, under http.StripPrefix, to allow principals to list (GET /) and
+// create (POST /) their subscriptions, read (GET /{id}) and delete (DELETE /{id})
+// them, and read their delivery log (GET /{id}/deliveries) and dead letters
+// (GET /{id}/dead-letters).
+type Webhooks struct {
+	Changes *ChangeBus
+	// Defaults to a client with a 10s timeout that only connects to addresses
+	// allowed by AllowAddress. A custom Client must make its own checks.
+	Client *http.Client
+
+	// Decides which addresses deliveries may connect to and subscription URLs may
+	// name. Defaults to refusing loopback, private, shared, link-local, unspecified
+	// and multicast addresses, so subscriptions cannot reach internal services.
+	AllowAddress func(ip net.IP) bool
+
+	MaxAttempts    int           // Defaults to 5.
+	InitialBackoff time.Duration // Defaults to 1s, doubled after each attempt.
+	MaxBackoff     time.Duration // Defaults to 5m.
+
+	LogSize        int          // Deliveries logged per subscription. Defaults to 100.
+	DeadLetterSize int          // Dead letters kept, the oldest are dropped. Defaults to 1000.
+	Logger         *slog.Logger // If set, also logs failed deliveries.
+
+	// Lets requests without a principal, or whose principal has no Subject, manage
+	// every subscription through the endpoint. Only set it if the endpoint is not
+	// reachable by partners.
+	AllowAnonymous bool
+
+	mu            sync.Mutex
+	defaultClient *http.Client
+	targets       map[string]*webhookTarget
+	deadLetters   []WebhookDeadLetter
+	subscription  *Subscription
+	lastEventID   uint64
+	stop          chan struct{}
+	ctx           context.Context // Canceled by Stop, aborting deliveries in progress.
+	cancel        context.CancelFunc
+	workers       sync.WaitGroup
+}
+
+type webhookTarget struct {
+	subscription WebhookSubscription
+	principal    *Principal
+	queue        chan webhookJob
+	removed      chan struct{}
+	log          []WebhookDelivery
+}
+
+type webhookJob struct {
+	id      string
+	event   ChangeEvent
+	payload []byte
+}
+
+const webhookQueueSize = 256
+
+func (webhooks *Webhooks) maxAttempts() int {
+	if webhooks.MaxAttempts <= 0 {
+		return 5
+	}
+	return webhooks.MaxAttempts
+}
+
+func (webhooks *Webhooks) logSize() int {
+	if webhooks.LogSize <= 0 {
+		return 100
+	}
+	return webhooks.LogSize
+}
+
+func (webhooks *Webhooks) deadLetterSize() int {
+	if webhooks.DeadLetterSize <= 0 {
+		return 1000
+	}
+	return webhooks.DeadLetterSize
+}
+
+func (webhooks *Webhooks) client() *http.Client {
+	if webhooks.Client != nil {
+		return webhooks.Client
+	}
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	if webhooks.defaultClient == nil {
+		// Checked when connecting, after resolving, so DNS names and redirects cannot
+		// lead to refused addresses either.
+		dialer := &net.Dialer{Timeout: 10 * time.Second, Control: webhooks.dialControl}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+		webhooks.defaultClient = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	}
+	return webhooks.defaultClient
+}
+
+var errAddressNotAllowed = errors.New("webhook address not allowed")
+
+// The CGNAT range, shared between the customers of a provider.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func (webhooks *Webhooks) allowAddress(ip net.IP) bool {
+	if webhooks.AllowAddress != nil {
+		return webhooks.AllowAddress(ip)
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsLinkLocalUnicast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+func (webhooks *Webhooks) dialControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhooks.allowAddress(ip) {
+		return errAddressNotAllowed
+	}
+	return nil
+}
+
+// Returns whether the host of a subscription URL is allowed, as far as can be told
+// without resolving it.
+func (webhooks *Webhooks) allowHost(rawURL string) bool {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(target.Hostname()), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return webhooks.allowAddress(ip)
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return webhooks.allowAddress(net.IPv4(127, 0, 0, 1))
+	}
+	return true
+}
+
+// Returns how long to wait after the given failed attempt.
+func (webhooks *Webhooks) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	backoff := webhooks.InitialBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := webhooks.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Minute
+	}
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if retryAfter > backoff {
+		backoff = retryAfter
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+func (webhooks *Webhooks) init() {
+	if webhooks.targets == nil {
+		webhooks.targets = make(map[string]*webhookTarget)
+		webhooks.stop = make(chan struct{})
+		webhooks.ctx, webhooks.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// Starts delivering the events published to Changes.
+func (webhooks *Webhooks) Start() {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	webhooks.init()
+	if webhooks.subscription != nil {
+		return
+	}
+	webhooks.lastEventID = webhooks.Changes.LastEventID()
+	webhooks.subscription = webhooks.Changes.Subscribe("", "")
+	webhooks.workers.Add(1)
+	go webhooks.dispatch(webhooks.subscription)
+}
+
+// Stops delivering events, cancelling the deliveries in progress, and waits for the
+// workers to finish. Deliveries in progress or waiting to be made or retried are
+// added to the dead letters.
+func (webhooks *Webhooks) Stop() {
+	webhooks.mu.Lock()
+	webhooks.init()
+	if !webhooks.stopped() {
+		close(webhooks.stop)
+		webhooks.cancel()
+	}
+	if webhooks.subscription != nil {
+		webhooks.subscription.Close()
+	}
+	webhooks.mu.Unlock()
+	webhooks.workers.Wait()
+}
+
+func (webhooks *Webhooks) dispatch(subscription *Subscription) {
+	defer webhooks.workers.Done()
+	for {
+		event, ok := <-subscription.Events()
+		if ok {
+			webhooks.enqueue(event)
+			continue
+		}
+		if !subscription.Dropped() {
+			return
+		}
+		// Fell behind, resume from the last event handled, unless Stop closed the
+		// subscription meanwhile and would not close the resumed one.
+		webhooks.mu.Lock()
+		if webhooks.stopped() {
+			webhooks.mu.Unlock()
+			return
+		}
+		var missed []ChangeEvent
+		subscription, missed, _ = webhooks.Changes.Resume("", "", webhooks.lastEventID)
+		webhooks.subscription = subscription
+		webhooks.mu.Unlock()
+		for _, event := range missed {
+			webhooks.enqueue(event)
+		}
+	}
+}
+
+// Queues event for the subscriptions it matches.
+func (webhooks *Webhooks) enqueue(event ChangeEvent) {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	if webhooks.stopped() {
+		return
+	}
+	if event.ID > webhooks.lastEventID {
+		webhooks.lastEventID = event.ID
+	}
+	for _, target := range webhooks.sortedTargets() {
+		if !target.subscription.matches(event) {
+			continue
+		}
+		ctx := ContextWithPrincipal(context.Background(), target.principal)
+		if !event.visible(ctx) {
+			continue
+		}
+		payload, err := event.render(ctx)
+		if err != nil {
+			continue
+		}
+		job := webhookJob{id: NewUUIDv7(), event: event, payload: payload}
+		select {
+		case target.queue <- job:
+		default:
+			webhooks.addDeadLetter(target, job, 0, "delivery queue full")
+		}
+	}
+}
+
+func (webhooks *Webhooks) sortedTargets() []*webhookTarget {
+	targets := make([]*webhookTarget, 0, len(webhooks.targets))
+	for _, target := range webhooks.targets {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].subscription.ID < targets[j].subscription.ID
+	})
+	return targets
+}
+
+const errWebhooksStopped = "webhooks stopped"
+
+func (webhooks *Webhooks) stopped() bool {
+	select {
+	case <-webhooks.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Delivers the jobs of target until it is removed or the webhooks are stopped.
+func (webhooks *Webhooks) run(target *webhookTarget) {
+	defer webhooks.workers.Done()
+	for {
+		select {
+		case <-webhooks.stop:
+			webhooks.mu.Lock()
+			defer webhooks.mu.Unlock()
+			for {
+				select {
+				case job := <-target.queue:
+					webhooks.addDeadLetter(target, job, 0, errWebhooksStopped)
+				default:
+					return
+				}
+			}
+		case <-target.removed:
+			return
+		case job := <-target.queue:
+			if webhooks.stopped() {
+				webhooks.mu.Lock()
+				webhooks.addDeadLetter(target, job, 0, errWebhooksStopped)
+				webhooks.mu.Unlock()
+				continue
+			}
+			webhooks.deliver(target, job)
+		}
+	}
+}
+
+func (webhooks *Webhooks) deliver(target *webhookTarget, job webhookJob) {
+	for attempt := 1; ; attempt++ {
+		status, retryAfter, err := webhooks.post(target, job, attempt)
+		if err == nil {
+			return
+		}
+		retryable := status == 0 || status == http.StatusRequestTimeout ||
+			status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt >= webhooks.maxAttempts() {
+			webhooks.mu.Lock()
+			webhooks.addDeadLetter(target, job, attempt, err.Error())
+			webhooks.mu.Unlock()
+			return
+		}
+
+		timer := time.NewTimer(webhooks.backoff(attempt, retryAfter))
+		select {
+		case <-timer.C:
+		case <-target.removed:
+			timer.Stop()
+			return
+		case <-webhooks.stop:
+			timer.Stop()
+			webhooks.mu.Lock()
+			webhooks.addDeadLetter(target, job, attempt, err.Error())
+			webhooks.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Makes one delivery attempt and logs it.
+func (webhooks *Webhooks) post(target *webhookTarget, job webhookJob, attempt int) (int, time.Duration, error) {
+	start := time.Now()
+	delivery := WebhookDelivery{
+		ID:             job.id,
+		SubscriptionID: target.subscription.ID,
+		EventID:        job.event.ID,
+		EventType:      job.event.Type,
+		Attempt:        attempt,
+		Time:           start,
+	}
+	var retryAfter time.Duration
+	err := func() error {
+		request, err := http.NewRequestWithContext(webhooks.ctx, http.MethodPost, target.subscription.URL, bytes.NewReader(job.payload))
+		if err != nil {
+			return err
+		}
+		timestamp := start.Unix()
+		request.Header.Set("Content-Type", jsonContentType)
+		request.Header.Set("User-Agent", "handlers-webhooks")
+		request.Header.Set(WebhookIDHeader, job.id)
+		request.Header.Set(WebhookEventHeader, job.event.Type)
+		request.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+		request.Header.Set(WebhookSignatureHeader, SignWebhook(target.subscription.Secret, timestamp, job.payload))
+		response, err := webhooks.client().Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+		delivery.Status = response.StatusCode
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			return errors.New("receiver responded " + response.Status)
+		}
+		return nil
+	}()
+	delivery.Duration = time.Since(start)
+	if err != nil {
+		delivery.Error = err.Error()
+		if webhooks.Logger != nil {
+			webhooks.Logger.Warn("webhook delivery failed",
+				slog.String("subscription", delivery.SubscriptionID),
+				slog.String("delivery", delivery.ID),
+				slog.Int("attempt", attempt),
+				slog.String("error", delivery.Error))
+		}
+	}
+
+	webhooks.mu.Lock()
+	target.log = append(target.log, delivery)
+	if overflow := len(target.log) - webhooks.logSize(); overflow > 0 {
+		target.log = append([]WebhookDelivery(nil), target.log[overflow:]...)
+	}
+	webhooks.mu.Unlock()
+	return delivery.Status, retryAfter, err
+}
+
+func (webhooks *Webhooks) addDeadLetter(target *webhookTarget, job webhookJob, attempts int, message string) {
+	webhooks.deadLetters = append(webhooks.deadLetters, WebhookDeadLetter{
+		ID:             job.id,
+		SubscriptionID: target.subscription.ID,
+		EventID:        job.event.ID,
+		EventType:      job.event.Type,
+		Payload:        job.payload,
+		Attempts:       attempts,
+		Error:          message,
+		Time:           time.Now(),
+	})
+	if overflow := len(webhooks.deadLetters) - webhooks.deadLetterSize(); overflow > 0 {
+		webhooks.deadLetters = append([]WebhookDeadLetter(nil), webhooks.deadLetters[overflow:]...)
+	}
+}
+
+// Adds a subscription owned by the principal in ctx, whose events are rendered with
+// the fields and objects that principal may read. Returns the subscription with its
+// ID and secret.
+func (webhooks *Webhooks) Add(ctx context.Context, subscription WebhookSubscription) (WebhookSubscription, error) {
+	fieldErrs := subscription.Validate()
+	if fieldErrs == nil && !webhooks.allowHost(subscription.URL) {
+		fieldErrs = NewFieldErrors()
+		fieldErrs.Add("url", "must not be an internal address")
+	}
+	if fieldErrs != nil {
+		return WebhookSubscription{}, fieldErrs
+	}
+	principal := PrincipalFromContext(ctx)
+	subscription.ID = NewUUIDv7()
+	subscription.Owner = ""
+	if principal != nil {
+		subscription.Owner = principal.Subject
+	}
+	subscription.Created = time.Now()
+	if subscription.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		subscription.Secret = hex.EncodeToString(secret)
+	}
+	target := &webhookTarget{
+		subscription: subscription,
+		principal:    principal,
+		queue:        make(chan webhookJob, webhookQueueSize),
+		removed:      make(chan struct{}),
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	webhooks.init()
+	webhooks.targets[subscription.ID] = target
+	webhooks.workers.Add(1)
+	go webhooks.run(target)
+	return subscription, nil
+}
+
+// Removes a subscription, abandoning its pending deliveries. Returns false if there
+// is no subscription with id.
+func (webhooks *Webhooks) Remove(id string) bool {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	target, ok := webhooks.targets[id]
+	if !ok {
+		return false
+	}
+	delete(webhooks.targets, id)
+	close(target.removed)
+	return true
+}
+
+// Returns the subscriptions, without their secrets.
+func (webhooks *Webhooks) Subscriptions() []WebhookSubscription {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	subscriptions := make([]WebhookSubscription, 0, len(webhooks.targets))
+	for _, target := range webhooks.sortedTargets() {
+		subscriptions = append(subscriptions, target.subscription.withoutSecret())
+	}
+	return subscriptions
+}
+
+func (subscription WebhookSubscription) withoutSecret() WebhookSubscription {
+	subscription.Secret = ""
+	subscription.Events = append([]string(nil), subscription.Events...)
+	return subscription
+}
+
+// Returns the logged delivery attempts of a subscription, oldest first.
+func (webhooks *Webhooks) Deliveries(subscriptionID string) []WebhookDelivery {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	target, ok := webhooks.targets[subscriptionID]
+	if !ok {
+		return nil
+	}
+	return append(make([]WebhookDelivery, 0, len(target.log)), target.log...)
+}
+
+// Returns the dead letters, oldest first.
+func (webhooks *Webhooks) DeadLetters() []WebhookDeadLetter {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	return append([]WebhookDeadLetter(nil), webhooks.deadLetters...)
+}
+
+// Queues a dead letter for delivery again, with the same delivery ID.
+func (webhooks *Webhooks) Redeliver(id string) error {
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	for i, deadLetter := range webhooks.deadLetters {
+		if deadLetter.ID != id {
+			continue
+		}
+		target, ok := webhooks.targets[deadLetter.SubscriptionID]
+		if !ok {
+			return ErrNotFound
+		}
+		job := webhookJob{
+			id:      deadLetter.ID,
+			event:   ChangeEvent{ID: deadLetter.EventID, Type: deadLetter.EventType},
+			payload: deadLetter.Payload,
+		}
+		select {
+		case target.queue <- job:
+		default:
+			return errors.New("delivery queue full")
+		}
+		webhooks.deadLetters = append(webhooks.deadLetters[:i:i], webhooks.deadLetters[i+1:]...)
+		return nil
+	}
+	return ErrNotFound
+}
+
+// Returns the signature of a webhook delivery: the hex HMAC-SHA256, keyed by the
+// subscription's secret, of the timestamp header, a dot and the body, prefixed with
+// "sha256=".
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns whether a received delivery has a valid signature and a timestamp no older
+// than tolerance, which rejects replayed deliveries if it is positive.
+func VerifyWebhook(secret string, r *http.Request, body []byte, tolerance time.Duration) bool {
+	timestamp, err := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	if tolerance > 0 && time.Since(time.Unix(timestamp, 0)) > tolerance {
+		return false
+	}
+	expected := SignWebhook(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get(WebhookSignatureHeader)))
+}
+
+// Returns the resource for the subscription management path of r, see Webhooks.
+func (webhooks *Webhooks) GetResource(r *http.Request) Resource {
+	path := strings.Trim(r.URL.Path, "/")
+	if path == "" {
+		return &webhookListResource{webhooks: webhooks}
+	}
+	id, child, _ := strings.Cut(path, "/")
+	webhooks.mu.Lock()
+	target, ok := webhooks.targets[id]
+	webhooks.mu.Unlock()
+	if !ok || !webhooks.manages(target.subscription, PrincipalFromContext(r.Context())) {
+		return nil
+	}
+	switch child {
+	case "":
+		return &webhookResource{webhooks: webhooks, subscription: target.subscription.withoutSecret()}
+	case "deliveries":
+		return &JSONReadOnlyResource{Object: webhooks.Deliveries(id)}
+	case "dead-letters":
+		deadLetters := make([]WebhookDeadLetter, 0)
+		for _, deadLetter := range webhooks.DeadLetters() {
+			if deadLetter.SubscriptionID == id {
+				deadLetters = append(deadLetters, deadLetter)
+			}
+		}
+		return &JSONReadOnlyResource{Object: deadLetters}
+	}
+	return nil
+}
+
+// Returns whether principal may manage the subscription, see AllowAnonymous.
+func (webhooks *Webhooks) manages(subscription WebhookSubscription, principal *Principal) bool {
+	if principal == nil || principal.Subject == "" {
+		return webhooks.AllowAnonymous
+	}
+	return subscription.Owner == principal.Subject
+}
+
+// Returns whether principal may list and create subscriptions.
+func (webhooks *Webhooks) identifies(principal *Principal) bool {
+	return webhooks.AllowAnonymous || (principal != nil && principal.Subject != "")
+}
+
+type webhookListResource struct {
+	webhooks *Webhooks
+}
+
+func (resource *webhookListResource) GetContentType() string {
+	return jsonContentType
+}
+
+func (resource *webhookListResource) Read() ([]byte, error) {
+	return resource.ReadContext(context.Background())
+}
+
+// Returns the subscriptions of the request's principal.
+func (resource *webhookListResource) ReadContext(ctx context.Context) ([]byte, error) {
+	principal := PrincipalFromContext(ctx)
+	if !resource.webhooks.identifies(principal) {
+		return nil, ErrForbidden
+	}
+	subscriptions := make([]WebhookSubscription, 0)
+	for _, subscription := range resource.webhooks.Subscriptions() {
+		if resource.webhooks.manages(subscription, principal) {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return json.Marshal(subscriptions)
+}
+
+func (resource *webhookListResource) Create(data []byte) (Readable, error) {
+	return resource.CreateContext(context.Background(), data)
+}
+
+func (resource *webhookListResource) CreateContext(ctx context.Context, data []byte) (Readable, error) {
+	if !resource.webhooks.identifies(PrincipalFromContext(ctx)) {
+		return nil, ErrForbidden
+	}
+	var subscription WebhookSubscription
+	err := json.Unmarshal(data, &subscription)
+	if err != nil {
+		return nil, err
+	}
+	subscription, err = resource.webhooks.Add(ctx, subscription)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONReadOnlyResource{Object: subscription}, nil
+}
+
+type webhookResource struct {
+	webhooks     *Webhooks
+	subscription WebhookSubscription
+}
+
+func (resource *webhookResource) GetContentType() string {
+	return jsonContentType
+}
+
+func (resource *webhookResource) Read() ([]byte, error) {
+	return json.Marshal(resource.subscription)
+}
+
+func (resource *webhookResource) Delete() error {
+	if !resource.webhooks.Remove(resource.subscription.ID) {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int // Responded in turn, then 200.
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (receiver *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.requests = append(receiver.requests, r)
+	receiver.bodies = append(receiver.bodies, body)
+	status := http.StatusOK
+	if len(receiver.statuses) > 0 {
+		status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (receiver *webhookReceiver) received() int {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return len(receiver.requests)
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out.")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func newWebhookTest(statuses ...int) (*Webhooks, *webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{statuses: statuses}
+	server := httptest.NewServer(receiver)
+	webhooks := &Webhooks{
+		Changes:        &ChangeBus{},
+		InitialBackoff: time.Millisecond,
+		MaxAttempts:    3,
+		// The receiver listens on the loopback interface.
+		AllowAddress: func(ip net.IP) bool { return ip.IsLoopback() },
+	}
+	webhooks.Start()
+	return webhooks, receiver, server
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	webhooks, receiver, server := newWebhookTest()
+	defer server.Close()
+	defer webhooks.Stop()
+
+	subscription, err := webhooks.Add(context.Background(), WebhookSubscription{
+		URL: server.URL, Collection: "people", Events: []string{ChangeUpdated}, Secret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	publishChange(context.Background(), webhooks.Changes, ChangeUpdated, "pets", "rex", &Person{Name: "Rex"}, nil)
+	publishChange(context.Background(), webhooks.Changes, ChangeUpdated, "people", "bob", &Person{Name: "Bob", Age: 36}, nil)
+	eventually(t, func() bool { return len(webhooks.Deliveries(subscription.ID)) == 1 })
+
+	if receiver.received() != 1 {
+		t.Fatal("Only matching events should be delivered.")
+	}
+	request, body := receiver.requests[0], receiver.bodies[0]
+	if !VerifyWebhook("secret", request, body, time.Minute) || VerifyWebhook("other", request, body, 0) {
+		t.Error("Deliveries should be signed with the secret.")
+	}
+	if request.Header.Get(WebhookEventHeader) != ChangeUpdated || !strings.Contains(string(body), `"age":36`) {
+		t.Error("The event should be delivered.", string(body))
+	}
+	delivery := webhooks.Deliveries(subscription.ID)[0]
+	if delivery.Status != http.StatusOK || delivery.Attempt != 1 || delivery.ID != request.Header.Get(WebhookIDHeader) {
+		t.Error("Deliveries should be logged.", delivery)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	webhooks, receiver, server := newWebhookTest(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+	defer webhooks.Stop()
+
+	subscription, _ := webhooks.Add(context.Background(), WebhookSubscription{URL: server.URL})
+	publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	eventually(t, func() bool { return receiver.received() == 3 })
+	eventually(t, func() bool { return len(webhooks.Deliveries(subscription.ID)) == 3 })
+
+	deliveries := webhooks.Deliveries(subscription.ID)
+	if deliveries[0].Status != http.StatusServiceUnavailable || deliveries[2].Status != http.StatusOK || deliveries[2].Attempt != 3 {
+		t.Error("Failed deliveries should be retried.", deliveries)
+	}
+	if receiver.requests[0].Header.Get(WebhookIDHeader) != receiver.requests[2].Header.Get(WebhookIDHeader) {
+		t.Error("Retries should have the same delivery ID.")
+	}
+	if len(webhooks.DeadLetters()) != 0 {
+		t.Error("Delivered events should not be dead letters.")
+	}
+	if webhooks.backoff(3, 0) != 4*time.Millisecond || webhooks.backoff(1, time.Hour) != 5*time.Minute {
+		t.Error("The backoff should double up to MaxBackoff.")
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	webhooks, receiver, server := newWebhookTest(http.StatusInternalServerError, http.StatusInternalServerError,
+		http.StatusInternalServerError, http.StatusGone)
+	defer server.Close()
+	defer webhooks.Stop()
+
+	subscription, _ := webhooks.Add(context.Background(), WebhookSubscription{URL: server.URL})
+	publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	publishChange(context.Background(), webhooks.Changes, ChangeDeleted, "people", "bob", &Person{Name: "Bob"}, nil)
+	eventually(t, func() bool { return len(webhooks.DeadLetters()) == 2 })
+
+	deadLetters := webhooks.DeadLetters()
+	if deadLetters[0].Attempts != 3 || deadLetters[0].EventType != ChangeCreated || deadLetters[0].SubscriptionID != subscription.ID {
+		t.Error("Deliveries should be dead letters after MaxAttempts.", deadLetters[0])
+	}
+	if deadLetters[1].Attempts != 1 || receiver.received() != 4 {
+		t.Error("Refused deliveries should not be retried.", deadLetters[1])
+	}
+
+	if webhooks.Redeliver(deadLetters[0].ID) != nil {
+		t.Fatal("Dead letters should be redelivered.")
+	}
+	eventually(t, func() bool { return receiver.received() == 5 })
+	if len(webhooks.DeadLetters()) != 1 || receiver.requests[4].Header.Get(WebhookIDHeader) != deadLetters[0].ID {
+		t.Error("Redelivered dead letters should be removed.")
+	}
+	if webhooks.Redeliver("unknown") != ErrNotFound {
+		t.Error("Unknown dead letters should not be found.")
+	}
+}
+
+func TestWebhookDeadLetterSize(t *testing.T) {
+	webhooks, _, server := newWebhookTest(http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest)
+	defer server.Close()
+	defer webhooks.Stop()
+	webhooks.DeadLetterSize = 2
+
+	webhooks.Add(context.Background(), WebhookSubscription{URL: server.URL})
+	for i := 0; i < 3; i++ {
+		publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	}
+	eventually(t, func() bool {
+		deadLetters := webhooks.DeadLetters()
+		return len(deadLetters) == 2 && deadLetters[1].EventID == 3
+	})
+	if webhooks.DeadLetters()[0].EventID != 2 {
+		t.Error("The oldest dead letters should be dropped.")
+	}
+}
+
+func TestWebhookStop(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	webhooks := &Webhooks{Changes: &ChangeBus{}, AllowAddress: func(ip net.IP) bool { return true }}
+	webhooks.Start()
+	subscription, _ := webhooks.Add(context.Background(), WebhookSubscription{URL: server.URL})
+	for i := 0; i < 3; i++ {
+		publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	}
+
+	eventually(t, func() bool {
+		webhooks.mu.Lock()
+		defer webhooks.mu.Unlock()
+		return len(webhooks.targets[subscription.ID].queue) == 2
+	})
+
+	start := time.Now()
+	webhooks.Stop()
+	if time.Since(start) > time.Second {
+		t.Error("Stop should not wait for the receiver to respond.")
+	}
+	deadLetters := webhooks.DeadLetters()
+	if len(deadLetters) != 3 || deadLetters[0].Attempts != 1 || deadLetters[0].SubscriptionID != subscription.ID {
+		t.Fatal("The delivery in progress should be cancelled into the dead letters.", deadLetters)
+	}
+	if deadLetters[1].Error != errWebhooksStopped || deadLetters[2].Error != errWebhooksStopped {
+		t.Error("Queued deliveries should be dead letters when stopped.", deadLetters)
+	}
+}
+
+func TestWebhookStopWhileResuming(t *testing.T) {
+	webhooks := &Webhooks{Changes: &ChangeBus{}}
+	webhooks.Start()
+	webhooks.mu.Lock()
+	subscription := webhooks.subscription
+	// Overflow the subscription while dispatch cannot enqueue, so it gets dropped.
+	for i := 0; i <= subscriptionBuffer; i++ {
+		publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	}
+	close(webhooks.stop)
+	webhooks.cancel()
+	webhooks.mu.Unlock()
+
+	eventually(t, subscription.Dropped)
+	stopped := make(chan struct{})
+	go func() {
+		webhooks.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop should not wait for a subscription resumed after stopping.")
+	}
+	if webhooks.subscription != subscription {
+		t.Error("No subscription should be resumed once stopped.")
+	}
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	webhooks := &Webhooks{Changes: &ChangeBus{}, MaxAttempts: 1}
+	webhooks.Start()
+	defer webhooks.Stop()
+
+	for _, address := range []string{"http://169.254.169.254/latest", "http://10.0.0.1", "http://localhost:8080",
+		"http://[::1]/", "http://100.64.0.1", "http://0.0.0.0"} {
+		_, err := webhooks.Add(context.Background(), WebhookSubscription{URL: address})
+		if _, ok := err.(FieldErrors); !ok {
+			t.Error("Internal addresses should be refused.", address)
+		}
+	}
+
+	// As if the subscription's name came to resolve to an internal address.
+	subscription, err := webhooks.Add(context.Background(), WebhookSubscription{URL: "https://example.com/hook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks.mu.Lock()
+	webhooks.targets[subscription.ID].subscription.URL = server.URL
+	webhooks.mu.Unlock()
+	publishChange(context.Background(), webhooks.Changes, ChangeCreated, "people", "bob", &Person{Name: "Bob"}, nil)
+	eventually(t, func() bool { return len(webhooks.DeadLetters()) == 1 })
+	if receiver.received() != 0 || !strings.Contains(webhooks.DeadLetters()[0].Error, "not allowed") {
+		t.Error("Deliveries to internal addresses should be refused.", webhooks.DeadLetters())
+	}
+}
+
+func TestWebhookEndpoint(t *testing.T) {
+	webhooks := &Webhooks{Changes: &ChangeBus{}}
+	defer webhooks.Stop()
+	handler := EndpointHandler{
+		Endpoint: webhooks,
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{
+			"alice":   {Subject: "alice"},
+			"bob":     {Subject: "bob"},
+			"service": {},
+		}},
+		AllowAnonymous: true,
+	}
+	serve := func(method string, path string, body string, key string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		request.Header.Set("X-API-Key", key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	response := serve(http.MethodPost, "/", `{"url":"ftp://example.com","events":["renamed"]}`, "alice")
+	var fieldErrs map[string]string
+	json.Unmarshal(response.Body.Bytes(), &fieldErrs)
+	if response.Code != http.StatusBadRequest || fieldErrs["url"] == "" || fieldErrs["events"] == "" {
+		t.Error("Invalid subscriptions should be refused.", response.Body.String())
+	}
+
+	response = serve(http.MethodPost, "/", `{"url":"https://example.com/hook","collection":"people"}`, "alice")
+	var subscription WebhookSubscription
+	json.Unmarshal(response.Body.Bytes(), &subscription)
+	if response.Code != http.StatusCreated || subscription.Secret == "" || subscription.Owner != "alice" {
+		t.Fatal("Subscriptions should be created with a secret.", response.Body.String())
+	}
+
+	response = serve(http.MethodGet, "/"+subscription.ID, "", "alice")
+	if response.Code != http.StatusOK || strings.Contains(response.Body.String(), subscription.Secret) {
+		t.Error("Secrets should not be returned after creation.", response.Body.String())
+	}
+	if response = serve(http.MethodGet, "/", "", "bob"); response.Body.String() != "[]" {
+		t.Error("Principals should only list their own subscriptions.", response.Body.String())
+	}
+	if response = serve(http.MethodDelete, "/"+subscription.ID, "", "bob"); response.Code != http.StatusNotFound {
+		t.Error("Principals should not manage others' subscriptions.")
+	}
+	for _, key := range []string{"", "service"} {
+		if response = serve(http.MethodGet, "/"+subscription.ID+"/deliveries", "", key); response.Code != http.StatusNotFound {
+			t.Error("Anonymous requests should not manage subscriptions.", key)
+		}
+		if response = serve(http.MethodGet, "/", "", key); response.Code != http.StatusForbidden {
+			t.Error("Anonymous requests should not list subscriptions.", key)
+		}
+		if response = serve(http.MethodPost, "/", `{"url":"https://example.com"}`, key); response.Code != http.StatusForbidden {
+			t.Error("Anonymous requests should not create subscriptions.", key)
+		}
+	}
+	webhooks.AllowAnonymous = true
+	if response = serve(http.MethodGet, "/"+subscription.ID, "", ""); response.Code != http.StatusOK {
+		t.Error("Anonymous requests should manage every subscription when allowed.")
+	}
+	webhooks.AllowAnonymous = false
+	if response = serve(http.MethodGet, "/"+subscription.ID+"/deliveries", "", "alice"); response.Body.String() != "[]" {
+		t.Error("Deliveries should be listed.", response.Body.String())
+	}
+	if response = serve(http.MethodDelete, "/"+subscription.ID, "", "alice"); response.Code != http.StatusOK && response.Code != http.StatusNoContent {
+		t.Error("Subscriptions should be deleted.", response.Code)
+	}
+	if len(webhooks.Subscriptions()) != 0 {
+		t.Error("Deleted subscriptions should be removed.")
+	}
+}
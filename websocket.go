@@ -0,0 +1,530 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Serves live updates over a WebSocket (RFC 6455). Clients send JSON messages to
+// subscribe to resource paths and to patch resources:
+//
+//	{"type": "subscribe", "path": "/people/bob"}
+//	{"type": "unsubscribe", "path": "/people/bob"}
+//	{"type": "patch", "id": "1", "path": "/people/bob", "data": {"age": 36}}
+//
+// A subscribe is answered with the resource's current state, read with a GET through
+// Handler, then the path's change events follow:
+//
+//	{"type": "subscribed", "path": "/people/bob", "object": {...}}
+//	{"type": "event", "path": "/people/bob", "event": {...}}
+//
+// A patch is served as a PATCH request through Handler, so it passes the same
+// authentication, authorization, field policies, validation and hooks as a PATCH
+// over HTTP, and is answered with the patched object or an error carrying the
+// request's FieldErrors:
+//
+//	{"type": "patched", "id": "1", "path": "/people/bob", "object": {...}}
+//	{"type": "error", "id": "1", "path": "/people/bob", "status": 400, "errors": {"age": "too old"}}
+//
+// Requests made through Handler carry the headers of the WebSocket handshake, so
+// credentials sent with it authenticate them.
+type WebSocketHandler struct {
+	// Serves the GET and PATCH requests for messages, usually the handler serving
+	// the REST API.
+	Handler http.Handler
+	Changes *ChangeBus
+
+	// Returns the collection and key of the change events for a path. Defaults to
+	// treating "/collection" and "/collection/key" paths as such.
+	Subscription func(path string) (collection string, key string, ok bool)
+
+	// Reports whether a handshake from the request's Origin is allowed. Defaults to
+	// allowing requests without an Origin and those from the request's host.
+	CheckOrigin func(r *http.Request) bool
+
+	MaxMessageBytes int64 // Defaults to 1MB.
+}
+
+// A message from or to a WebSocket client.
+type webSocketMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Path    string          `json:"path,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Object  json.RawMessage `json:"object,omitempty"`
+	Event   json.RawMessage `json:"event,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Errors  json.RawMessage `json:"errors,omitempty"`
+	Message string          `json:"message,omitempty"`
+}
+
+func (handler *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !handler.checkOrigin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	conn.maxMessageBytes = handler.MaxMessageBytes
+	if conn.maxMessageBytes <= 0 {
+		conn.maxMessageBytes = 1 << 20
+	}
+	session := &webSocketSession{handler: handler, conn: conn, request: r, subscriptions: make(map[string]*Subscription)}
+	defer session.close()
+	session.run()
+}
+
+func (handler *WebSocketHandler) checkOrigin(r *http.Request) bool {
+	if handler.CheckOrigin != nil {
+		return handler.CheckOrigin(r)
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, r.Host)
+}
+
+func (handler *WebSocketHandler) subscription(path string) (string, string, bool) {
+	if handler.Subscription != nil {
+		return handler.Subscription(path)
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return parts[0], "", true
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+type webSocketSession struct {
+	handler *WebSocketHandler
+	conn    *webSocketConn
+	request *http.Request
+
+	mu            sync.Mutex
+	subscriptions map[string]*Subscription
+	forwarders    sync.WaitGroup
+}
+
+func (session *webSocketSession) run() {
+	for {
+		data, err := session.conn.readMessage()
+		if err != nil {
+			return
+		}
+		var message webSocketMessage
+		if json.Unmarshal(data, &message) != nil {
+			session.send(webSocketMessage{Type: "error", Status: http.StatusBadRequest, Message: "invalid message"})
+			continue
+		}
+		switch message.Type {
+		case "subscribe":
+			session.subscribe(message)
+		case "unsubscribe":
+			session.unsubscribe(message.Path)
+			session.send(webSocketMessage{Type: "unsubscribed", ID: message.ID, Path: message.Path})
+		case "patch":
+			session.patch(message)
+		default:
+			session.send(webSocketMessage{Type: "error", ID: message.ID, Status: http.StatusBadRequest, Message: "unknown message type"})
+		}
+	}
+}
+
+func (session *webSocketSession) send(message webSocketMessage) {
+	data, err := json.Marshal(message)
+	if err == nil {
+		session.conn.writeMessage(opText, data)
+	}
+}
+
+// Serves a request for a message through the handler, with the handshake's headers
+// but for Accept-Encoding, as replies embed the response body as JSON. Also returns
+// what the handler learned about the request, such as its principal.
+func (session *webSocketSession) serve(method string, path string, body []byte) (*bufferedResponse, *requestInfo) {
+	info := &requestInfo{}
+	ctx := context.WithValue(session.request.Context(), requestInfoContextKey{}, info)
+	r, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(body))
+	response := newBufferedResponse()
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(err.Error()))
+		return response, info
+	}
+	for name, values := range session.request.Header {
+		if !strings.HasPrefix(name, "Sec-Websocket-") && name != "Upgrade" && name != "Connection" && name != "Accept-Encoding" {
+			r.Header[name] = values
+		}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = session.request.RemoteAddr
+	r.Host = session.request.Host
+	session.handler.Handler.ServeHTTP(response, r)
+	if response.status == 0 {
+		response.status = http.StatusOK
+	}
+	return response, info
+}
+
+// Converts an error response into an error message.
+func errorMessage(message webSocketMessage, response *bufferedResponse) webSocketMessage {
+	reply := webSocketMessage{Type: "error", ID: message.ID, Path: message.Path, Status: response.status}
+	body := response.body.Bytes()
+	if strings.HasPrefix(response.header.Get("Content-Type"), "application/json") && json.Valid(body) {
+		reply.Errors = body
+	} else if len(body) > 0 {
+		reply.Message = string(body)
+	} else {
+		reply.Message = http.StatusText(response.status)
+	}
+	return reply
+}
+
+func (session *webSocketSession) subscribe(message webSocketMessage) {
+	collection, key, ok := session.handler.subscription(message.Path)
+	if !ok || session.handler.Changes == nil {
+		session.send(webSocketMessage{Type: "error", ID: message.ID, Path: message.Path, Status: http.StatusNotFound, Message: "cannot subscribe to path"})
+		return
+	}
+	// Subscribe before reading the object, so no change made after the read is missed.
+	subscription := session.handler.Changes.Subscribe(collection, key)
+	response, info := session.serve(http.MethodGet, message.Path, nil)
+	if response.status >= http.StatusBadRequest {
+		subscription.Close()
+		session.send(errorMessage(message, response))
+		return
+	}
+
+	session.mu.Lock()
+	previous := session.subscriptions[message.Path]
+	session.subscriptions[message.Path] = subscription
+	session.mu.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	reply := webSocketMessage{Type: "subscribed", ID: message.ID, Path: message.Path}
+	if json.Valid(response.body.Bytes()) {
+		reply.Object = response.body.Bytes()
+	}
+	session.send(reply)
+
+	// Render events for the principal the GET was authenticated as.
+	ctx := session.request.Context()
+	if info.principal != nil {
+		ctx = ContextWithPrincipal(ctx, info.principal)
+	}
+	session.forwarders.Add(1)
+	go func() {
+		defer session.forwarders.Done()
+		for event := range subscription.Events() {
+			if !event.visible(ctx) {
+				continue
+			}
+			data, err := event.render(ctx)
+			if err == nil {
+				session.send(webSocketMessage{Type: "event", Path: message.Path, Event: data})
+			}
+		}
+		if subscription.Dropped() {
+			session.send(webSocketMessage{Type: "error", Path: message.Path, Status: http.StatusServiceUnavailable, Message: "subscription dropped, resubscribe"})
+		}
+	}()
+}
+
+func (session *webSocketSession) unsubscribe(path string) {
+	session.mu.Lock()
+	subscription := session.subscriptions[path]
+	delete(session.subscriptions, path)
+	session.mu.Unlock()
+	if subscription != nil {
+		subscription.Close()
+	}
+}
+
+func (session *webSocketSession) patch(message webSocketMessage) {
+	response, _ := session.serve(http.MethodPatch, message.Path, message.Data)
+	if response.status >= http.StatusBadRequest {
+		session.send(errorMessage(message, response))
+		return
+	}
+	reply := webSocketMessage{Type: "patched", ID: message.ID, Path: message.Path}
+	if json.Valid(response.body.Bytes()) {
+		reply.Object = response.body.Bytes()
+	}
+	session.send(reply)
+}
+
+func (session *webSocketSession) close() {
+	session.mu.Lock()
+	subscriptions := session.subscriptions
+	session.subscriptions = nil
+	session.mu.Unlock()
+	for _, subscription := range subscriptions {
+		subscription.Close()
+	}
+	session.forwarders.Wait()
+	session.conn.close(closeNormal, "")
+}
+
+// WebSocket opcodes and close codes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	closeNormal          = 1000
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeInvalidPayload  = 1007
+	closeMessageTooBig   = 1009
+)
+
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errWebSocketClosed   = errors.New("websocket closed")
+	errWebSocketProtocol = errors.New("websocket protocol error")
+)
+
+// The server side of a WebSocket connection.
+type webSocketConn struct {
+	conn            net.Conn
+	reader          *bufio.Reader
+	maxMessageBytes int64
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the Sec-WebSocket-Accept value for a handshake key.
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// Completes the opening handshake and takes over the connection. Invalid handshakes
+// are answered with a 400 or, for other versions, a 426.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*webSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decodedKey, keyErr := base64.StdEncoding.DecodeString(key)
+	if r.Method != http.MethodGet || !headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") || keyErr != nil || len(decodedKey) != 16 {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, errWebSocketProtocol
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return nil, errWebSocketProtocol
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &webSocketConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+func (ws *webSocketConn) readFrame(limit int64) (webSocketFrame, error) {
+	var header [2]byte
+	_, err := io.ReadFull(ws.reader, header[:])
+	if err != nil {
+		return webSocketFrame{}, err
+	}
+	frame := webSocketFrame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0f}
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7f)
+	if header[0]&0x70 != 0 || !masked {
+		// No extensions are negotiated, and clients must mask their frames.
+		return frame, errWebSocketProtocol
+	}
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(ws.reader, extended[:])
+		length = int64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(ws.reader, extended[:])
+		length = int64(binary.BigEndian.Uint64(extended[:]))
+	}
+	if err != nil {
+		return frame, err
+	}
+	if frame.opcode >= opClose && (length > 125 || !frame.fin) {
+		return frame, errWebSocketProtocol
+	}
+	if length < 0 || length > limit {
+		return frame, errMessageTooBig
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(ws.reader, mask[:])
+	if err != nil {
+		return frame, err
+	}
+	frame.payload = make([]byte, length)
+	_, err = io.ReadFull(ws.reader, frame.payload)
+	if err != nil {
+		return frame, err
+	}
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i%4]
+	}
+	return frame, nil
+}
+
+var errMessageTooBig = errors.New("websocket message too big")
+
+// Returns the next text message, answering pings and close frames on the way.
+func (ws *webSocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	messageOpcode := byte(0)
+	for {
+		frame, err := ws.readFrame(ws.maxMessageBytes - int64(len(message)))
+		if errors.Is(err, errMessageTooBig) {
+			ws.close(closeMessageTooBig, "message too big")
+			return nil, err
+		}
+		if errors.Is(err, errWebSocketProtocol) {
+			ws.close(closeProtocolError, "")
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch frame.opcode {
+		case opPing:
+			ws.writeMessage(opPong, frame.payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			code := closeNormal
+			if len(frame.payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(frame.payload))
+			}
+			ws.close(code, "")
+			return nil, errWebSocketClosed
+		case opText, opBinary:
+			if messageOpcode != 0 {
+				ws.close(closeProtocolError, "")
+				return nil, errWebSocketProtocol
+			}
+			messageOpcode = frame.opcode
+		case opContinuation:
+			if messageOpcode == 0 {
+				ws.close(closeProtocolError, "")
+				return nil, errWebSocketProtocol
+			}
+		default:
+			ws.close(closeProtocolError, "")
+			return nil, errWebSocketProtocol
+		}
+
+		message = append(message, frame.payload...)
+		if !frame.fin {
+			continue
+		}
+		if messageOpcode == opBinary {
+			ws.close(closeUnsupportedData, "text messages only")
+			return nil, errWebSocketProtocol
+		}
+		if !utf8.Valid(message) {
+			ws.close(closeInvalidPayload, "")
+			return nil, errWebSocketProtocol
+		}
+		return message, nil
+	}
+}
+
+func (ws *webSocketConn) writeMessage(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closed {
+		return errWebSocketClosed
+	}
+	return ws.writeFrame(opcode, payload)
+}
+
+func (ws *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// Sends a close frame, once, and closes the connection.
+func (ws *webSocketConn) close(code int, reason string) {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closed {
+		return
+	}
+	ws.closed = true
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	ws.writeFrame(opClose, append(payload, reason...))
+	ws.conn.Close()
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type webSocketClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, header string) *webSocketClient {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	handshake := "GET /live HTTP/1.1\r\nHost: " + strings.TrimPrefix(server.URL, "http://") + "\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" + header + "\r\n"
+	conn.Write([]byte(handshake))
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		response.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("Handshake failed.")
+	}
+	return &webSocketClient{t: t, conn: conn, reader: reader}
+}
+
+func (client *webSocketClient) writeFrame(fin bool, opcode byte, payload []byte) {
+	header := []byte{opcode, 0x80}
+	if fin {
+		header[0] |= 0x80
+	}
+	switch {
+	case len(payload) <= 125:
+		header[1] |= byte(len(payload))
+	default:
+		header[1] |= 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	masked := make([]byte, len(payload))
+	for i := range payload {
+		masked[i] = payload[i] ^ mask[i%4]
+	}
+	client.conn.Write(append(append(header, mask...), masked...))
+}
+
+func (client *webSocketClient) send(message string) {
+	client.writeFrame(true, opText, []byte(message))
+}
+
+func (client *webSocketClient) readFrame() (byte, []byte) {
+	var header [2]byte
+	_, err := io.ReadFull(client.reader, header[:])
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		var extended [2]byte
+		io.ReadFull(client.reader, extended[:])
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload := make([]byte, length)
+	io.ReadFull(client.reader, payload)
+	return header[0] & 0x0f, payload
+}
+
+func (client *webSocketClient) receive() webSocketMessage {
+	opcode, payload := client.readFrame()
+	if opcode != opText {
+		client.t.Fatal("Expected a text message.")
+	}
+	var message webSocketMessage
+	json.Unmarshal(payload, &message)
+	return message
+}
+
+type livePeopleEndpoint struct {
+	people map[string]*Person
+	bus    *ChangeBus
+}
+
+func (endpoint livePeopleEndpoint) GetResource(r *http.Request) Resource {
+	name := strings.TrimPrefix(r.URL.Path, "/people/")
+	person, ok := endpoint.people[name]
+	if !ok {
+		return nil
+	}
+	return &JSONResource{Object: person, Changes: endpoint.bus, Collection: "people", Key: name}
+}
+
+func newLiveServer() (*httptest.Server, *ChangeBus) {
+	bus := &ChangeBus{}
+	api := EndpointHandler{
+		Endpoint:      livePeopleEndpoint{people: map[string]*Person{"bob": {Name: "Bob", Age: 35}}, bus: bus},
+		Authenticator: &APIKeyAuthenticator{Keys: map[string]*Principal{"key": {Subject: "alice"}}},
+	}
+	return httptest.NewServer(&WebSocketHandler{Handler: api, Changes: bus}), bus
+}
+
+func TestWebSocketSubscribeAndPatch(t *testing.T) {
+	server, _ := newLiveServer()
+	defer server.Close()
+	client := dialWebSocket(t, server, "X-API-Key: key\r\n")
+
+	client.send(`{"type":"subscribe","id":"s","path":"/people/bob"}`)
+	message := client.receive()
+	if message.Type != "subscribed" || !strings.Contains(string(message.Object), `"age":35`) {
+		t.Fatal("Subscribing should return the current state.", message)
+	}
+
+	// A fragmented message, with a ping in between.
+	patch := []byte(`{"type":"patch","id":"1","path":"/people/bob","data":{"age":36}}`)
+	client.writeFrame(false, opText, patch[:10])
+	client.writeFrame(true, opPing, []byte("hi"))
+	client.writeFrame(true, opContinuation, patch[10:])
+	if opcode, payload := client.readFrame(); opcode != opPong || string(payload) != "hi" {
+		t.Error("Pings should be answered.")
+	}
+
+	received := map[string]webSocketMessage{}
+	for i := 0; i < 2; i++ {
+		message = client.receive()
+		received[message.Type] = message
+	}
+	if received["patched"].ID != "1" || !strings.Contains(string(received["patched"].Object), `"age":36`) {
+		t.Error("Patches should be answered with the object.", received)
+	}
+	if !strings.Contains(string(received["event"].Event), `"type":"updated"`) || received["event"].Path != "/people/bob" {
+		t.Error("Subscribers should receive change events.", received)
+	}
+
+	client.send(`{"type":"patch","id":"2","path":"/people/bob","data":{"name":"Fred"}}`)
+	message = client.receive()
+	var fieldErrs map[string]string
+	json.Unmarshal(message.Errors, &fieldErrs)
+	if message.Type != "error" || message.ID != "2" || message.Status != http.StatusBadRequest || fieldErrs["name"] != "invalid" {
+		t.Error("Validation errors should be returned as FieldErrors.", message)
+	}
+
+	client.writeFrame(true, opClose, binary.BigEndian.AppendUint16(nil, closeNormal))
+	if opcode, _ := client.readFrame(); opcode != opClose {
+		t.Error("Close frames should be echoed.")
+	}
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	bus := &ChangeBus{}
+	api := EndpointHandler{
+		Endpoint:   livePeopleEndpoint{people: map[string]*Person{"bob": {Name: "Bob", Age: 35}}, bus: bus},
+		Compressor: &Compressor{MinSize: 1},
+	}
+	server := httptest.NewServer(&WebSocketHandler{Handler: api, Changes: bus})
+	defer server.Close()
+	client := dialWebSocket(t, server, "Accept-Encoding: gzip\r\n")
+
+	client.send(`{"type":"subscribe","id":"s","path":"/people/bob"}`)
+	if message := client.receive(); message.Type != "subscribed" || !strings.Contains(string(message.Object), `"age":35`) {
+		t.Error("Objects should not be compressed.", message)
+	}
+	client.send(`{"type":"patch","id":"1","path":"/people/bob","data":{"age":36}}`)
+	received := map[string]webSocketMessage{}
+	for i := 0; i < 2; i++ {
+		message := client.receive()
+		received[message.Type] = message
+	}
+	if !strings.Contains(string(received["patched"].Object), `"age":36`) {
+		t.Error("Patched objects should not be compressed.", received)
+	}
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	server, _ := newLiveServer()
+	defer server.Close()
+	client := dialWebSocket(t, server, "")
+
+	client.send(`{"type":"subscribe","path":"/people/bob"}`)
+	if message := client.receive(); message.Type != "error" || message.Status != http.StatusUnauthorized {
+		t.Error("Subscriptions should be authenticated.", message)
+	}
+	client.send(`{"type":"patch","path":"/people/bob","data":{"age":1}}`)
+	if message := client.receive(); message.Type != "error" || message.Status != http.StatusUnauthorized {
+		t.Error("Patches should be authenticated.", message)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	server, _ := newLiveServer()
+	defer server.Close()
+
+	client := dialWebSocket(t, server, "")
+	client.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	opcode, payload := client.readFrame()
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != closeProtocolError {
+		t.Error("Unmasked client frames should close the connection.")
+	}
+
+	client = dialWebSocket(t, server, "")
+	client.send(strings.Repeat("a", 2<<20)[:60000])
+	client.writeFrame(true, opBinary, []byte{1})
+	opcode, payload = client.readFrame()
+	if opcode == opText {
+		opcode, payload = client.readFrame()
+	}
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != closeUnsupportedData {
+		t.Error("Binary messages should be refused.")
+	}
+
+	response, err := http.Get(server.URL)
+	if err != nil || response.StatusCode != http.StatusBadRequest {
+		t.Error("Requests that are not handshakes should be rejected.")
+	}
+}
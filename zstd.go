@@ -0,0 +1,29 @@
+//go:build zstd
+
+// The zstd content coding, which has no standard library implementation. Build with
+//
+//	go get github.com/klauspost/compress && go build -tags zstd
+//
+// to have Compressor offer it and request bodies in it decoded.
+package handlers
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	RegisterEncoder("zstd", func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	})
+	// Windows are capped at the 8MB RFC 8878 asks HTTP decoders to support, so a
+	// frame header cannot make a request allocate more.
+	RegisterDecoder("zstd", func(r io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	})
+}
@@ -0,0 +1,55 @@
+//go:build zstd
+
+// Tests of the zstd coding, run with
+//
+//	go get github.com/klauspost/compress && go test -tags zstd ./...
+package handlers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressorZstd(t *testing.T) {
+	body := strings.Repeat(`{"name":"Rex"}`, 200)
+	w := serveCompressed(&Compressor{}, "gzip, zstd", "application/json", body)
+	if w.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatal("zstd should be preferred when the tag provides it.")
+	}
+	decoder, err := zstd.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	data, _ := ioutil.ReadAll(decoder)
+	if string(data) != body {
+		t.Error("Body should survive compression.")
+	}
+}
+
+func TestZstdRequestBodies(t *testing.T) {
+	dataStore = make(map[string]*PetObject)
+	handler := EndpointHandler{Endpoint: PetListResourceDispatcher{}, MaxBodyBytes: 1000}
+	post := func(body string) *httptest.ResponseRecorder {
+		encoder, _ := zstd.NewWriter(nil)
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(encoder.EncodeAll([]byte(body), nil)))
+		r.Header.Set("Content-Encoding", "zstd")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post(`{"id":"zstd","name":"Foo"}`); w.Code != http.StatusCreated || dataStore["zstd"] == nil {
+		t.Error("Should decode zstd request bodies.", w.Code)
+	}
+	bomb := `{"id":"bomb","name":"` + strings.Repeat("a", 100000) + `"}`
+	if w := post(bomb); w.Code != http.StatusRequestEntityTooLarge || dataStore["bomb"] != nil {
+		t.Error("The limit should apply to the decompressed body.", w.Code)
+	}
+}